@@ -6,10 +6,65 @@ package jnigi
 
 /*
 #include<jni.h>
+#include<stdarg.h>
+#include<stdio.h>
+#include<stdlib.h>
+
+// implemented in jvm_hooks.go
+extern void go_jvm_vfprintf(char* msg, int len);
+extern void go_jvm_exit(jint code);
+extern void go_jvm_abort(void);
+
+// jvm_vfprintf, jvm_exit and jvm_abort are passed to the JVM as the extraInfo of the vfprintf,
+// exit and abort options
+jint JNICALL jvm_vfprintf(FILE* fp, const char* format, va_list args) {
+	char buf[1024];
+	va_list copy;
+	va_copy(copy, args);
+	int n = vsnprintf(buf, sizeof(buf), format, copy);
+	va_end(copy);
+	if (n < 0) {
+		return n;
+	}
+	if (n < (int)sizeof(buf)) {
+		go_jvm_vfprintf(buf, n);
+		return n;
+	}
+	char* big = malloc(n + 1);
+	if (big == NULL) {
+		return -1;
+	}
+	vsnprintf(big, n + 1, format, args);
+	go_jvm_vfprintf(big, n);
+	free(big);
+	return n;
+}
+
+void JNICALL jvm_exit(jint code) {
+	go_jvm_exit(code);
+	exit(code);
+}
+
+void JNICALL jvm_abort(void) {
+	go_jvm_abort();
+	abort();
+}
+
+void* jvm_hook(int i) {
+	switch (i) {
+	case 0:
+		return (void*)jvm_vfprintf;
+	case 1:
+		return (void*)jvm_exit;
+	default:
+		return (void*)jvm_abort;
+	}
+}
 */
 import "C"
 
 import (
+	"errors"
 	"unsafe"
 )
 
@@ -18,30 +73,108 @@ const jni_abort = C.JNI_ABORT
 
 // These functions deal with initializing C structs
 
-// NewJVMInitArgs builds JNI JavaVMInitArgs using GetDefaultJavaVMInitArgs and parameters.
+// NewJVMInitArgs builds JNI JavaVMInitArgs using GetDefaultJavaVMInitArgs and parameters. If version
+// is NEGOTIATE_VERSION, CreateJVM uses the highest JNI version supported by the JVM. It panics if the
+// version is not supported, JVMConfig.Build returns an error instead.
 func NewJVMInitArgs(ignoreUnrecognizedArgs bool, includeDefaultArgs bool, version int, args []string) *JVMInitArgs {
+	a, err := newJVMInitArgs(ignoreUnrecognizedArgs, includeDefaultArgs, version, args, nil)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// newJVMInitArgs is NewJVMInitArgs returning an error, the extraInfo of options named in hooks is
+// set to the C hook function, see jvmHooks.
+func newJVMInitArgs(ignoreUnrecognizedArgs bool, includeDefaultArgs bool, version int, args []string, hooks *jvmHooks) (*JVMInitArgs, error) {
 	jvmargs := (*C.JavaVMInitArgs)(calloc(unsafe.Sizeof(C.JavaVMInitArgs{}), 1))
+	a := &JVMInitArgs{javaVMInitArgs: unsafe.Pointer(jvmargs), hooks: hooks}
 	jvmargs.version = C.jint(version)
 	if includeDefaultArgs {
+		if version == NEGOTIATE_VERSION {
+			// every JVM supports 1.2, the version is negotiated by CreateJVM
+			jvmargs.version = C.jint(JNI_VERSION_1_2)
+		}
 		if jni_GetDefaultJavaVMInitArgs(unsafe.Pointer(jvmargs)) < 0 {
-			panic("JNI_GetDefaultJavaVMInitArgs failed")
+			a.Free()
+			return nil, errors.New("JNIGI: JNI_GetDefaultJavaVMInitArgs failed, JNI version " + VersionString(version) + " is not supported by the JVM")
 		}
+		jvmargs.version = C.jint(version)
 	}
 	if ignoreUnrecognizedArgs {
 		jvmargs.ignoreUnrecognized = (C.jboolean)(jboolean(1))
 	}
+	if len(args) == 0 {
+		return a, nil
+	}
+	jvmargs.options = (*C.JavaVMOption)(calloc(uintptr(len(args)), unsafe.Sizeof(C.JavaVMOption{})))
 	for _, arg := range args {
-		cStr := cString(arg)
-		jvmargs.nOptions++
-		jvmargs.options = (*C.JavaVMOption)(realloc(unsafe.Pointer(jvmargs.options), uintptr(jvmargs.nOptions)*unsafe.Sizeof(C.JavaVMOption{})))
-		if unsafe.Pointer(jvmargs.options) == nil {
-			panic("NewJVMInitArgs realloc call failed")
-		}
-		option := (*C.JavaVMOption)(unsafe.Pointer(uintptr(unsafe.Pointer(jvmargs.options)) + unsafe.Sizeof(C.JavaVMOption{})*uintptr(jvmargs.nOptions-1)))
-		option.optionString = (*C.char)(cStr)
+		option := (*C.JavaVMOption)(unsafe.Pointer(uintptr(unsafe.Pointer(jvmargs.options)) + unsafe.Sizeof(C.JavaVMOption{})*uintptr(jvmargs.nOptions)))
+		option.optionString = (*C.char)(cString(arg))
 		option.extraInfo = unsafe.Pointer(nil)
+		if hooks != nil {
+			option.extraInfo = hooks.extraInfo(arg)
+		}
+		jvmargs.nOptions++
+	}
+	return a, nil
+}
+
+// Free frees the C memory of a. It is called by CreateJVM for JVMInitArgs built by JVMConfig, and
+// can be called after CreateJVM for JVMInitArgs built by NewJVMInitArgs. a must not be used after.
+func (a *JVMInitArgs) Free() {
+	if a.javaVMInitArgs == nil {
+		return
+	}
+	jvmargs := (*C.JavaVMInitArgs)(a.javaVMInitArgs)
+	for i := 0; i < int(jvmargs.nOptions); i++ {
+		option := (*C.JavaVMOption)(unsafe.Pointer(uintptr(unsafe.Pointer(jvmargs.options)) + unsafe.Sizeof(C.JavaVMOption{})*uintptr(i)))
+		free(unsafe.Pointer(option.optionString))
+	}
+	free(unsafe.Pointer(jvmargs.options))
+	free(a.javaVMInitArgs)
+	a.javaVMInitArgs = nil
+}
+
+// options returns the option strings of a.
+func (a *JVMInitArgs) options() []string {
+	jvmargs := (*C.JavaVMInitArgs)(a.javaVMInitArgs)
+	opts := make([]string, int(jvmargs.nOptions))
+	for i := range opts {
+		option := (*C.JavaVMOption)(unsafe.Pointer(uintptr(unsafe.Pointer(jvmargs.options)) + unsafe.Sizeof(C.JavaVMOption{})*uintptr(i)))
+		opts[i] = C.GoString(option.optionString)
 	}
-	return &JVMInitArgs{unsafe.Pointer(jvmargs)}
+	return opts
+}
+
+func (a *JVMInitArgs) version() int {
+	return int((*C.JavaVMInitArgs)(a.javaVMInitArgs).version)
+}
+
+func (a *JVMInitArgs) setVersion(version int) {
+	(*C.JavaVMInitArgs)(a.javaVMInitArgs).version = C.jint(version)
+}
+
+// jvmHookFunc returns the C function for the vfprintf, exit or abort option.
+func jvmHookFunc(option string) unsafe.Pointer {
+	switch option {
+	case "vfprintf":
+		return C.jvm_hook(0)
+	case "exit":
+		return C.jvm_hook(1)
+	case "abort":
+		return C.jvm_hook(2)
+	}
+	return nil
+}
+
+// newJVMAttachArgs builds JNI JavaVMAttachArgs, name must be a C string or nil. Free with free.
+func newJVMAttachArgs(version int, name unsafe.Pointer, group jobject) unsafe.Pointer {
+	args := (*C.JavaVMAttachArgs)(calloc(unsafe.Sizeof(C.JavaVMAttachArgs{}), 1))
+	args.version = C.jint(version)
+	args.name = (*C.char)(name)
+	args.group = C.jobject(unsafe.Pointer(group))
+	return unsafe.Pointer(args)
 }
 
 func registerNative(env unsafe.Pointer, class jclass, mnCstr, sigCstr, fptr unsafe.Pointer) int {
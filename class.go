@@ -0,0 +1,267 @@
+package jnigi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// Class holds a reference to a Java class. A class found by name with GetClass is owned by the JVM's
+// class cache, it does not need to be released and is valid until the JVM is destroyed, or the class
+// loader it was found with is released or reloaded. A class returned by DefineClass, GetObjectClass,
+// Superclass, Interfaces or ComponentType owns a global reference, call Release when it is no longer
+// used so the class can be unloaded.
+type Class struct {
+	class jclass
+	name  string
+	// owned is true if class is a global reference of this Class, deleted by Release
+	owned bool
+}
+
+// GetClass returns the class className.
+func (j *Env) GetClass(className string) (*Class, error) {
+	class, err := j.callFindClass(className)
+	if err != nil {
+		return nil, err
+	}
+	return &Class{class: class, name: className}, nil
+}
+
+// DefineClass calls JNI DefineClass to define class className from the class file data in bytecode,
+// using class loader loader. If loader is nil the bootstrap class loader is used. The returned class
+// owns its reference, call Release when it is no longer used. It is the class defined by this call,
+// so the same class can be defined side by side in several loaders.
+// When loader is visible to j, for example the system class loader, the class can then be used by
+// name with the other methods of j, for example RegisterNative. This allows class files to be
+// embedded in Go programs, for example with go:embed.
+func (j *Env) DefineClass(className string, loader *ObjectRef, bytecode []byte) (*Class, error) {
+	if len(bytecode) == 0 {
+		return nil, errors.New("JNIGI: DefineClass with empty bytecode")
+	}
+
+	cnCstr := cString(className)
+	defer free(cnCstr)
+
+	var ptr unsafe.Pointer
+	if copyToC {
+		ptr = malloc(uintptr(len(bytecode)))
+		defer free(ptr)
+		data := (*(*[big]byte)(ptr))[:len(bytecode)]
+		copy(data, bytecode)
+	} else {
+		ptr = unsafe.Pointer(&bytecode[0])
+	}
+
+	var loaderObj jobject
+	if loader != nil {
+		if err := j.checkRef("DefineClass", loader); err != nil {
+			return nil, err
+		}
+		loaderObj = loader.jobject
+	}
+
+	class := defineClass(j.jniEnv, cnCstr, loaderObj, ptr, jsize(len(bytecode)))
+	if class == 0 {
+		return nil, j.handleException()
+	}
+
+	return j.ownedClass(class, className), nil
+}
+
+// GetObjectClass returns the runtime class of the object o, call Release when it is no longer used.
+func (j *Env) GetObjectClass(o *ObjectRef) (*Class, error) {
+	if o.IsNil() {
+		return nil, fmt.Errorf("JNIGI: get class of nil object")
+	}
+	if err := j.checkRef("GetObjectClass", o); err != nil {
+		return nil, err
+	}
+	class := getObjectClass(j.jniEnv, o.jobject)
+	if class == 0 {
+		return nil, j.handleException()
+	}
+	return j.newClass(class)
+}
+
+// newClass returns a *Class owning a global reference to class, which must be a local reference, it
+// is deleted.
+func (j *Env) newClass(class jclass) (*Class, error) {
+	name, err := j.classNameOf(class)
+	if err != nil {
+		deleteLocalRef(j.jniEnv, jobject(class))
+		return nil, err
+	}
+	return j.ownedClass(class, name), nil
+}
+
+// ownedClass returns a *Class owning a global reference to class, which must be a local reference,
+// it is deleted.
+func (j *Env) ownedClass(class jclass, name string) *Class {
+	defer deleteLocalRef(j.jniEnv, jobject(class))
+	j.counters.track(GlobalRefType, 1)
+	return &Class{class: jclass(newGlobalRef(j.jniEnv, jobject(class))), name: name, owned: true}
+}
+
+// Release deletes the global reference owned by c. It does nothing for a class owned by the class
+// cache. c must not be used after it is released.
+func (c *Class) Release(env *Env) {
+	if !c.owned || c.class == 0 {
+		return
+	}
+	deleteGlobalRef(env.jniEnv, jobject(c.class))
+	env.counters.track(GlobalRefType, -1)
+	c.class = 0
+}
+
+// classNameOf returns the name of class in the form used by FindClass, for example java/lang/String
+// or [Ljava/lang/String;.
+func (j *Env) classNameOf(class jclass) (string, error) {
+	classClass, err := j.callFindClass("java/lang/Class")
+	if err != nil {
+		return "", err
+	}
+	mid, err := j.callGetMethodID(false, classClass, "getName", "()Ljava/lang/String;")
+	if err != nil {
+		return "", err
+	}
+	ret, err := j.callMethodByID(jobject(class), mid, Object, "java/lang/String", nil)
+	if err != nil {
+		return "", err
+	}
+	str := ret.(*ObjectRef)
+	defer j.DeleteLocalRef(str)
+
+	return strings.Replace(stringFromJavaLangString(j, str), ".", "/", -1), nil
+}
+
+// callClassMethod calls a no argument method of java.lang.Class on c.
+func (c *Class) callClassMethod(env *Env, methodName, sig string) (interface{}, error) {
+	_, rType, rClassName, err := parseMethodSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	classClass, err := env.callFindClass("java/lang/Class")
+	if err != nil {
+		return nil, err
+	}
+	mid, err := env.callGetMethodID(false, classClass, methodName, sig)
+	if err != nil {
+		return nil, err
+	}
+	return env.callMethodByID(jobject(c.class), mid, rType, rClassName, nil)
+}
+
+// Name returns the name of the class in the form used by FindClass, for example java/lang/String.
+// Primitive type classes have the name of the type, for example int.
+func (c *Class) Name() string {
+	return c.name
+}
+
+// GetObject returns the class as a *ObjectRef of class java/lang/Class. The reference must not be
+// deleted.
+func (c *Class) GetObject() *ObjectRef {
+	return &ObjectRef{jobject: jobject(c.class), className: "java/lang/Class", kind: GlobalRefType}
+}
+
+// Superclass calls JNI GetSuperclass. Returns nil if c is java/lang/Object, an interface or a
+// primitive type. Call Release on the returned class when it is no longer used.
+func (c *Class) Superclass(env *Env) (*Class, error) {
+	sup := getSuperclass(env.jniEnv, c.class)
+	if sup == 0 {
+		return nil, nil
+	}
+	return env.newClass(sup)
+}
+
+// Interfaces returns the interfaces directly implemented by c, or extended by c if it is an interface.
+// Call Release on the returned classes when they are no longer used.
+func (c *Class) Interfaces(env *Env) ([]*Class, error) {
+	ret, err := c.callClassMethod(env, "getInterfaces", "()[Ljava/lang/Class;")
+	if err != nil {
+		return nil, err
+	}
+	array := ret.(*ObjectRef)
+	defer env.DeleteLocalRef(array)
+
+	elems := env.FromObjectArray(array)
+	interfaces := make([]*Class, 0, len(elems))
+	for i, elem := range elems {
+		env.untrackLocal(elem)
+		iface, err := env.newClass(jclass(elem.jobject))
+		if err != nil {
+			for _, rest := range elems[i+1:] {
+				env.DeleteLocalRef(rest)
+			}
+			for _, done := range interfaces {
+				done.Release(env)
+			}
+			return nil, err
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// IsAssignableFrom calls JNI IsAssignableFrom, returns true if objects of class other can be
+// assigned to variables of class c.
+func (c *Class) IsAssignableFrom(env *Env, other *Class) bool {
+	return toBool(isAssignableFrom(env.jniEnv, other.class, c.class))
+}
+
+// IsInstance returns true if o is an instance of c.
+func (c *Class) IsInstance(env *Env, o *ObjectRef) bool {
+	if env.reportRef("IsInstance", o) {
+		return false
+	}
+	return toBool(isInstanceOf(env.jniEnv, o.jobject, c.class))
+}
+
+// IsInterface returns true if c is an interface.
+func (c *Class) IsInterface(env *Env) (bool, error) {
+	ret, err := c.callClassMethod(env, "isInterface", "()Z")
+	if err != nil {
+		return false, err
+	}
+	return ret.(bool), nil
+}
+
+// IsArray returns true if c is an array class.
+func (c *Class) IsArray() bool {
+	return strings.HasPrefix(c.name, "[")
+}
+
+// ComponentType returns the class of the elements of array class c, or nil if c is not an array class.
+// Call Release on the returned class when it is no longer used.
+func (c *Class) ComponentType(env *Env) (*Class, error) {
+	ret, err := c.callClassMethod(env, "getComponentType", "()Ljava/lang/Class;")
+	if err != nil {
+		return nil, err
+	}
+	component := ret.(*ObjectRef)
+	if component.IsNil() {
+		return nil, nil
+	}
+	env.untrackLocal(component)
+	return env.newClass(jclass(component.jobject))
+}
+
+// NewInstance creates a new object of class c, args arguments to constructor.
+func (c *Class) NewInstance(env *Env, args ...interface{}) (*ObjectRef, error) {
+	return env.newObject(c.class, c.name, args...)
+}
+
+// CallStaticMethod calls static method methodName in c with arguments args and stores return value in dest.
+func (c *Class) CallStaticMethod(env *Env, methodName string, dest interface{}, args ...interface{}) error {
+	return env.callStaticMethod(c.class, methodName, dest, args...)
+}
+
+// GetStaticField gets static field fieldName in c, stores value in dest.
+func (c *Class) GetStaticField(env *Env, fieldName string, dest interface{}) error {
+	return env.getStaticField(c.class, fieldName, dest)
+}
+
+// SetStaticField sets static field fieldName in c to value.
+func (c *Class) SetStaticField(env *Env, fieldName string, value interface{}) error {
+	return env.setStaticField(c.class, fieldName, value)
+}
@@ -0,0 +1,150 @@
+package jnigi
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// classKey identifies a class resolved by name. loader is the ClassLoaderRef set on the Env when
+// the class was looked up, nil if none was set, so the same name can be cached for each loader.
+type classKey struct {
+	loader unsafe.Pointer
+	name   string
+}
+
+// memberKey identifies a method or field ID of a cached class.
+type memberKey struct {
+	field  bool
+	static bool
+	name   string
+	sig    string
+}
+
+// classCache holds global references to classes resolved by name and the method and field IDs
+// looked up in them. Classes found by identity, for example the class of an object, are not cached,
+// they would keep their class loader from being unloaded. There is one classCache per JVM, shared by
+// all its Envs, so it is safe for concurrent use.
+type classCache struct {
+	mu    sync.RWMutex
+	named map[classKey]jclass
+	// members holds the member IDs of every cached class
+	members map[jclass]map[memberKey]uintptr
+}
+
+func newClassCache() *classCache {
+	c := &classCache{}
+	c.reset()
+	return c
+}
+
+func (c *classCache) reset() {
+	c.named = make(map[classKey]jclass)
+	c.members = make(map[jclass]map[memberKey]uintptr)
+}
+
+// classCaches holds the class cache of each JVM by JavaVM pointer.
+var (
+	classCachesMu sync.Mutex
+	classCaches   = make(map[unsafe.Pointer]*classCache)
+)
+
+// sharedClassCache returns the class cache of javaVM.
+func sharedClassCache(javaVM unsafe.Pointer) *classCache {
+	classCachesMu.Lock()
+	defer classCachesMu.Unlock()
+	c, ok := classCaches[javaVM]
+	if !ok {
+		c = newClassCache()
+		classCaches[javaVM] = c
+	}
+	return c
+}
+
+// removeSharedClassCache forgets the class cache of javaVM.
+func removeSharedClassCache(javaVM unsafe.Pointer) {
+	classCachesMu.Lock()
+	defer classCachesMu.Unlock()
+	delete(classCaches, javaVM)
+}
+
+func (c *classCache) lookup(key classKey) (jclass, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	class, ok := c.named[key]
+	return class, ok
+}
+
+// add stores a new global reference to class and returns it. c.mu must be held.
+func (c *classCache) add(env unsafe.Pointer, class jclass) jclass {
+	ref := jclass(newGlobalRef(env, jobject(class)))
+	c.members[ref] = make(map[memberKey]uintptr)
+	return ref
+}
+
+// remove deletes the global reference class and its member IDs. c.mu must be held.
+func (c *classCache) remove(env unsafe.Pointer, class jclass) {
+	delete(c.members, class)
+	deleteGlobalRef(env, jobject(class))
+}
+
+func (c *classCache) member(class jclass, key memberKey) (uintptr, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.members[class][key]
+	return id, ok
+}
+
+// putMember stores a member ID, only if class is a cached class.
+func (c *classCache) putMember(class jclass, key memberKey, id uintptr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.members[class]; ok {
+		m[key] = id
+	}
+}
+
+// clear deletes all global references in the cache.
+func (c *classCache) clear(env unsafe.Pointer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for class := range c.members {
+		deleteGlobalRef(env, jobject(class))
+	}
+	c.reset()
+}
+
+// cacheClass stores a global reference to class in the class cache under className and the class
+// loader of j, and returns it. class must be a local reference, it is deleted.
+func (j *Env) cacheClass(className string, class jclass) jclass {
+	defer deleteLocalRef(j.jniEnv, jobject(class))
+	c := j.classCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := classKey{j.addtlClassLoader, className}
+	if v, ok := c.named[key]; ok {
+		return v
+	}
+	ref := c.add(j.jniEnv, class)
+	c.named[key] = ref
+	return ref
+}
+
+// removeLoaderKeys removes the classes looked up with the ClassLoaderRef loader. c.mu must be held.
+func (c *classCache) removeLoaderKeys(env unsafe.Pointer, loader unsafe.Pointer) {
+	for key, class := range c.named {
+		if key.loader == loader {
+			delete(c.named, key)
+			c.remove(env, class)
+		}
+	}
+}
+
+// freeClassLoader frees the ClassLoaderRef loader. The classes looked up with it are removed in the
+// same critical section, as its address can be reused by another ClassLoaderRef once it is freed.
+func (c *classCache) freeClassLoader(env unsafe.Pointer, loader unsafe.Pointer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLoaderKeys(env, loader)
+	freeClassLoaderRef(env, loader)
+}
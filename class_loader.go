@@ -3,30 +3,87 @@ package jnigi
 /*
 #include <jni.h>
 #include <stdlib.h>
+#include <string.h>
 
 typedef struct ClassLoaderRef {
-	jclass clazz;
+	jobject loader;
 	jmethodID findClass;
+	jmethodID loadClass;
+	int useFindClass;
 } ClassLoaderRef;
 
-// Gets a global ref to the class loader (and its findClass method) currently active for 'thiz'.
+// Creates a ClassLoaderRef holding a global ref to the class loader object 'loader'.
 // This ref can then be cached and used on any thread to find additional dependencies that the
 // default class loader cannot.
+ClassLoaderRef* newClassLoaderRef(JNIEnv *env, jobject loader) {
+	jclass classLoaderClazz = (*env)->FindClass(env, "java/lang/ClassLoader");
+
+	ClassLoaderRef *ref = (ClassLoaderRef*)malloc(sizeof(ClassLoaderRef));
+	ref->loader = loader ? (*env)->NewGlobalRef(env, loader) : NULL;
+	ref->findClass = (*env)->GetMethodID(env, classLoaderClazz, "findClass", "(Ljava/lang/String;)Ljava/lang/Class;");
+	ref->loadClass = (*env)->GetMethodID(env, classLoaderClazz, "loadClass", "(Ljava/lang/String;)Ljava/lang/Class;");
+	ref->useFindClass = 0;
+	(*env)->DeleteLocalRef(env, classLoaderClazz);
+
+	return ref;
+}
+
+// Gets a ClassLoaderRef for the class loader currently active for 'thiz'.
 ClassLoaderRef* getClassLoaderRef(JNIEnv *env, jobject thiz) {
 	jclass thizClazz = (*env)->GetObjectClass(env, thiz);
 	jclass thizClazzClazz = (*env)->GetObjectClass(env, thizClazz);
-	jclass classLoaderClazz = (*env)->FindClass(env, "java/lang/ClassLoader");
 
 	jmethodID getClassLoaderMethod = (*env)->GetMethodID(env, thizClazzClazz, "getClassLoader", "()Ljava/lang/ClassLoader;");
-	jclass classLoader = (*env)->CallObjectMethod(env, thizClazz, getClassLoaderMethod);
+	jobject classLoader = (*env)->CallObjectMethod(env, thizClazz, getClassLoaderMethod);
 
-	ClassLoaderRef *ref = (ClassLoaderRef*)malloc(sizeof(ClassLoaderRef));
-	ref->clazz = (*env)->NewGlobalRef(env, classLoader);
-	ref->findClass = (*env)->GetMethodID(env, classLoaderClazz, "findClass", "(Ljava/lang/String;)Ljava/lang/Class;");
+	ClassLoaderRef *ref = newClassLoaderRef(env, classLoader);
+	// loaders derived from an object have always used findClass
+	ref->useFindClass = 1;
 
+	(*env)->DeleteLocalRef(env, classLoader);
+	(*env)->DeleteLocalRef(env, thizClazzClazz);
+	(*env)->DeleteLocalRef(env, thizClazz);
 	return ref;
 }
 
+// Deletes the global ref held by 'ref' and frees it.
+void freeClassLoaderRef(JNIEnv *env, ClassLoaderRef *ref) {
+	if (ref->loader) {
+		(*env)->DeleteGlobalRef(env, ref->loader);
+	}
+	free(ref);
+}
+
+// Load a jclass with the given name using only 'loader'. Depending on 'useFindClass' either
+// loadClass, which delegates to the parent loader, or findClass is called.
+jclass loadClassWithLoader(JNIEnv *env, const char *className, ClassLoaderRef *loader) {
+	// ClassLoader methods take binary names, e.g. java.lang.String
+	size_t len = strlen(className);
+	char *binaryName = (char*)malloc(len + 1);
+	if (!binaryName) {
+		jclass oomClazz = (*env)->FindClass(env, "java/lang/OutOfMemoryError");
+		if (oomClazz) {
+			(*env)->ThrowNew(env, oomClazz, "loadClassWithLoader");
+			(*env)->DeleteLocalRef(env, oomClazz);
+		}
+		return NULL;
+	}
+	size_t i;
+	for (i = 0; i <= len; i++) {
+		binaryName[i] = className[i] == '/' ? '.' : className[i];
+	}
+	jstring jClassName = (*env)->NewStringUTF(env, binaryName);
+	free(binaryName);
+	if (!jClassName) {
+		return NULL;
+	}
+
+	jmethodID method = loader->useFindClass ? loader->findClass : loader->loadClass;
+	jclass clazz = (*env)->CallObjectMethod(env, loader->loader, method, jClassName);
+	(*env)->DeleteLocalRef(env, jClassName);
+	return clazz;
+}
+
 // Find a jclass with the given name using both the default and an optional additional loader.
 jclass findClass(JNIEnv *env, const char *className, ClassLoaderRef *addtlLoader) {
 	// The default FindClass finds system classes (e.g. java/lang/String, android/app/Application),
@@ -37,7 +94,7 @@ jclass findClass(JNIEnv *env, const char *className, ClassLoaderRef *addtlLoader
 	if (clazz) {
 		return clazz;
 	}
-	if (!addtlLoader) {
+	if (!addtlLoader || !addtlLoader->loader) {
 		return NULL;
 	}
 
@@ -49,14 +106,333 @@ jclass findClass(JNIEnv *env, const char *className, ClassLoaderRef *addtlLoader
 	// The loader can be derived from JNI_OnLoad or from 'thiz' provided to any JNI function
 	// implementation. A loader derived from these sources will find custom classes, but will not
 	// find system classes.
-	jstring jClassName = (*env)->NewStringUTF(env, className);
-	clazz = (*env)->CallObjectMethod(env, addtlLoader->clazz, addtlLoader->findClass, jClassName);
-	(*env)->DeleteLocalRef(env, jClassName);
-	return clazz;
+	return loadClassWithLoader(env, className, addtlLoader);
 }
 */
 import "C"
-import "unsafe"
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// ClassLookup selects the java.lang.ClassLoader method a ClassLoaderRef uses to resolve class names.
+// Loaders from GetClassLoader, and the loader UseJVM derives from thiz, use LookupFindClass as they
+// always have. Loaders from NewClassLoaderRef and the loaders created by jnigi use LookupLoadClass.
+type ClassLookup int
+
+const (
+	// LookupLoadClass calls loadClass, the loader delegates to its parent first and returns classes
+	// it has already loaded.
+	LookupLoadClass ClassLookup = iota
+	// LookupFindClass calls the protected findClass, only the loader itself is searched. A class
+	// can only be found once this way, as the loader will not define a class twice.
+	LookupFindClass
+)
+
+// A reference to a class loader object
+type ClassLoaderRef struct {
+	ref unsafe.Pointer
+	// closeOnRelease is set for loaders created by jnigi that hold resources, like open jar files
+	closeOnRelease bool
+	// recreate creates a new loader from the same source, for ReloadClassLoader
+	recreate func(env *Env) (*ClassLoaderRef, error)
+
+	mu      sync.Mutex
+	classes map[string]jclass
+}
+
+// Get a class loader object from an existing object obj, the class loader of its class. It uses
+// LookupFindClass, see SetLookup.
+func (r *Env) GetClassLoader(obj *ObjectRef) *ClassLoaderRef {
+	classLoader := getClassLoader(r.jniEnv, (unsafe.Pointer)(obj.jobject))
+	return &ClassLoaderRef{ref: classLoader}
+}
+
+// NewClassLoaderRef returns a ClassLoaderRef for the class loader object loader, a
+// java.lang.ClassLoader. The ClassLoaderRef holds its own global reference to loader.
+func (r *Env) NewClassLoaderRef(loader *ObjectRef) (*ClassLoaderRef, error) {
+	if loader.IsNil() {
+		return nil, errors.New("JNIGI: NewClassLoaderRef with nil loader")
+	}
+	return &ClassLoaderRef{ref: newClassLoaderRef(r.jniEnv, loader.jobject)}, nil
+}
+
+// NewURLClassLoader creates a java.net.URLClassLoader which loads classes and resources from the
+// jar files and directories paths. Relative paths are resolved against the current directory.
+// If parent is nil the system class loader is the parent of the new loader. The loader is closed
+// when it is released.
+func (r *Env) NewURLClassLoader(parent *ClassLoaderRef, paths ...string) (*ClassLoaderRef, error) {
+	return r.newURLClassLoader(parent, false, paths)
+}
+
+// NewChildFirstURLClassLoader is like NewURLClassLoader, but classes in paths are loaded by the new
+// loader even if the parent loader can load them. This allows loading a version of a library
+// isolated from other versions, for example for plugins.
+func (r *Env) NewChildFirstURLClassLoader(parent *ClassLoaderRef, paths ...string) (*ClassLoaderRef, error) {
+	return r.newURLClassLoader(parent, true, paths)
+}
+
+func (r *Env) newURLClassLoader(parent *ClassLoaderRef, childFirst bool, paths []string) (*ClassLoaderRef, error) {
+	var urls []*ObjectRef
+	defer func() {
+		for _, url := range urls {
+			r.DeleteLocalRef(url)
+		}
+	}()
+	for _, path := range paths {
+		url, err := r.fileURL(path)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	urlArray := r.ToObjectArray(urls, "java/net/URL")
+	defer r.DeleteLocalRef(urlArray)
+
+	parentObj, err := r.parentClassLoader(parent)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		defer r.DeleteLocalRef(parentObj)
+	}
+
+	var loader *ObjectRef
+	if childFirst {
+		var class jclass
+		class, err = r.helperClass(childFirstURLLoaderClass)
+		if err != nil {
+			return nil, err
+		}
+		loader, err = r.newObject(class, childFirstURLLoaderClass, urlArray, parentObj)
+	} else {
+		loader, err = r.NewObject("java/net/URLClassLoader", urlArray, parentObj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.DeleteLocalRef(loader)
+
+	return &ClassLoaderRef{
+		ref:            newClassLoaderRef(r.jniEnv, loader.jobject),
+		closeOnRelease: true,
+		recreate: func(env *Env) (*ClassLoaderRef, error) {
+			return env.newURLClassLoader(parent, childFirst, paths)
+		},
+	}, nil
+}
+
+// ReloadClassLoader replaces loader, created by NewURLClassLoader, NewJarClassLoader or their child
+// first variants, with a new loader created from the same paths or jars, with the same parent. The
+// classes looked up with loader and their cached method and field IDs are removed from the class
+// cache of r, if r uses loader it uses the new loader, and loader is released. Class, Method and
+// Field values obtained through loader must not be used afterwards. Objects created from the old
+// classes keep working, the JVM unloads the classes once they are no longer referenced.
+//
+// If releasing loader fails the new loader is returned along with the error.
+func (r *Env) ReloadClassLoader(loader *ClassLoaderRef) (*ClassLoaderRef, error) {
+	if loader.recreate == nil {
+		return nil, errors.New("JNIGI: class loader was not created by jnigi, it can not be reloaded")
+	}
+	newLoader, err := loader.recreate(r)
+	if err != nil {
+		return nil, err
+	}
+	newLoader.SetLookup(loader.Lookup())
+
+	inUse := r.addtlClassLoader == loader.ref
+	err = loader.Release(r)
+	if inUse {
+		r.addtlClassLoader = newLoader.ref
+	}
+	return newLoader, err
+}
+
+// fileURL returns a local reference to the java.net.URL of file path.
+func (r *Env) fileURL(path string) (*ObjectRef, error) {
+	pathStr, err := r.NewObject("java/lang/String", []byte(path), r.GetUTF8String())
+	if err != nil {
+		return nil, err
+	}
+	defer r.DeleteLocalRef(pathStr)
+
+	file, err := r.NewObject("java/io/File", pathStr)
+	if err != nil {
+		return nil, err
+	}
+	defer r.DeleteLocalRef(file)
+
+	uri := NewObjectRef("java/net/URI")
+	if err := file.CallMethod(r, "toURI", uri); err != nil {
+		return nil, err
+	}
+	defer r.DeleteLocalRef(uri)
+
+	url := NewObjectRef("java/net/URL")
+	if err := uri.CallMethod(r, "toURL", url); err != nil {
+		return nil, err
+	}
+	return url, nil
+}
+
+// parentClassLoader returns the loader object of parent, or a local reference to the system class
+// loader if parent is nil.
+func (r *Env) parentClassLoader(parent *ClassLoaderRef) (*ObjectRef, error) {
+	if parent == nil {
+		return r.systemClassLoader()
+	}
+	return parent.GetObject(), nil
+}
+
+// GetObject returns the class loader object. The reference is a global reference owned by r.
+func (r *ClassLoaderRef) GetObject() *ObjectRef {
+	return &ObjectRef{jobject: classLoaderObject(r.ref), className: "java/lang/ClassLoader", kind: GlobalRefType}
+}
+
+// SetLookup sets which ClassLoader method is used to resolve class names, for Envs using r as
+// their class loader and for LoadClass.
+func (r *ClassLoaderRef) SetLookup(lookup ClassLookup) {
+	setClassLoaderLookup(r.ref, lookup == LookupFindClass)
+}
+
+// Lookup returns which ClassLoader method is used to resolve class names.
+func (r *ClassLoaderRef) Lookup() ClassLookup {
+	if classLoaderLookup(r.ref) {
+		return LookupFindClass
+	}
+	return LookupLoadClass
+}
+
+// LoadClass resolves className using only the class loader r, regardless of the class loader set on
+// env. The class reference is owned by r and is valid until r is released.
+func (r *ClassLoaderRef) LoadClass(env *Env, className string) (*Class, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if class, ok := r.classes[className]; ok {
+		return &Class{class: class, name: className}, nil
+	}
+
+	if classLoaderObject(r.ref) == 0 {
+		return nil, errors.New("JNIGI: LoadClass with bootstrap class loader")
+	}
+
+	cnCstr := cString(className)
+	defer free(cnCstr)
+	class := loadClassWithLoader(env.jniEnv, cnCstr, r.ref)
+	if class == 0 {
+		return nil, env.handleException()
+	}
+	defer deleteLocalRef(env.jniEnv, jobject(class))
+
+	if r.classes == nil {
+		r.classes = make(map[string]jclass)
+	}
+	ref := jclass(newGlobalRef(env.jniEnv, jobject(class)))
+	r.classes[className] = ref
+	return &Class{class: ref, name: className}, nil
+}
+
+// Release deletes the global references held by r and frees it. The classes looked up with r are
+// removed from the class cache of env, and if env uses r it no longer uses a class loader. Loaders
+// created by NewURLClassLoader are closed. r must not be in use by any other Env or JVM, or be
+// used afterwards.
+func (r *ClassLoaderRef) Release(env *Env) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ref == nil {
+		return nil
+	}
+
+	var err error
+	if env.addtlClassLoader == r.ref {
+		env.addtlClassLoader = nil
+	}
+
+	if r.closeOnRelease {
+		if closeErr := r.GetObject().Cast("java/io/Closeable").CallMethod(env, "close", nil); err == nil {
+			err = closeErr
+		}
+	}
+
+	for _, class := range r.classes {
+		deleteGlobalRef(env.jniEnv, jobject(class))
+	}
+	r.classes = nil
+	env.classCache.freeClassLoader(env.jniEnv, r.ref)
+	r.ref = nil
+	return err
+}
+
+// childFirstLoadClass adds a loadClass method to the class loader class being written by cw, which
+// loads classes that the loader has itself before delegating to the parent loader. If
+// childFirstField is not empty it names a boolean field which enables child first loading.
+//
+//	protected synchronized Class loadClass(String name, boolean resolve) throws ClassNotFoundException {
+//		if (childFirst && findResource(name.replace('.', '/').concat(".class")) != null) {
+//			Class c = findLoadedClass(name);
+//			if (c == null) c = findClass(name);
+//			return c;
+//		}
+//		return super.loadClass(name, resolve);
+//	}
+func childFirstLoadClass(cw *classWriter, className, superName, childFirstField string) {
+	code := cw.method(accProtected|accSynchronized, "loadClass", "(Ljava/lang/String;Z)Ljava/lang/Class;", 4, 4)
+	var toParent []int
+	if childFirstField != "" {
+		code.op(opAload0).fieldOp(opGetfield, className, childFirstField, "Z")
+		toParent = append(toParent, code.branch(opIfeq))
+	}
+	code.op(opAload0, opAload1).bipush('.').bipush('/').
+		invoke(opInvokevirtual, "java/lang/String", "replace", "(CC)Ljava/lang/String;").
+		ldcString(".class").
+		invoke(opInvokevirtual, "java/lang/String", "concat", "(Ljava/lang/String;)Ljava/lang/String;").
+		invoke(opInvokevirtual, className, "findResource", "(Ljava/lang/String;)Ljava/net/URL;")
+	toParent = append(toParent, code.branch(opIfnull))
+	code.op(opAload0, opAload1).
+		invoke(opInvokevirtual, "java/lang/ClassLoader", "findLoadedClass", "(Ljava/lang/String;)Ljava/lang/Class;").
+		op(opAstore3, opAload3)
+	loaded := code.branch(opIfnonnull)
+	code.op(opAload0, opAload1).
+		invoke(opInvokevirtual, className, "findClass", "(Ljava/lang/String;)Ljava/lang/Class;").
+		op(opAstore3)
+	code.label(loaded)
+	code.op(opAload3, opAreturn)
+	for _, pos := range toParent {
+		code.label(pos)
+	}
+	code.op(opAload0, opAload1, opIload2).
+		invoke(opInvokespecial, superName, "loadClass", "(Ljava/lang/String;Z)Ljava/lang/Class;").
+		op(opAreturn)
+}
+
+const childFirstURLLoaderClass = "jnigi/ChildFirstURLClassLoader"
+
+// childFirstURLClassLoaderBytecode returns the class file of:
+//
+//	public class ChildFirstURLClassLoader extends URLClassLoader {
+//		public ChildFirstURLClassLoader(URL[] urls, ClassLoader parent) {
+//			super(urls, parent);
+//		}
+//
+//		protected synchronized Class loadClass(String name, boolean resolve) throws ClassNotFoundException {
+//			// see childFirstLoadClass
+//		}
+//	}
+func childFirstURLClassLoaderBytecode() []byte {
+	cw := newClassWriter(childFirstURLLoaderClass, "java/net/URLClassLoader")
+
+	cw.method(accPublic, "<init>", "([Ljava/net/URL;Ljava/lang/ClassLoader;)V", 3, 3).
+		op(opAload0, opAload1, opAload2).
+		invoke(opInvokespecial, "java/net/URLClassLoader", "<init>", "([Ljava/net/URL;Ljava/lang/ClassLoader;)V").
+		op(opReturn)
+
+	childFirstLoadClass(cw, childFirstURLLoaderClass, "java/net/URLClassLoader", "")
+
+	return cw.bytes()
+}
 
 // findClass attempts to find the class with the given 'name' within env.
 // Optionally, addtlLoader can be specified as a second source.
@@ -64,7 +440,39 @@ func findClass(env unsafe.Pointer, name unsafe.Pointer, addtlLoader unsafe.Point
 	return jclass(C.findClass((*C.JNIEnv)(env), (*C.char)(name), (*C.ClassLoaderRef)(addtlLoader)))
 }
 
+// loadClassWithLoader attempts to find the class with the given 'name' using only loader.
+func loadClassWithLoader(env unsafe.Pointer, name unsafe.Pointer, loader unsafe.Pointer) jclass {
+	return jclass(C.loadClassWithLoader((*C.JNIEnv)(env), (*C.char)(name), (*C.ClassLoaderRef)(loader)))
+}
+
+// classLoaderObject returns the class loader object referenced by the ClassLoaderRef loader
+func classLoaderObject(loader unsafe.Pointer) jobject {
+	return jobject(unsafe.Pointer((*C.ClassLoaderRef)(loader).loader))
+}
+
+func setClassLoaderLookup(loader unsafe.Pointer, useFindClass bool) {
+	var v C.int
+	if useFindClass {
+		v = 1
+	}
+	(*C.ClassLoaderRef)(loader).useFindClass = v
+}
+
+func classLoaderLookup(loader unsafe.Pointer) bool {
+	return (*C.ClassLoaderRef)(loader).useFindClass != 0
+}
+
 // getClassLoader returns a reference to the class loader used by 'thiz'
 func getClassLoader(env unsafe.Pointer, thiz unsafe.Pointer) unsafe.Pointer {
 	return unsafe.Pointer(C.getClassLoaderRef((*C.JNIEnv)(env), (C.jobject)(thiz)))
 }
+
+// newClassLoaderRef returns a reference to the class loader object loader
+func newClassLoaderRef(env unsafe.Pointer, loader jobject) unsafe.Pointer {
+	return unsafe.Pointer(C.newClassLoaderRef((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(loader))))
+}
+
+// freeClassLoaderRef deletes the global reference held by loader and frees it
+func freeClassLoaderRef(env unsafe.Pointer, loader unsafe.Pointer) {
+	C.freeClassLoaderRef((*C.JNIEnv)(env), (*C.ClassLoaderRef)(loader))
+}
@@ -0,0 +1,355 @@
+package jnigi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// classWriter assembles small Java class files for helper classes that jnigi defines at runtime with
+// DefineClass, so no Java compiler or class path is needed. Class file version 49 is used so methods
+// with branches do not need a StackMapTable.
+
+const (
+	classFileVersion = 49
+
+	accPublic       = 0x0001
+	accPrivate      = 0x0002
+	accProtected    = 0x0004
+	accStatic       = 0x0008
+	accFinal        = 0x0010
+	accSuper        = 0x0020
+	accSynchronized = 0x0020
+	accNative       = 0x0100
+
+	constUtf8               = 1
+	constClass              = 7
+	constString             = 8
+	constFieldref           = 9
+	constMethodref          = 10
+	constInterfaceMethodref = 11
+	constNameAndType        = 12
+)
+
+// bytecode instructions used by the generated classes
+const (
+	opAconstNull      = 0x01
+	opIconstM1        = 0x02
+	opIconst0         = 0x03
+	opIconst1         = 0x04
+	opBipush          = 0x10
+	opLdcW            = 0x13
+	opIload1          = 0x1b
+	opIload2          = 0x1c
+	opIload3          = 0x1d
+	opAload0          = 0x2a
+	opAload1          = 0x2b
+	opAload2          = 0x2c
+	opAload3          = 0x2d
+	opAstore2         = 0x4d
+	opAstore3         = 0x4e
+	opDup             = 0x59
+	opIfeq            = 0x99
+	opIfne            = 0x9a
+	opIreturn         = 0xac
+	opAreturn         = 0xb0
+	opReturn          = 0xb1
+	opGetfield        = 0xb4
+	opPutfield        = 0xb5
+	opInvokevirtual   = 0xb6
+	opInvokespecial   = 0xb7
+	opInvokestatic    = 0xb8
+	opInvokeinterface = 0xb9
+	opNew             = 0xbb
+	opArraylength     = 0xbe
+	opAthrow          = 0xbf
+	opCheckcast       = 0xc0
+	opIfnull          = 0xc6
+	opIfnonnull       = 0xc7
+)
+
+// helperClassDef is a helper class, requires are the helper classes it uses, they are defined
+// before it.
+type helperClassDef struct {
+	bytecode func() []byte
+	requires []string
+}
+
+// helperClassDefs holds the helper classes by name. A helper class is only defined when it is used,
+// so one that needs a module missing from the runtime, for example java.logging in a jlink image,
+// does not break the others.
+var helperClassDefs = map[string]helperClassDef{
+	jarURLConnClass:          {jarURLConnectionBytecode, nil},
+	jarURLHandlerClass:       {jarURLStreamHandlerBytecode, []string{jarURLConnClass}},
+	jarLoaderClass:           {jarClassLoaderBytecode, []string{jarURLHandlerClass}},
+	childFirstURLLoaderClass: {childFirstURLClassLoaderBytecode, nil},
+	goOutputStreamClass:      {goOutputStreamBytecode, nil},
+	goInputStreamClass:       {goInputStreamBytecode, nil},
+}
+
+// helperClasses holds global references to the helper classes defined, they are defined once per
+// JVM.
+var (
+	helperClassesMu sync.Mutex
+	helperClasses   map[string]jclass
+)
+
+// helperClass returns the helper class className, defining it and the helper classes it requires
+// in the system class loader the first time it is called. A helper class already defined by an
+// earlier call that failed is not defined again, the system class loader would throw a LinkageError.
+func (j *Env) helperClass(className string) (jclass, error) {
+	helperClassesMu.Lock()
+	defer helperClassesMu.Unlock()
+
+	if class, ok := helperClasses[className]; ok {
+		return class, nil
+	}
+	system, err := j.systemClassLoader()
+	if err != nil {
+		return 0, err
+	}
+	defer j.DeleteLocalRef(system)
+	return j.loadHelperClass(system, className)
+}
+
+// loadHelperClass returns the helper class className, defining it and the helper classes it
+// requires in loader if they are not defined yet. helperClassesMu must be held.
+func (j *Env) loadHelperClass(loader *ObjectRef, className string) (jclass, error) {
+	if class, ok := helperClasses[className]; ok {
+		return class, nil
+	}
+	def, ok := helperClassDefs[className]
+	if !ok {
+		return 0, errors.New("JNIGI: unknown helper class " + className)
+	}
+	for _, required := range def.requires {
+		if _, err := j.loadHelperClass(loader, required); err != nil {
+			return 0, err
+		}
+	}
+	class, err := j.defineHelperClass(loader, className, def.bytecode)
+	if err != nil {
+		return 0, err
+	}
+	if helperClasses == nil {
+		helperClasses = make(map[string]jclass)
+	}
+	helperClasses[className] = class
+	return class, nil
+}
+
+// defineHelperClass returns a global reference to helper class className, defining it in loader
+// if it is not loaded yet.
+func (j *Env) defineHelperClass(loader *ObjectRef, className string, bytecode func() []byte) (jclass, error) {
+	name, err := j.NewObject("java/lang/String", []byte(strings.Replace(className, "/", ".", -1)), j.GetUTF8String())
+	if err != nil {
+		return 0, err
+	}
+	defer j.DeleteLocalRef(name)
+
+	// findLoadedClass is protected, JNI does not check access
+	loaded := NewObjectRef("java/lang/Class")
+	j.PrecalculateSignature("(Ljava/lang/String;)Ljava/lang/Class;")
+	if err := loader.CallMethod(j, "findLoadedClass", loaded, name); err != nil {
+		return 0, err
+	}
+	if !loaded.IsNil() {
+		defer j.DeleteLocalRef(loaded)
+		return jclass(newGlobalRef(j.jniEnv, loaded.jobject)), nil
+	}
+
+	class, err := j.DefineClass(className, loader, bytecode())
+	if err != nil {
+		return 0, err
+	}
+	defer class.Release(j)
+	return jclass(newGlobalRef(j.jniEnv, jobject(class.class))), nil
+}
+
+type classMember struct {
+	access uint16
+	name   uint16
+	desc   uint16
+	code   *codeWriter
+}
+
+type classWriter struct {
+	pool      bytes.Buffer
+	poolCount uint16
+	consts    map[string]uint16
+	access    uint16
+	this      uint16
+	super     uint16
+	fields    []classMember
+	methods   []classMember
+}
+
+func newClassWriter(className, superName string) *classWriter {
+	cw := &classWriter{poolCount: 1, consts: make(map[string]uint16), access: accPublic | accSuper}
+	cw.this = cw.class(className)
+	cw.super = cw.class(superName)
+	return cw
+}
+
+// constant adds a constant pool entry, entries with the same key are only added once.
+func (cw *classWriter) constant(key string, tag byte, data ...uint16) uint16 {
+	if idx, ok := cw.consts[key]; ok {
+		return idx
+	}
+	cw.pool.WriteByte(tag)
+	for _, v := range data {
+		binary.Write(&cw.pool, binary.BigEndian, v)
+	}
+	idx := cw.poolCount
+	cw.poolCount++
+	cw.consts[key] = idx
+	return idx
+}
+
+// utf8 adds a CONSTANT_Utf8 entry. Only used for ASCII names so no modified UTF-8 encoding is needed.
+func (cw *classWriter) utf8(s string) uint16 {
+	key := "U" + s
+	if idx, ok := cw.consts[key]; ok {
+		return idx
+	}
+	cw.pool.WriteByte(constUtf8)
+	binary.Write(&cw.pool, binary.BigEndian, uint16(len(s)))
+	cw.pool.WriteString(s)
+	idx := cw.poolCount
+	cw.poolCount++
+	cw.consts[key] = idx
+	return idx
+}
+
+func (cw *classWriter) class(name string) uint16 {
+	return cw.constant("C"+name, constClass, cw.utf8(name))
+}
+
+func (cw *classWriter) string(s string) uint16 {
+	return cw.constant("S"+s, constString, cw.utf8(s))
+}
+
+func (cw *classWriter) nameAndType(name, desc string) uint16 {
+	return cw.constant("N"+name+" "+desc, constNameAndType, cw.utf8(name), cw.utf8(desc))
+}
+
+func (cw *classWriter) memberRef(tag byte, class, name, desc string) uint16 {
+	return cw.constant(string([]byte{'R', tag})+class+"."+name+" "+desc, tag, cw.class(class), cw.nameAndType(name, desc))
+}
+
+func (cw *classWriter) field(access uint16, name, desc string) {
+	cw.fields = append(cw.fields, classMember{access: access, name: cw.utf8(name), desc: cw.utf8(desc)})
+}
+
+// method adds a method and returns a codeWriter for its body.
+func (cw *classWriter) method(access uint16, name, desc string, maxStack, maxLocals uint16) *codeWriter {
+	code := &codeWriter{cw: cw, maxStack: maxStack, maxLocals: maxLocals}
+	cw.methods = append(cw.methods, classMember{access: access, name: cw.utf8(name), desc: cw.utf8(desc), code: code})
+	return code
+}
+
+// nativeMethod adds a native method, it has no body.
+func (cw *classWriter) nativeMethod(access uint16, name, desc string) {
+	cw.methods = append(cw.methods, classMember{access: access | accNative, name: cw.utf8(name), desc: cw.utf8(desc)})
+}
+
+// bytes returns the class file.
+func (cw *classWriter) bytes() []byte {
+	codeAttr := cw.utf8("Code")
+
+	var b bytes.Buffer
+	w := func(v interface{}) {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	w(uint32(0xcafebabe))
+	w(uint16(0))
+	w(uint16(classFileVersion))
+	w(cw.poolCount)
+	b.Write(cw.pool.Bytes())
+	w(cw.access)
+	w(cw.this)
+	w(cw.super)
+	w(uint16(0)) // interfaces
+	w(uint16(len(cw.fields)))
+	for _, f := range cw.fields {
+		w([]uint16{f.access, f.name, f.desc, 0})
+	}
+	w(uint16(len(cw.methods)))
+	for _, m := range cw.methods {
+		if m.code == nil {
+			w([]uint16{m.access, m.name, m.desc, 0})
+			continue
+		}
+		w([]uint16{m.access, m.name, m.desc, 1})
+		code := m.code.code.Bytes()
+		w(codeAttr)
+		w(uint32(2 + 2 + 4 + len(code) + 2 + 2))
+		w([]uint16{m.code.maxStack, m.code.maxLocals})
+		w(uint32(len(code)))
+		b.Write(code)
+		w([]uint16{0, 0}) // exception table, attributes
+	}
+	w(uint16(0)) // class attributes
+	return b.Bytes()
+}
+
+// codeWriter writes the bytecode of a method.
+type codeWriter struct {
+	cw        *classWriter
+	code      bytes.Buffer
+	maxStack  uint16
+	maxLocals uint16
+}
+
+func (c *codeWriter) op(ops ...byte) *codeWriter {
+	c.code.Write(ops)
+	return c
+}
+
+func (c *codeWriter) opIndex(op byte, idx uint16) *codeWriter {
+	c.code.Write([]byte{op, byte(idx >> 8), byte(idx)})
+	return c
+}
+
+func (c *codeWriter) bipush(v int8) *codeWriter {
+	return c.op(opBipush, byte(v))
+}
+
+func (c *codeWriter) ldcString(s string) *codeWriter {
+	return c.opIndex(opLdcW, c.cw.string(s))
+}
+
+func (c *codeWriter) typeOp(op byte, class string) *codeWriter {
+	return c.opIndex(op, c.cw.class(class))
+}
+
+func (c *codeWriter) fieldOp(op byte, class, name, desc string) *codeWriter {
+	return c.opIndex(op, c.cw.memberRef(constFieldref, class, name, desc))
+}
+
+func (c *codeWriter) invoke(op byte, class, name, desc string) *codeWriter {
+	return c.opIndex(op, c.cw.memberRef(constMethodref, class, name, desc))
+}
+
+// invokeInterface calls interface method name, nargs is the number of argument slots including the object.
+func (c *codeWriter) invokeInterface(class, name, desc string, nargs byte) *codeWriter {
+	c.opIndex(opInvokeinterface, c.cw.memberRef(constInterfaceMethodref, class, name, desc))
+	return c.op(nargs, 0)
+}
+
+// branch writes a branch instruction and returns its position, the target is set with label.
+func (c *codeWriter) branch(op byte) int {
+	pos := c.code.Len()
+	c.op(op, 0, 0)
+	return pos
+}
+
+// label sets the target of the branch instruction at pos to the current position.
+func (c *codeWriter) label(pos int) {
+	offset := int16(c.code.Len() - pos)
+	b := c.code.Bytes()
+	b[pos+1] = byte(offset >> 8)
+	b[pos+2] = byte(offset)
+}
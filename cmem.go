@@ -11,14 +11,19 @@ import "C"
 
 import (
 	"log"
+	"sync/atomic"
 	"unsafe"
 )
 
+// cAllocs is the number of live C allocations made by the functions below, see Stats.
+var cAllocs int64
+
 func malloc(size uintptr) unsafe.Pointer {
 	p := C.malloc(C.size_t(size))
 	if p == nil {
 		log.Panicf("C malloc failed (size = %d)", size)
 	}
+	atomic.AddInt64(&cAllocs, 1)
 	return p
 }
 
@@ -27,6 +32,7 @@ func calloc(count uintptr, size uintptr) unsafe.Pointer {
 	if p == nil {
 		log.Panicf("C calloc failed (count = %d, size = %d)", count, size)
 	}
+	atomic.AddInt64(&cAllocs, 1)
 	return p
 }
 
@@ -35,13 +41,20 @@ func realloc(ptr unsafe.Pointer, size uintptr) unsafe.Pointer {
 	if p == nil {
 		log.Panicf("C realloc failed (size = %d)", size)
 	}
+	if ptr == nil {
+		atomic.AddInt64(&cAllocs, 1)
+	}
 	return p
 }
 
 func free(ptr unsafe.Pointer) {
+	if ptr != nil {
+		atomic.AddInt64(&cAllocs, -1)
+	}
 	C.free(ptr)
 }
 
 func cString(in string) unsafe.Pointer {
+	atomic.AddInt64(&cAllocs, 1)
 	return unsafe.Pointer(C.CString(in))
 }
@@ -8,6 +8,19 @@ package jnigi
 #include<jni.h>
 #include<stdlib.h>
 
+// GetModule is in the function table of jni.h since JNI_VERSION_9, IsVirtualThread since
+// JNI_VERSION_21, check before the missing constants are defined below
+#ifdef JNI_VERSION_9
+#define JNIGI_HAVE_GET_MODULE 1
+#else
+#define JNIGI_HAVE_GET_MODULE 0
+#endif
+#ifdef JNI_VERSION_21
+#define JNIGI_HAVE_IS_VIRTUAL_THREAD 1
+#else
+#define JNIGI_HAVE_IS_VIRTUAL_THREAD 0
+#endif
+
 // Android is missing the JNI_VERSION_1_8, JNI_VERSION_9, JNI_VERSION_10 constant
 #ifndef JNI_VERSION_1_8
 #define JNI_VERSION_1_8 0x00010008
@@ -18,12 +31,69 @@ package jnigi
 #ifndef JNI_VERSION_10
 #define JNI_VERSION_10  0x000a0000
 #endif
+#ifndef JNI_VERSION_19
+#define JNI_VERSION_19  0x00130000
+#endif
+#ifndef JNI_VERSION_20
+#define JNI_VERSION_20  0x00140000
+#endif
+#ifndef JNI_VERSION_21
+#define JNI_VERSION_21  0x00150000
+#endif
+
+jint GetVersion(JNIEnv* env) {
+	return (*env)->GetVersion (env);
+}
+
+jobject GetModule(JNIEnv* env, jclass clazz) {
+#if JNIGI_HAVE_GET_MODULE
+	return (*env)->GetModule (env, clazz);
+#else
+	return NULL;
+#endif
+}
 
+jboolean IsVirtualThread(JNIEnv* env, jobject obj) {
+#if JNIGI_HAVE_IS_VIRTUAL_THREAD
+	return (*env)->IsVirtualThread (env, obj);
+#else
+	return JNI_FALSE;
+#endif
+}
+
+
+jclass DefineClass(JNIEnv* env, char* name, jobject loader, jbyte* buf, jsize len) {
+	return (*env)->DefineClass (env, name, loader, buf, len);
+}
 
 jclass FindClass(JNIEnv* env, char* name) {
 	return (*env)->FindClass (env, name);
 }
 
+jmethodID FromReflectedMethod(JNIEnv* env, jobject method) {
+	return (*env)->FromReflectedMethod (env, method);
+}
+
+jfieldID FromReflectedField(JNIEnv* env, jobject field) {
+	return (*env)->FromReflectedField (env, field);
+}
+
+jobject ToReflectedMethod(JNIEnv* env, jclass cls, jmethodID methodID, jboolean isStatic) {
+	return (*env)->ToReflectedMethod (env, cls, methodID, isStatic);
+}
+
+jobject ToReflectedField(JNIEnv* env, jclass cls, jfieldID fieldID, jboolean isStatic) {
+	return (*env)->ToReflectedField (env, cls, fieldID, isStatic);
+}
+
+jclass GetSuperclass(JNIEnv* env, jclass sub) {
+	return (*env)->GetSuperclass (env, sub);
+}
+
+jboolean IsAssignableFrom(JNIEnv* env, jclass sub, jclass sup) {
+	return (*env)->IsAssignableFrom (env, sub, sup);
+}
+
 jint Throw(JNIEnv* env, jthrowable obj) {
 	return (*env)->Throw (env, obj);
 }
@@ -72,6 +142,18 @@ void DeleteLocalRef(JNIEnv* env, jobject obj) {
 	(*env)->DeleteLocalRef (env, obj);
 }
 
+jobjectRefType GetObjectRefType(JNIEnv* env, jobject obj) {
+	return (*env)->GetObjectRefType (env, obj);
+}
+
+jint MonitorEnter(JNIEnv* env, jobject obj) {
+	return (*env)->MonitorEnter (env, obj);
+}
+
+jint MonitorExit(JNIEnv* env, jobject obj) {
+	return (*env)->MonitorExit (env, obj);
+}
+
 jboolean IsSameObject(JNIEnv* env, jobject obj1, jobject obj2) {
 	return (*env)->IsSameObject (env, obj1, obj2);
 }
@@ -80,6 +162,14 @@ jobject NewLocalRef(JNIEnv* env, jobject ref) {
 	return (*env)->NewLocalRef (env, ref);
 }
 
+jweak NewWeakGlobalRef(JNIEnv* env, jobject obj) {
+	return (*env)->NewWeakGlobalRef (env, obj);
+}
+
+void DeleteWeakGlobalRef(JNIEnv* env, jweak ref) {
+	(*env)->DeleteWeakGlobalRef (env, ref);
+}
+
 jint EnsureLocalCapacity(JNIEnv* env, jint capacity) {
 	return (*env)->EnsureLocalCapacity (env, capacity);
 }
@@ -584,6 +674,14 @@ jint AttachCurrentThread(JavaVM* vm, void** penv, void* args) {
 #endif
 }
 
+jint AttachCurrentThreadAsDaemon(JavaVM* vm, void** penv, void* args) {
+#ifdef ANDROID_JNI
+	return (*vm)->AttachCurrentThreadAsDaemon (vm, (JNIEnv**)penv, args);
+#else
+	return (*vm)->AttachCurrentThreadAsDaemon (vm, penv, args);
+#endif
+}
+
 jint DetachCurrentThread(JavaVM* vm) {
 	return (*vm)->DetachCurrentThread (vm);
 }
@@ -592,6 +690,10 @@ jint DestroyJavaVM(JavaVM* vm) {
  	return (*vm)->DestroyJavaVM (vm);
 }
 
+jint GetEnv(JavaVM* vm, void** penv, jint version) {
+	return (*vm)->GetEnv (vm, penv, version);
+}
+
 jint GetJavaVM(JNIEnv* env, JavaVM** vm) {
 	return (*env)->GetJavaVM (env, vm);
 }
@@ -648,8 +750,19 @@ const (
 	JNI_VERSION_1_8 = C.JNI_VERSION_1_8
 	JNI_VERSION_9   = C.JNI_VERSION_9
 	JNI_VERSION_10  = C.JNI_VERSION_10
+	JNI_VERSION_19  = C.JNI_VERSION_19
+	JNI_VERSION_20  = C.JNI_VERSION_20
+	JNI_VERSION_21  = C.JNI_VERSION_21
 
 	DEFAULT_VERSION = JNI_VERSION_1_6
+
+	jniOK        = C.JNI_OK
+	jniEDetached = C.JNI_EDETACHED
+	jniEVersion  = C.JNI_EVERSION
+
+	// haveGetModule and haveIsVirtualThread are true if jni.h has the function
+	haveGetModule       = C.JNIGI_HAVE_GET_MODULE != 0
+	haveIsVirtualThread = C.JNIGI_HAVE_IS_VIRTUAL_THREAD != 0
 )
 
 type (
@@ -681,6 +794,34 @@ type (
 	jint          C.jint
 )
 
+func defineClass(env unsafe.Pointer, name unsafe.Pointer, loader jobject, buf unsafe.Pointer, len jsize) jclass {
+	return jclass(unsafe.Pointer(C.DefineClass((*C.JNIEnv)(env), (*C.char)(name), C.jobject(unsafe.Pointer(loader)), (*C.jbyte)(buf), C.jsize(len))))
+}
+
+func fromReflectedMethod(env unsafe.Pointer, method jobject) jmethodID {
+	return jmethodID(unsafe.Pointer(C.FromReflectedMethod((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(method)))))
+}
+
+func fromReflectedField(env unsafe.Pointer, field jobject) jfieldID {
+	return jfieldID(unsafe.Pointer(C.FromReflectedField((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(field)))))
+}
+
+func toReflectedMethod(env unsafe.Pointer, cls jclass, methodID jmethodID, isStatic jboolean) jobject {
+	return jobject(unsafe.Pointer(C.ToReflectedMethod((*C.JNIEnv)(env), C.jclass(unsafe.Pointer(cls)), C.jmethodID(unsafe.Pointer(methodID)), C.jboolean(isStatic))))
+}
+
+func toReflectedField(env unsafe.Pointer, cls jclass, fieldID jfieldID, isStatic jboolean) jobject {
+	return jobject(unsafe.Pointer(C.ToReflectedField((*C.JNIEnv)(env), C.jclass(unsafe.Pointer(cls)), C.jfieldID(unsafe.Pointer(fieldID)), C.jboolean(isStatic))))
+}
+
+func getSuperclass(env unsafe.Pointer, sub jclass) jclass {
+	return jclass(unsafe.Pointer(C.GetSuperclass((*C.JNIEnv)(env), C.jclass(unsafe.Pointer(sub)))))
+}
+
+func isAssignableFrom(env unsafe.Pointer, sub jclass, sup jclass) jboolean {
+	return jboolean(C.IsAssignableFrom((*C.JNIEnv)(env), C.jclass(unsafe.Pointer(sub)), C.jclass(unsafe.Pointer(sup))))
+}
+
 func throw(env unsafe.Pointer, obj jthrowable) jint {
 	return jint(C.Throw((*C.JNIEnv)(env), C.jthrowable(unsafe.Pointer(obj))))
 }
@@ -729,6 +870,30 @@ func deleteLocalRef(env unsafe.Pointer, obj jobject) {
 	C.DeleteLocalRef((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj)))
 }
 
+func getObjectRefType(env unsafe.Pointer, obj jobject) int {
+	return int(C.GetObjectRefType((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj))))
+}
+
+func getVersion(env unsafe.Pointer) jint {
+	return jint(C.GetVersion((*C.JNIEnv)(env)))
+}
+
+func getModule(env unsafe.Pointer, clazz jclass) jobject {
+	return jobject(unsafe.Pointer(C.GetModule((*C.JNIEnv)(env), C.jclass(unsafe.Pointer(clazz)))))
+}
+
+func isVirtualThread(env unsafe.Pointer, obj jobject) jboolean {
+	return jboolean(C.IsVirtualThread((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj))))
+}
+
+func monitorEnter(env unsafe.Pointer, obj jobject) jint {
+	return jint(C.MonitorEnter((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj))))
+}
+
+func monitorExit(env unsafe.Pointer, obj jobject) jint {
+	return jint(C.MonitorExit((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj))))
+}
+
 func isSameObject(env unsafe.Pointer, obj1 jobject, obj2 jobject) jboolean {
 	return jboolean(C.IsSameObject((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj1)), C.jobject(unsafe.Pointer(obj2))))
 }
@@ -737,6 +902,14 @@ func newLocalRef(env unsafe.Pointer, ref jobject) jobject {
 	return jobject(unsafe.Pointer(C.NewLocalRef((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(ref)))))
 }
 
+func newWeakGlobalRef(env unsafe.Pointer, obj jobject) jobject {
+	return jobject(unsafe.Pointer(C.NewWeakGlobalRef((*C.JNIEnv)(env), C.jobject(unsafe.Pointer(obj)))))
+}
+
+func deleteWeakGlobalRef(env unsafe.Pointer, ref jobject) {
+	C.DeleteWeakGlobalRef((*C.JNIEnv)(env), C.jweak(unsafe.Pointer(ref)))
+}
+
 func ensureLocalCapacity(env unsafe.Pointer, capacity jint) jint {
 	return jint(C.EnsureLocalCapacity((*C.JNIEnv)(env), C.jint(capacity)))
 }
@@ -1237,6 +1410,10 @@ func attachCurrentThread(vm unsafe.Pointer, penv unsafe.Pointer, args unsafe.Poi
 	return jint(C.AttachCurrentThread((*C.JavaVM)(vm), (*unsafe.Pointer)(penv), args))
 }
 
+func attachCurrentThreadAsDaemon(vm unsafe.Pointer, penv unsafe.Pointer, args unsafe.Pointer) jint {
+	return jint(C.AttachCurrentThreadAsDaemon((*C.JavaVM)(vm), (*unsafe.Pointer)(penv), args))
+}
+
 func detachCurrentThread(vm unsafe.Pointer) jint {
 	return jint(C.DetachCurrentThread((*C.JavaVM)(vm)))
 }
@@ -1245,6 +1422,10 @@ func destroyJavaVM(vm unsafe.Pointer) jint {
 	return jint(C.DestroyJavaVM((*C.JavaVM)(vm)))
 }
 
+func getEnv(vm unsafe.Pointer, penv unsafe.Pointer, version jint) jint {
+	return jint(C.GetEnv((*C.JavaVM)(vm), (*unsafe.Pointer)(penv), C.jint(version)))
+}
+
 func getJavaVM(env unsafe.Pointer, vm unsafe.Pointer) jint {
 	return jint(C.GetJavaVM((*C.JNIEnv)(env), (**C.JavaVM)(vm)))
 }
@@ -30,6 +30,27 @@ jint dyn_JNI_CreateJavaVM(JavaVM **pvm, void **penv, void *args) {
     return var_JNI_CreateJavaVM(pvm, penv, args);
 }
 
+typedef jint (*type_JNI_GetCreatedJavaVMs)(JavaVM**, jsize, jsize*);
+
+type_JNI_GetCreatedJavaVMs var_JNI_GetCreatedJavaVMs;
+
+// load_JNI_GetCreatedJavaVMs looks up JNI_GetCreatedJavaVMs in the libraries loaded by the process
+// if LoadJVMLib was not called, for example when running inside a Java process. It returns 0 if it
+// is not found.
+int load_JNI_GetCreatedJavaVMs(void) {
+    if (var_JNI_GetCreatedJavaVMs == NULL) {
+        void* self = dlopen(NULL, RTLD_NOW);
+        if (self != NULL) {
+            var_JNI_GetCreatedJavaVMs = (type_JNI_GetCreatedJavaVMs)dlsym(self, "JNI_GetCreatedJavaVMs");
+        }
+    }
+    return var_JNI_GetCreatedJavaVMs != NULL;
+}
+
+jint dyn_JNI_GetCreatedJavaVMs(JavaVM **vmBuf, jsize bufLen, jsize *nVMs) {
+    return var_JNI_GetCreatedJavaVMs(vmBuf, bufLen, nVMs);
+}
+
 // call back for dummy source used to make sure the CFRunLoop doesn't exit right away
 // This callback is called when the source has fired.
 void jnigiCFRSourceCallBack (  void *info  ) {
@@ -83,6 +104,13 @@ func jni_CreateJavaVM(pvm unsafe.Pointer, penv unsafe.Pointer, args unsafe.Point
 	return jint(C.dyn_JNI_CreateJavaVM((**C.JavaVM)(pvm), (*unsafe.Pointer)(penv), (unsafe.Pointer)(args)))
 }
 
+func jni_GetCreatedJavaVMs(vmBuf unsafe.Pointer, bufLen int, nVMs unsafe.Pointer) (jint, error) {
+	if C.load_JNI_GetCreatedJavaVMs() == 0 {
+		return 0, errors.New("could not find JNI_GetCreatedJavaVMs in libjvm.dylib")
+	}
+	return jint(C.dyn_JNI_GetCreatedJavaVMs((**C.JavaVM)(vmBuf), C.jsize(bufLen), (*C.jsize)(nVMs))), nil
+}
+
 // LoadJVMLib loads libjvm.dyo as specified in jvmLibPath
 func LoadJVMLib(jvmLibPath string) error {
 	// On MacOS we need to preload libjli.dylib to workaround JDK-7131356
@@ -136,6 +164,13 @@ func LoadJVMLib(jvmLibPath string) error {
 		return errors.New("could not find JNI_CreateJavaVM in libjvm.dylib")
 	}
 	C.var_JNI_CreateJavaVM = C.type_JNI_CreateJavaVM(ptr)
+
+	// optional, GetCreatedJVMs looks for it in the process if it is not found
+	cs4 := cString("JNI_GetCreatedJavaVMs")
+	defer free(cs4)
+	if ptr = C.dlsym(unsafe.Pointer(libHandle), (*C.char)(cs4)); ptr != nil {
+		C.var_JNI_GetCreatedJavaVMs = C.type_JNI_GetCreatedJavaVMs(ptr)
+	}
 	return nil
 }
 
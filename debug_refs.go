@@ -0,0 +1,9 @@
+//go:build jnigi_debug
+// +build jnigi_debug
+
+package jnigi
+
+// Building with the jnigi_debug tag turns on reference debugging, see SetRefDebug.
+func init() {
+	SetRefDebug(true, nil)
+}
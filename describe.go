@@ -0,0 +1,391 @@
+package jnigi
+
+import (
+	"strings"
+)
+
+// Modifiers holds Java language modifier flags as returned by getModifiers() of the
+// java.lang.reflect classes. See java.lang.reflect.Modifier.
+type Modifiers int32
+
+// Java language modifier flags.
+const (
+	ModPublic       Modifiers = 0x0001
+	ModPrivate      Modifiers = 0x0002
+	ModProtected    Modifiers = 0x0004
+	ModStatic       Modifiers = 0x0008
+	ModFinal        Modifiers = 0x0010
+	ModSynchronized Modifiers = 0x0020
+	ModVolatile     Modifiers = 0x0040
+	ModTransient    Modifiers = 0x0080
+	ModNative       Modifiers = 0x0100
+	ModInterface    Modifiers = 0x0200
+	ModAbstract     Modifiers = 0x0400
+	ModStrict       Modifiers = 0x0800
+)
+
+var modifierNames = []struct {
+	mod  Modifiers
+	name string
+}{
+	// same order as java.lang.reflect.Modifier.toString
+	{ModPublic, "public"},
+	{ModProtected, "protected"},
+	{ModPrivate, "private"},
+	{ModAbstract, "abstract"},
+	{ModStatic, "static"},
+	{ModFinal, "final"},
+	{ModTransient, "transient"},
+	{ModVolatile, "volatile"},
+	{ModSynchronized, "synchronized"},
+	{ModNative, "native"},
+	{ModStrict, "strictfp"},
+	{ModInterface, "interface"},
+}
+
+// Is returns true if all modifiers in mod are set in m.
+func (m Modifiers) Is(mod Modifiers) bool {
+	return m&mod == mod
+}
+
+// String returns the modifiers separated by spaces, as java.lang.reflect.Modifier.toString does.
+func (m Modifiers) String() string {
+	var names []string
+	for _, v := range modifierNames {
+		if m&v.mod != 0 {
+			names = append(names, v.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// MethodDescription describes a Java method or constructor.
+type MethodDescription struct {
+	// Name is the method name, or <init> for constructors.
+	Name           string
+	DeclaringClass string
+	Modifiers      Modifiers
+	// Signature is the JNI method signature, for example (I)Ljava/lang/String;
+	Signature string
+	IsVarArgs bool
+	// GenericString is the result of toGenericString() on the reflected method or constructor.
+	GenericString string
+}
+
+// FieldDescription describes a Java field.
+type FieldDescription struct {
+	Name           string
+	DeclaringClass string
+	Modifiers      Modifiers
+	// Signature is the JNI type signature, for example Ljava/lang/String;
+	Signature string
+	// GenericType is the type name of the generic type of the field, for example java.util.List<java.lang.String>
+	GenericType   string
+	GenericString string
+}
+
+// ClassDescription describes a Java class, its constructors, methods and fields. Class names are
+// in the form used by FindClass, for example java/lang/String.
+type ClassDescription struct {
+	Name          string
+	Modifiers     Modifiers
+	Superclass    string
+	Interfaces    []string
+	GenericString string
+	// Constructors declared by the class.
+	Constructors []MethodDescription
+	// Methods declared by the class, followed by inherited public methods.
+	Methods []MethodDescription
+	// Fields declared by the class, followed by inherited public fields.
+	Fields []FieldDescription
+}
+
+// FindMethods returns the descriptions of methods named name.
+func (d *ClassDescription) FindMethods(name string) []MethodDescription {
+	var found []MethodDescription
+	for _, m := range d.Methods {
+		if m.Name == name {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// FindField returns the description of field name, or nil if there is no such field.
+func (d *ClassDescription) FindField(name string) *FieldDescription {
+	for i := range d.Fields {
+		if d.Fields[i].Name == name {
+			return &d.Fields[i]
+		}
+	}
+	return nil
+}
+
+// DescribeClass uses java.lang.reflect to describe class className.
+func (j *Env) DescribeClass(className string) (*ClassDescription, error) {
+	class, err := j.GetClass(className)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &ClassDescription{Name: class.Name()}
+
+	classObj := class.GetObject()
+	mods, err := callModifiers(j, classObj)
+	if err != nil {
+		return nil, err
+	}
+	desc.Modifiers = mods
+
+	if err := callStringMethodAndAssign(j, classObj, "toGenericString", func(s string) {
+		desc.GenericString = s
+	}); err != nil {
+		return nil, err
+	}
+
+	super, err := class.Superclass(j)
+	if err != nil {
+		return nil, err
+	}
+	if super != nil {
+		desc.Superclass = super.Name()
+		super.Release(j)
+	}
+
+	interfaces, err := class.Interfaces(j)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range interfaces {
+		desc.Interfaces = append(desc.Interfaces, iface.Name())
+		iface.Release(j)
+	}
+
+	if err := j.forEachMember(classObj, "getDeclaredConstructors", "java/lang/reflect/Constructor", func(member *ObjectRef) error {
+		m, err := j.describeExecutable(member, true)
+		if err != nil {
+			return err
+		}
+		desc.Constructors = append(desc.Constructors, m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, getter := range []string{"getDeclaredMethods", "getMethods"} {
+		if err := j.forEachMember(classObj, getter, "java/lang/reflect/Method", func(member *ObjectRef) error {
+			m, err := j.describeExecutable(member, false)
+			if err != nil {
+				return err
+			}
+			if getter == "getMethods" && m.DeclaringClass == desc.Name {
+				return nil
+			}
+			desc.Methods = append(desc.Methods, m)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, getter := range []string{"getDeclaredFields", "getFields"} {
+		if err := j.forEachMember(classObj, getter, "java/lang/reflect/Field", func(member *ObjectRef) error {
+			f, err := j.describeField(member)
+			if err != nil {
+				return err
+			}
+			if getter == "getFields" && f.DeclaringClass == desc.Name {
+				return nil
+			}
+			desc.Fields = append(desc.Fields, f)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return desc, nil
+}
+
+// forEachMember calls java.lang.Class method getter on classObj, which returns an array of
+// memberClass, and calls f with each element. Each call to f is made in its own local frame.
+func (j *Env) forEachMember(classObj *ObjectRef, getter, memberClass string, f func(member *ObjectRef) error) error {
+	j.PrecalculateSignature("()[L" + memberClass + ";")
+	array := NewObjectArrayRef(memberClass)
+	if err := classObj.CallMethod(j, getter, array); err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(array)
+
+	return j.forEachElement(array, f)
+}
+
+// forEachElement calls f with each element of object array, each call is made in its own local frame.
+func (j *Env) forEachElement(array *ObjectRef, f func(elem *ObjectRef) error) error {
+	n := int(getArrayLength(j.jniEnv, jarray(array.jobject)))
+	for i := 0; i < n; i++ {
+		if err := j.PushLocalFrame(16); err != nil {
+			return err
+		}
+		elem := getObjectArrayElement(j.jniEnv, jobjectArray(array.jobject), jsize(i))
+		var err error
+		if j.exceptionCheck() {
+			err = j.handleException()
+		} else {
+			err = f(j.newLocalRef(elem, array.className, false))
+		}
+		j.PopLocalFrame(nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func callModifiers(env *Env, member *ObjectRef) (Modifiers, error) {
+	env.PrecalculateSignature("()I")
+	var mods int32
+	if err := member.CallMethod(env, "getModifiers", &mods); err != nil {
+		return 0, err
+	}
+	return Modifiers(mods), nil
+}
+
+// callClassNameMethod calls method on obj which returns a java.lang.Class and returns the class name.
+func (j *Env) callClassNameMethod(obj *ObjectRef, method string) (string, error) {
+	j.PrecalculateSignature("()Ljava/lang/Class;")
+	classRef := NewObjectRef("java/lang/Class")
+	if err := obj.CallMethod(j, method, classRef); err != nil {
+		return "", err
+	}
+	defer j.DeleteLocalRef(classRef)
+	return j.classNameOf(jclass(classRef.jobject))
+}
+
+// describeExecutable describes a java.lang.reflect.Method or java.lang.reflect.Constructor.
+func (j *Env) describeExecutable(member *ObjectRef, isConstructor bool) (MethodDescription, error) {
+	var m MethodDescription
+	var err error
+
+	if isConstructor {
+		m.Name = "<init>"
+	} else if err = callStringMethodAndAssign(j, member, "getName", func(s string) {
+		m.Name = s
+	}); err != nil {
+		return m, err
+	}
+
+	if m.Modifiers, err = callModifiers(j, member); err != nil {
+		return m, err
+	}
+
+	if m.DeclaringClass, err = j.callClassNameMethod(member, "getDeclaringClass"); err != nil {
+		return m, err
+	}
+
+	j.PrecalculateSignature("()[Ljava/lang/Class;")
+	params := NewObjectArrayRef("java/lang/Class")
+	if err = member.CallMethod(j, "getParameterTypes", params); err != nil {
+		return m, err
+	}
+	defer j.DeleteLocalRef(params)
+	var sig strings.Builder
+	sig.WriteString("(")
+	if err = j.forEachElement(params, func(param *ObjectRef) error {
+		name, err := j.classNameOf(jclass(param.jobject))
+		if err != nil {
+			return err
+		}
+		sig.WriteString(classTypeSignature(name))
+		return nil
+	}); err != nil {
+		return m, err
+	}
+	sig.WriteString(")")
+	if isConstructor {
+		sig.WriteString("V")
+	} else {
+		rName, err := j.callClassNameMethod(member, "getReturnType")
+		if err != nil {
+			return m, err
+		}
+		sig.WriteString(classTypeSignature(rName))
+	}
+	m.Signature = sig.String()
+
+	j.PrecalculateSignature("()Z")
+	if err = member.CallMethod(j, "isVarArgs", &m.IsVarArgs); err != nil {
+		return m, err
+	}
+
+	err = callStringMethodAndAssign(j, member, "toGenericString", func(s string) {
+		m.GenericString = s
+	})
+	return m, err
+}
+
+// describeField describes a java.lang.reflect.Field.
+func (j *Env) describeField(member *ObjectRef) (FieldDescription, error) {
+	var f FieldDescription
+	var err error
+
+	if err = callStringMethodAndAssign(j, member, "getName", func(s string) {
+		f.Name = s
+	}); err != nil {
+		return f, err
+	}
+
+	if f.Modifiers, err = callModifiers(j, member); err != nil {
+		return f, err
+	}
+
+	if f.DeclaringClass, err = j.callClassNameMethod(member, "getDeclaringClass"); err != nil {
+		return f, err
+	}
+
+	typeName, err := j.callClassNameMethod(member, "getType")
+	if err != nil {
+		return f, err
+	}
+	f.Signature = classTypeSignature(typeName)
+
+	j.PrecalculateSignature("()Ljava/lang/reflect/Type;")
+	genericType := NewObjectRef("java/lang/reflect/Type")
+	if err = member.CallMethod(j, "getGenericType", genericType); err != nil {
+		return f, err
+	}
+	defer j.DeleteLocalRef(genericType)
+	if err = callStringMethodAndAssign(j, genericType, "getTypeName", func(s string) {
+		f.GenericType = s
+	}); err != nil {
+		return f, err
+	}
+
+	err = callStringMethodAndAssign(j, member, "toGenericString", func(s string) {
+		f.GenericString = s
+	})
+	return f, err
+}
+
+var primitiveTypeSignatures = map[string]string{
+	"void":    "V",
+	"boolean": "Z",
+	"byte":    "B",
+	"char":    "C",
+	"short":   "S",
+	"int":     "I",
+	"long":    "J",
+	"float":   "F",
+	"double":  "D",
+}
+
+// classTypeSignature returns the JNI type signature for a class named as returned by Class.Name.
+func classTypeSignature(name string) string {
+	if sig, ok := primitiveTypeSignatures[name]; ok {
+		return sig
+	}
+	if strings.HasPrefix(name, "[") {
+		return name
+	}
+	return "L" + name + ";"
+}
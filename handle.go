@@ -0,0 +1,590 @@
+package jnigi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// Method is a prepared handle to a Java method. The class, method ID, parameter classes and return
+// type are resolved once when the handle is created, so calls made through it avoid the signature
+// building and lookups done by CallMethod and CallStaticMethod. A Method can be used from any Env.
+type Method struct {
+	class     jclass
+	className string
+	name      string
+	sig       string
+	mid       jmethodID
+	static    bool
+	ctor      bool
+	params    []Type
+	// paramClasses are global references to the classes of object parameters, 0 for parameters
+	// any value of the parameter type matches
+	paramClasses []jclass
+	rType        Type
+	rClassName   string
+}
+
+// GetMethod returns a handle to method methodName with JNI signature sig in class className.
+func (j *Env) GetMethod(className, methodName, sig string) (*Method, error) {
+	return j.getMethod(false, className, methodName, sig)
+}
+
+// GetStaticMethod returns a handle to static method methodName with JNI signature sig in class className.
+func (j *Env) GetStaticMethod(className, methodName, sig string) (*Method, error) {
+	return j.getMethod(true, className, methodName, sig)
+}
+
+// GetConstructor returns a handle to the constructor with JNI signature sig of class className.
+func (j *Env) GetConstructor(className, sig string) (*Method, error) {
+	return j.getMethod(false, className, "<init>", sig)
+}
+
+func (j *Env) getMethod(static bool, className, methodName, sig string) (*Method, error) {
+	params, rType, rClassName, err := parseMethodSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := j.callFindClass(className)
+	if err != nil {
+		return nil, err
+	}
+
+	mid, err := j.callGetMethodID(static, class, methodName, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	paramClasses, err := j.paramClasses(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Method{
+		class:        jclass(newGlobalRef(j.jniEnv, jobject(class))),
+		className:    className,
+		name:         methodName,
+		sig:          sig,
+		mid:          mid,
+		static:       static,
+		ctor:         methodName == "<init>",
+		params:       paramTypes(params),
+		paramClasses: paramClasses,
+		rType:        rType,
+		rClassName:   rClassName,
+	}, nil
+}
+
+// Name returns the name of the method.
+func (m *Method) Name() string {
+	return m.name
+}
+
+// Signature returns the JNI signature of the method.
+func (m *Method) Signature() string {
+	return m.sig
+}
+
+// ClassName returns the name of the class the method was looked up in.
+func (m *Method) ClassName() string {
+	return m.className
+}
+
+// IsStatic returns true if m is a static method.
+func (m *Method) IsStatic() bool {
+	return m.static
+}
+
+// IsConstructor returns true if m is a constructor.
+func (m *Method) IsConstructor() bool {
+	return m.ctor
+}
+
+// Call calls the method on obj with arguments args and stores return value in dest. For static
+// methods obj is ignored and can be nil.
+func (m *Method) Call(env *Env, obj *ObjectRef, dest interface{}, args ...interface{}) error {
+	if m.ctor {
+		return errors.New("JNIGI: use NewObject to call a constructor")
+	}
+	if !m.static && (obj == nil || obj.IsNil()) {
+		return fmt.Errorf("JNIGI: call of method %s on nil object", m.name)
+	}
+	if !m.static {
+		if err := env.checkRef("Method.Call", obj); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceConvertedArgs(args); err != nil {
+		return err
+	}
+	if err := m.checkArgs(env, args); err != nil {
+		return err
+	}
+
+	// create args for jni call
+	jniArgs, refs, err := env.createArgs(args)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cleanUpArgs(jniArgs)
+		for _, ref := range refs {
+			deleteLocalRef(env.jniEnv, ref)
+		}
+	}()
+
+	var retVal interface{}
+	if m.static {
+		retVal, err = env.callStaticMethodByID(m.class, m.mid, m.rType, m.rClassName, jniArgs)
+	} else {
+		retVal, err = env.callMethodByID(obj.jobject, m.mid, m.rType, m.rClassName, jniArgs)
+	}
+	if err != nil {
+		return err
+	}
+
+	return env.assignReturnValue(retVal, m.rType, dest)
+}
+
+// NewObject calls constructor m with arguments args and returns the new object.
+func (m *Method) NewObject(env *Env, args ...interface{}) (*ObjectRef, error) {
+	if !m.ctor {
+		return nil, fmt.Errorf("JNIGI: method %s is not a constructor", m.name)
+	}
+
+	if err := replaceConvertedArgs(args); err != nil {
+		return nil, err
+	}
+	if err := m.checkArgs(env, args); err != nil {
+		return nil, err
+	}
+
+	// create args for jni call
+	jniArgs, refs, err := env.createArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cleanUpArgs(jniArgs)
+		for _, ref := range refs {
+			deleteLocalRef(env.jniEnv, ref)
+		}
+	}()
+
+	obj := newObjectA(env.jniEnv, m.class, m.mid, jniArgs)
+	if obj == 0 {
+		return nil, env.handleException()
+	}
+
+	return env.newLocalRef(obj, m.className, false), nil
+}
+
+// checkArgs returns an error if args do not match the parameter types of m. JNI does not check the
+// argument types, passing a value of the wrong type is undefined behaviour.
+func (m *Method) checkArgs(env *Env, args []interface{}) error {
+	if len(args) != len(m.params) {
+		return fmt.Errorf("JNIGI: method %s%s called with %d arguments", m.name, m.sig, len(args))
+	}
+	for i, arg := range args {
+		if !valueMatchesType(arg, m.params[i]) {
+			return fmt.Errorf("JNIGI: argument %d of method %s%s can not be %T", i, m.name, m.sig, arg)
+		}
+		if !env.isInstanceOfClass(arg, m.paramClasses[i]) {
+			return fmt.Errorf("JNIGI: argument %d of method %s%s is an object of the wrong class", i, m.name, m.sig)
+		}
+	}
+	return nil
+}
+
+// Release deletes the global class references held by m. The handle must not be used afterwards.
+func (m *Method) Release(env *Env) {
+	deleteGlobalRef(env.jniEnv, jobject(m.class))
+	deleteClassRefs(env.jniEnv, m.paramClasses)
+	m.class = 0
+	m.mid = 0
+	m.paramClasses = nil
+}
+
+// Field is a prepared handle to a Java field. The class, field ID and type are resolved once when
+// the handle is created. A Field can be used from any Env.
+type Field struct {
+	class      jclass
+	className  string
+	name       string
+	sig        string
+	fid        jfieldID
+	static     bool
+	fType      Type
+	fClassName string
+	// valueClass is a global reference to the class of an object field, 0 if any value of the
+	// field type matches
+	valueClass jclass
+}
+
+// GetFieldHandle returns a handle to field fieldName with JNI type signature sig in class className.
+// The Handle suffix tells it apart from GetStaticField and ObjectRef.GetField, which get field values.
+func (j *Env) GetFieldHandle(className, fieldName, sig string) (*Field, error) {
+	return j.getField(false, className, fieldName, sig)
+}
+
+// GetStaticFieldHandle returns a handle to static field fieldName with JNI type signature sig in
+// class className.
+func (j *Env) GetStaticFieldHandle(className, fieldName, sig string) (*Field, error) {
+	return j.getField(true, className, fieldName, sig)
+}
+
+func (j *Env) getField(static bool, className, fieldName, sig string) (*Field, error) {
+	fType, fClassName, rest, err := parseTypeSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" || fType == Void {
+		return nil, fmt.Errorf("JNIGI: invalid field signature %q", sig)
+	}
+
+	class, err := j.callFindClass(className)
+	if err != nil {
+		return nil, err
+	}
+
+	fid, err := j.callGetFieldID(static, class, fieldName, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	valueClass, err := j.objectTypeClass(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Field{
+		class:      jclass(newGlobalRef(j.jniEnv, jobject(class))),
+		className:  className,
+		name:       fieldName,
+		sig:        sig,
+		fid:        fid,
+		static:     static,
+		fType:      fType,
+		fClassName: fClassName,
+		valueClass: valueClass,
+	}, nil
+}
+
+// Name returns the name of the field.
+func (f *Field) Name() string {
+	return f.name
+}
+
+// Signature returns the JNI type signature of the field.
+func (f *Field) Signature() string {
+	return f.sig
+}
+
+// ClassName returns the name of the class the field was looked up in.
+func (f *Field) ClassName() string {
+	return f.className
+}
+
+// IsStatic returns true if f is a static field.
+func (f *Field) IsStatic() bool {
+	return f.static
+}
+
+func (f *Field) checkObj(env *Env, op string, obj *ObjectRef) error {
+	if f.static {
+		return nil
+	}
+	if obj == nil || obj.IsNil() {
+		return fmt.Errorf("JNIGI: access of field %s on nil object", f.name)
+	}
+	return env.checkRef(op, obj)
+}
+
+// Get gets the value of the field in obj and stores it in dest. For static fields obj is ignored
+// and can be nil.
+func (f *Field) Get(env *Env, obj *ObjectRef, dest interface{}) error {
+	fieldVal, err := f.get(env, obj)
+	if err != nil {
+		return err
+	}
+	return env.assignReturnValue(fieldVal, f.fType, dest)
+}
+
+func (f *Field) get(env *Env, obj *ObjectRef) (interface{}, error) {
+	if err := f.checkObj(env, "Field.Get", obj); err != nil {
+		return nil, err
+	}
+	if f.static {
+		return env.getStaticFieldByID(f.class, f.fid, f.fType, f.fClassName)
+	}
+	return env.getFieldByID(obj.jobject, f.fid, f.fType, f.fClassName)
+}
+
+// Set sets the field in obj to value. For static fields obj is ignored and can be nil. An error is
+// returned if value does not match the type of the field, for example an int64 for an int field.
+func (f *Field) Set(env *Env, obj *ObjectRef, value interface{}) error {
+	if err := f.checkObj(env, "Field.Set", obj); err != nil {
+		return err
+	}
+
+	if v, ok := value.(ToJavaConverter); ok {
+		ref, err := v.ConvertToJava()
+		if err != nil {
+			return err
+		}
+		defer env.DeleteLocalRef(ref)
+		value = ref
+	}
+
+	if !valueMatchesType(value, f.fType) {
+		return fmt.Errorf("JNIGI: field %s of type %s can not be set to %T", f.name, f.sig, value)
+	}
+	if !env.isInstanceOfClass(value, f.valueClass) {
+		return fmt.Errorf("JNIGI: field %s of type %s can not be set to an object of another class", f.name, f.sig)
+	}
+
+	if f.static {
+		return env.setStaticFieldByID(f.class, f.fid, value)
+	}
+	return env.setFieldByID(obj.jobject, f.fid, value)
+}
+
+// getTyped gets the value of a field of type t.
+func (f *Field) getTyped(env *Env, obj *ObjectRef, t Type) (interface{}, error) {
+	if f.fType != t {
+		return nil, fmt.Errorf("JNIGI: field %s has type %s, not %s", f.name, f.sig, typeSignature(t, ""))
+	}
+	return f.get(env, obj)
+}
+
+// GetBoolean gets the value of a boolean field.
+func (f *Field) GetBoolean(env *Env, obj *ObjectRef) (bool, error) {
+	v, err := f.getTyped(env, obj, Boolean)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// GetByte gets the value of a byte field.
+func (f *Field) GetByte(env *Env, obj *ObjectRef) (byte, error) {
+	v, err := f.getTyped(env, obj, Byte)
+	if err != nil {
+		return 0, err
+	}
+	return v.(byte), nil
+}
+
+// GetChar gets the value of a char field.
+func (f *Field) GetChar(env *Env, obj *ObjectRef) (uint16, error) {
+	v, err := f.getTyped(env, obj, Char)
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint16), nil
+}
+
+// GetShort gets the value of a short field.
+func (f *Field) GetShort(env *Env, obj *ObjectRef) (int16, error) {
+	v, err := f.getTyped(env, obj, Short)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int16), nil
+}
+
+// GetInt gets the value of an int field.
+func (f *Field) GetInt(env *Env, obj *ObjectRef) (int32, error) {
+	v, err := f.getTyped(env, obj, Int)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int32), nil
+}
+
+// GetLong gets the value of a long field.
+func (f *Field) GetLong(env *Env, obj *ObjectRef) (int64, error) {
+	v, err := f.getTyped(env, obj, Long)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// GetFloat gets the value of a float field.
+func (f *Field) GetFloat(env *Env, obj *ObjectRef) (float32, error) {
+	v, err := f.getTyped(env, obj, Float)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float32), nil
+}
+
+// GetDouble gets the value of a double field.
+func (f *Field) GetDouble(env *Env, obj *ObjectRef) (float64, error) {
+	v, err := f.getTyped(env, obj, Double)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float64), nil
+}
+
+// GetObject gets the value of an object or array field as a local reference.
+func (f *Field) GetObject(env *Env, obj *ObjectRef) (*ObjectRef, error) {
+	if f.fType.baseType() != Object && !f.fType.isArray() {
+		return nil, fmt.Errorf("JNIGI: field %s has type %s, not an object type", f.name, f.sig)
+	}
+	v, err := f.get(env, obj)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ObjectRef), nil
+}
+
+// SetBoolean sets the value of a boolean field.
+func (f *Field) SetBoolean(env *Env, obj *ObjectRef, value bool) error {
+	return f.Set(env, obj, value)
+}
+
+// SetByte sets the value of a byte field.
+func (f *Field) SetByte(env *Env, obj *ObjectRef, value byte) error {
+	return f.Set(env, obj, value)
+}
+
+// SetChar sets the value of a char field.
+func (f *Field) SetChar(env *Env, obj *ObjectRef, value uint16) error {
+	return f.Set(env, obj, value)
+}
+
+// SetShort sets the value of a short field.
+func (f *Field) SetShort(env *Env, obj *ObjectRef, value int16) error {
+	return f.Set(env, obj, value)
+}
+
+// SetInt sets the value of an int field.
+func (f *Field) SetInt(env *Env, obj *ObjectRef, value int32) error {
+	return f.Set(env, obj, value)
+}
+
+// SetLong sets the value of a long field.
+func (f *Field) SetLong(env *Env, obj *ObjectRef, value int64) error {
+	return f.Set(env, obj, value)
+}
+
+// SetFloat sets the value of a float field.
+func (f *Field) SetFloat(env *Env, obj *ObjectRef, value float32) error {
+	return f.Set(env, obj, value)
+}
+
+// SetDouble sets the value of a double field.
+func (f *Field) SetDouble(env *Env, obj *ObjectRef, value float64) error {
+	return f.Set(env, obj, value)
+}
+
+// SetObject sets the value of an object or array field, value can be a nil reference.
+func (f *Field) SetObject(env *Env, obj *ObjectRef, value *ObjectRef) error {
+	if value == nil {
+		value = NewObjectRef(f.fClassName)
+	}
+	return f.Set(env, obj, value)
+}
+
+// Release deletes the global class references held by f. The handle must not be used afterwards.
+func (f *Field) Release(env *Env) {
+	deleteGlobalRef(env.jniEnv, jobject(f.class))
+	if f.valueClass != 0 {
+		deleteGlobalRef(env.jniEnv, jobject(f.valueClass))
+	}
+	f.class = 0
+	f.fid = 0
+	f.valueClass = 0
+}
+
+// paramTypes returns the types of the parameter signatures of a method.
+func paramTypes(params []string) []Type {
+	types := make([]Type, len(params))
+	for i, param := range params {
+		types[i], _, _, _ = parseTypeSignature(param)
+	}
+	return types
+}
+
+// valueMatchesType returns true if value can be passed as a Java value of type t. Any object
+// reference matches an object or array type here, JNI does not check its class so the handles check
+// it with isInstanceOfClass. A Go slice matches an array of its element type or java.lang.Object.
+func valueMatchesType(value interface{}, t Type) bool {
+	if t.baseType() == Object || t.isArray() {
+		if _, ok := value.(jobj); ok {
+			return true
+		}
+		vt, _, err := typeOfValue(value)
+		return err == nil && vt.isArray() && (vt == t || t == Object)
+	}
+	vt, _, err := typeOfValue(value)
+	return err == nil && vt == t
+}
+
+// objectTypeClassName returns the class name of object or array type signature sig in the form used
+// by FindClass, ok is false if sig is a primitive type or java.lang.Object, which any object matches.
+func objectTypeClassName(sig string) (name string, ok bool) {
+	switch {
+	case strings.HasPrefix(sig, "["):
+		return sig, true
+	case strings.HasPrefix(sig, "L") && sig != "Ljava/lang/Object;":
+		return sig[1 : len(sig)-1], true
+	}
+	return "", false
+}
+
+// objectTypeClass returns a global reference to the class of object or array type signature sig,
+// or 0 if any value of the type matches, see objectTypeClassName.
+func (j *Env) objectTypeClass(sig string) (jclass, error) {
+	name, ok := objectTypeClassName(sig)
+	if !ok {
+		return 0, nil
+	}
+	class, err := j.callFindClass(name)
+	if err != nil {
+		return 0, err
+	}
+	return jclass(newGlobalRef(j.jniEnv, jobject(class))), nil
+}
+
+// paramClasses returns the objectTypeClass of each parameter signature of a method.
+func (j *Env) paramClasses(params []string) ([]jclass, error) {
+	classes := make([]jclass, len(params))
+	for i, param := range params {
+		class, err := j.objectTypeClass(param)
+		if err != nil {
+			deleteClassRefs(j.jniEnv, classes)
+			return nil, err
+		}
+		classes[i] = class
+	}
+	return classes, nil
+}
+
+// deleteClassRefs deletes the global references in classes that are not 0.
+func deleteClassRefs(env unsafe.Pointer, classes []jclass) {
+	for _, class := range classes {
+		if class != 0 {
+			deleteGlobalRef(env, jobject(class))
+		}
+	}
+}
+
+// isInstanceOfClass returns false if value is an object that is not an instance of class. Any value
+// matches class 0, and a nil reference matches any class.
+func (j *Env) isInstanceOfClass(value interface{}, class jclass) bool {
+	if class == 0 {
+		return true
+	}
+	o, ok := value.(jobj)
+	if !ok || o.jobj() == 0 {
+		return true
+	}
+	return toBool(isInstanceOf(j.jniEnv, o.jobj(), class))
+}
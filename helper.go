@@ -7,21 +7,16 @@ import (
 	"runtime"
 )
 
-// AttemptToFindJVMLibPath tries to find the full path to the JVM shared library file
+// AttemptToFindJVMLibPath tries to find the full path to the JVM shared library file. It uses
+// JAVA_HOME or the platform default, and if there is no library there the first runtime found by
+// FindJDKs.
 func AttemptToFindJVMLibPath() string {
-	// for these linux is the "default"
-
 	prefix := os.Getenv("JAVA_HOME")
 	if prefix == "" {
-		if runtime.GOOS == "windows" {
-			prefix = filepath.Join("c:", "Program Files", "Java", "jdk")
-		} else if runtime.GOOS == "darwin" {
-			prefix = "/Library/Java/Home"
-		} else {
-			prefix = "/usr/lib/jvm/default-java"
-		}
+		prefix = defaultJavaHome()
 	}
 
+	// for these linux is the "default"
 	dirPath := prefix
 	if runtime.GOOS == "windows" {
 		dirPath = filepath.Join(dirPath, "bin", "server")
@@ -39,6 +34,11 @@ func AttemptToFindJVMLibPath() string {
 	} else {
 		libPath = filepath.Join(dirPath, "libjvm.so")
 	}
+	if _, err := os.Stat(libPath); err != nil {
+		if jdks := FindJDKs(); len(jdks) > 0 {
+			return jdks[0].LibPath
+		}
+	}
 	return libPath
 }
 
@@ -0,0 +1,360 @@
+package jnigi
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	jarLoaderClass     = "jnigi/MemoryJarClassLoader"
+	jarURLHandlerClass = "jnigi/MemoryJarURLStreamHandler"
+	jarURLConnClass    = "jnigi/MemoryJarURLConnection"
+	// jarURLProtocol is the protocol of resource URLs returned by the loader, for example
+	// jnigi-jar:/META-INF/services/java.sql.Driver
+	jarURLProtocol = "jnigi-jar"
+)
+
+// NewJarClassLoader creates a class loader that loads classes and resources from the jar archives
+// jarBytes held in memory, for example embedded in the Go program with go:embed. The jars are
+// searched in order, resources are available with getResource, getResourceAsStream and
+// getResources, so java.util.ServiceLoader finds providers in META-INF/services. Service
+// configuration files found in more than one jar are concatenated. The parent of the loader is
+// the system class loader.
+//
+// Use SetClassLoader to make FindClass, NewObject etc. find classes with the loader. The loader
+// object is available from GetObject, for example to pass to Thread.setContextClassLoader.
+// Not supported on Android.
+func (j *Env) NewJarClassLoader(jarBytes ...[]byte) (*ClassLoaderRef, error) {
+	return j.NewJarClassLoaderWithParent(nil, jarBytes...)
+}
+
+// NewJarClassLoaderWithParent is like NewJarClassLoader, but the parent of the loader is parent.
+// If parent is nil the system class loader is used.
+func (j *Env) NewJarClassLoaderWithParent(parent *ClassLoaderRef, jarBytes ...[]byte) (*ClassLoaderRef, error) {
+	return j.newJarClassLoader(parent, false, jarBytes)
+}
+
+// NewChildFirstJarClassLoader is like NewJarClassLoaderWithParent, but classes in the jars are
+// loaded by the new loader even if the parent loader can load them. This allows loading a version
+// of a library isolated from other versions, for example for plugins.
+func (j *Env) NewChildFirstJarClassLoader(parent *ClassLoaderRef, jarBytes ...[]byte) (*ClassLoaderRef, error) {
+	return j.newJarClassLoader(parent, true, jarBytes)
+}
+
+func (j *Env) newJarClassLoader(parent *ClassLoaderRef, childFirst bool, jarBytes [][]byte) (*ClassLoaderRef, error) {
+	entries, err := readJarEntries(jarBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := j.helperClass(jarLoaderClass)
+	if err != nil {
+		return nil, err
+	}
+
+	parentObj, err := j.parentClassLoader(parent)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		defer j.DeleteLocalRef(parentObj)
+	}
+
+	m, err := j.NewObject("java/util/HashMap")
+	if err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(m)
+
+	put, err := j.GetMethod("java/util/Map", "put", "(Ljava/lang/Object;Ljava/lang/Object;)Ljava/lang/Object;")
+	if err != nil {
+		return nil, err
+	}
+	defer put.Release(j)
+
+	for name, data := range entries {
+		if err := j.putJarEntry(put, m, name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	loader, err := j.newObject(class, jarLoaderClass, parentObj, m.Cast("java/util/Map"), childFirst)
+	if err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(loader)
+
+	return &ClassLoaderRef{
+		ref: newClassLoaderRef(j.jniEnv, loader.jobject),
+		recreate: func(env *Env) (*ClassLoaderRef, error) {
+			return env.newJarClassLoader(parent, childFirst, jarBytes)
+		},
+	}, nil
+}
+
+func (j *Env) putJarEntry(put *Method, m *ObjectRef, name string, data []byte) error {
+	key, err := j.NewObject("java/lang/String", []byte(name), j.GetUTF8String())
+	if err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(key)
+
+	prev := NewObjectRef("java/lang/Object")
+	if err := put.Call(j, m, prev, key, data); err != nil {
+		return err
+	}
+	j.DeleteLocalRef(prev)
+	return nil
+}
+
+// systemClassLoader returns a local reference to the system class loader.
+func (j *Env) systemClassLoader() (*ObjectRef, error) {
+	loader := NewObjectRef("java/lang/ClassLoader")
+	j.PrecalculateSignature("()Ljava/lang/ClassLoader;")
+	if err := j.CallStaticMethod("java/lang/ClassLoader", "getSystemClassLoader", loader); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// readJarEntries returns the contents of the files in jars by name. If a file is in more than one
+// jar the first is used, except for service configuration files in META-INF/services which are
+// concatenated.
+func readJarEntries(jars [][]byte) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	for i, jar := range jars {
+		r, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+		if err != nil {
+			return nil, fmt.Errorf("JNIGI: jar %d: %v", i, err)
+		}
+		for _, f := range r.File {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			prev, dup := entries[f.Name]
+			if dup && !strings.HasPrefix(f.Name, "META-INF/services/") {
+				continue
+			}
+			data, err := readZipFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("JNIGI: jar %d: %s: %v", i, f.Name, err)
+			}
+			if dup {
+				data = append(append(prev, '\n'), data...)
+			}
+			entries[f.Name] = data
+		}
+	}
+	return entries, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// jarClassLoaderBytecode returns the class file of:
+//
+//	public class MemoryJarClassLoader extends ClassLoader {
+//		private final Map entries;
+//		private final URLStreamHandler handler;
+//		private final boolean childFirst;
+//
+//		public MemoryJarClassLoader(ClassLoader parent, Map entries, boolean childFirst) {
+//			super(parent);
+//			this.entries = entries;
+//			this.handler = new MemoryJarURLStreamHandler(entries);
+//			this.childFirst = childFirst;
+//		}
+//
+//		protected synchronized Class loadClass(String name, boolean resolve) throws ClassNotFoundException {
+//			// see childFirstLoadClass
+//		}
+//
+//		protected Class findClass(String name) throws ClassNotFoundException {
+//			byte[] b = (byte[]) entries.get(name.replace('.', '/').concat(".class"));
+//			if (b == null) throw new ClassNotFoundException(name);
+//			return defineClass(name.replace('/', '.'), b, 0, b.length);
+//		}
+//
+//		protected URL findResource(String name) {
+//			if (!entries.containsKey(name)) return null;
+//			return new URL("jnigi-jar", null, -1, "/".concat(name), handler);
+//		}
+//
+//		protected Enumeration findResources(String name) {
+//			URL url = findResource(name);
+//			if (url == null) return Collections.emptyEnumeration();
+//			return Collections.enumeration(Collections.singletonList(url));
+//		}
+//	}
+func jarClassLoaderBytecode() []byte {
+	cw := newClassWriter(jarLoaderClass, "java/lang/ClassLoader")
+	cw.field(accPrivate|accFinal, "entries", "Ljava/util/Map;")
+	cw.field(accPrivate|accFinal, "handler", "Ljava/net/URLStreamHandler;")
+	cw.field(accPrivate|accFinal, "childFirst", "Z")
+
+	cw.method(accPublic, "<init>", "(Ljava/lang/ClassLoader;Ljava/util/Map;Z)V", 4, 4).
+		op(opAload0, opAload1).
+		invoke(opInvokespecial, "java/lang/ClassLoader", "<init>", "(Ljava/lang/ClassLoader;)V").
+		op(opAload0, opAload2).
+		fieldOp(opPutfield, jarLoaderClass, "entries", "Ljava/util/Map;").
+		op(opAload0).
+		typeOp(opNew, jarURLHandlerClass).
+		op(opDup, opAload2).
+		invoke(opInvokespecial, jarURLHandlerClass, "<init>", "(Ljava/util/Map;)V").
+		fieldOp(opPutfield, jarLoaderClass, "handler", "Ljava/net/URLStreamHandler;").
+		op(opAload0, opIload3).
+		fieldOp(opPutfield, jarLoaderClass, "childFirst", "Z").
+		op(opReturn)
+
+	childFirstLoadClass(cw, jarLoaderClass, "java/lang/ClassLoader", "childFirst")
+
+	code := cw.method(accProtected, "findClass", "(Ljava/lang/String;)Ljava/lang/Class;", 5, 3).
+		op(opAload0).
+		fieldOp(opGetfield, jarLoaderClass, "entries", "Ljava/util/Map;").
+		op(opAload1).bipush('.').bipush('/').
+		invoke(opInvokevirtual, "java/lang/String", "replace", "(CC)Ljava/lang/String;").
+		ldcString(".class").
+		invoke(opInvokevirtual, "java/lang/String", "concat", "(Ljava/lang/String;)Ljava/lang/String;").
+		invokeInterface("java/util/Map", "get", "(Ljava/lang/Object;)Ljava/lang/Object;", 2).
+		typeOp(opCheckcast, "[B").
+		op(opAstore2, opAload2)
+	found := code.branch(opIfnonnull)
+	code.typeOp(opNew, "java/lang/ClassNotFoundException").
+		op(opDup, opAload1).
+		invoke(opInvokespecial, "java/lang/ClassNotFoundException", "<init>", "(Ljava/lang/String;)V").
+		op(opAthrow)
+	code.label(found)
+	code.op(opAload0, opAload1).bipush('/').bipush('.').
+		invoke(opInvokevirtual, "java/lang/String", "replace", "(CC)Ljava/lang/String;").
+		op(opAload2, opIconst0, opAload2, opArraylength).
+		invoke(opInvokevirtual, "java/lang/ClassLoader", "defineClass", "(Ljava/lang/String;[BII)Ljava/lang/Class;").
+		op(opAreturn)
+
+	code = cw.method(accProtected, "findResource", "(Ljava/lang/String;)Ljava/net/URL;", 7, 2).
+		op(opAload0).
+		fieldOp(opGetfield, jarLoaderClass, "entries", "Ljava/util/Map;").
+		op(opAload1).
+		invokeInterface("java/util/Map", "containsKey", "(Ljava/lang/Object;)Z", 2)
+	exists := code.branch(opIfne)
+	code.op(opAconstNull, opAreturn)
+	code.label(exists)
+	code.typeOp(opNew, "java/net/URL").
+		op(opDup).
+		ldcString(jarURLProtocol).
+		op(opAconstNull, opIconstM1).
+		ldcString("/").
+		op(opAload1).
+		invoke(opInvokevirtual, "java/lang/String", "concat", "(Ljava/lang/String;)Ljava/lang/String;").
+		op(opAload0).
+		fieldOp(opGetfield, jarLoaderClass, "handler", "Ljava/net/URLStreamHandler;").
+		invoke(opInvokespecial, "java/net/URL", "<init>", "(Ljava/lang/String;Ljava/lang/String;ILjava/lang/String;Ljava/net/URLStreamHandler;)V").
+		op(opAreturn)
+
+	code = cw.method(accProtected, "findResources", "(Ljava/lang/String;)Ljava/util/Enumeration;", 2, 3).
+		op(opAload0, opAload1).
+		invoke(opInvokevirtual, jarLoaderClass, "findResource", "(Ljava/lang/String;)Ljava/net/URL;").
+		op(opAstore2, opAload2)
+	nonNull := code.branch(opIfnonnull)
+	code.invoke(opInvokestatic, "java/util/Collections", "emptyEnumeration", "()Ljava/util/Enumeration;").
+		op(opAreturn)
+	code.label(nonNull)
+	code.op(opAload2).
+		invoke(opInvokestatic, "java/util/Collections", "singletonList", "(Ljava/lang/Object;)Ljava/util/List;").
+		invoke(opInvokestatic, "java/util/Collections", "enumeration", "(Ljava/util/Collection;)Ljava/util/Enumeration;").
+		op(opAreturn)
+
+	return cw.bytes()
+}
+
+// jarURLStreamHandlerBytecode returns the class file of:
+//
+//	public class MemoryJarURLStreamHandler extends URLStreamHandler {
+//		private final Map entries;
+//
+//		public MemoryJarURLStreamHandler(Map entries) {
+//			this.entries = entries;
+//		}
+//
+//		protected URLConnection openConnection(URL url) {
+//			return new MemoryJarURLConnection(url, (byte[]) entries.get(url.getPath().substring(1)));
+//		}
+//	}
+func jarURLStreamHandlerBytecode() []byte {
+	cw := newClassWriter(jarURLHandlerClass, "java/net/URLStreamHandler")
+	cw.field(accPrivate|accFinal, "entries", "Ljava/util/Map;")
+
+	cw.method(accPublic, "<init>", "(Ljava/util/Map;)V", 2, 2).
+		op(opAload0).
+		invoke(opInvokespecial, "java/net/URLStreamHandler", "<init>", "()V").
+		op(opAload0, opAload1).
+		fieldOp(opPutfield, jarURLHandlerClass, "entries", "Ljava/util/Map;").
+		op(opReturn)
+
+	cw.method(accProtected, "openConnection", "(Ljava/net/URL;)Ljava/net/URLConnection;", 6, 2).
+		typeOp(opNew, jarURLConnClass).
+		op(opDup, opAload1, opAload0).
+		fieldOp(opGetfield, jarURLHandlerClass, "entries", "Ljava/util/Map;").
+		op(opAload1).
+		invoke(opInvokevirtual, "java/net/URL", "getPath", "()Ljava/lang/String;").
+		op(opIconst1).
+		invoke(opInvokevirtual, "java/lang/String", "substring", "(I)Ljava/lang/String;").
+		invokeInterface("java/util/Map", "get", "(Ljava/lang/Object;)Ljava/lang/Object;", 2).
+		typeOp(opCheckcast, "[B").
+		invoke(opInvokespecial, jarURLConnClass, "<init>", "(Ljava/net/URL;[B)V").
+		op(opAreturn)
+
+	return cw.bytes()
+}
+
+// jarURLConnectionBytecode returns the class file of:
+//
+//	public class MemoryJarURLConnection extends URLConnection {
+//		private final byte[] data;
+//
+//		public MemoryJarURLConnection(URL url, byte[] data) {
+//			super(url);
+//			this.data = data;
+//		}
+//
+//		public void connect() {
+//			connected = true;
+//		}
+//
+//		public InputStream getInputStream() {
+//			return new ByteArrayInputStream(data);
+//		}
+//	}
+func jarURLConnectionBytecode() []byte {
+	cw := newClassWriter(jarURLConnClass, "java/net/URLConnection")
+	cw.field(accPrivate|accFinal, "data", "[B")
+
+	cw.method(accPublic, "<init>", "(Ljava/net/URL;[B)V", 2, 3).
+		op(opAload0, opAload1).
+		invoke(opInvokespecial, "java/net/URLConnection", "<init>", "(Ljava/net/URL;)V").
+		op(opAload0, opAload2).
+		fieldOp(opPutfield, jarURLConnClass, "data", "[B").
+		op(opReturn)
+
+	cw.method(accPublic, "connect", "()V", 2, 1).
+		op(opAload0, opIconst1).
+		fieldOp(opPutfield, "java/net/URLConnection", "connected", "Z").
+		op(opReturn)
+
+	cw.method(accPublic, "getInputStream", "()Ljava/io/InputStream;", 3, 1).
+		typeOp(opNew, "java/io/ByteArrayInputStream").
+		op(opDup, opAload0).
+		fieldOp(opGetfield, jarURLConnClass, "data", "[B").
+		invoke(opInvokespecial, "java/io/ByteArrayInputStream", "<init>", "([B)V").
+		op(opAreturn)
+
+	return cw.bytes()
+}
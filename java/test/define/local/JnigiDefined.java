@@ -0,0 +1,12 @@
+package local;
+
+// Compiled outside of the test class path, loaded with Env.DefineClass.
+public class JnigiDefined {
+    public String greeting() {
+        return "defined";
+    }
+
+    public static int twice(int v) {
+        return v * 2;
+    }
+}
@@ -0,0 +1,46 @@
+package local;
+
+import java.io.ByteArrayOutputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.util.ServiceLoader;
+import java.util.function.Supplier;
+
+// Compiled outside of the test class path, loaded from a jar in memory with Env.NewJarClassLoader.
+public class JnigiJarTest implements Supplier<String> {
+    public String get() {
+        return "from jar";
+    }
+
+    public static String resource(String name) throws IOException {
+        InputStream in = JnigiJarTest.class.getResourceAsStream(name);
+        if (in == null) {
+            return null;
+        }
+        try {
+            ByteArrayOutputStream out = new ByteArrayOutputStream();
+            byte[] buf = new byte[256];
+            int n;
+            while ((n = in.read(buf)) > 0) {
+                out.write(buf, 0, n);
+            }
+            return out.toString("UTF-8");
+        } finally {
+            in.close();
+        }
+    }
+
+    public static int providers() {
+        int n = 0;
+        for (Supplier<?> s : ServiceLoader.load(Supplier.class, JnigiJarTest.class.getClassLoader())) {
+            n++;
+        }
+        return n;
+    }
+
+    public static class Other implements Supplier<String> {
+        public String get() {
+            return "other";
+        }
+    }
+}
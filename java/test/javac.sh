@@ -1,4 +1,8 @@
 #!/bin/bash
 
 cd $(dirname $0)
-javac -d out -cp src  src/local/*
\ No newline at end of file
+javac -d out -cp src  src/local/*
+javac -d out_define define/local/*
+javac -d out_jar jar/local/*
+javac -d out_plugin_v1 plugin/v1/local/*
+javac -d out_plugin_v2 plugin/v2/local/*
@@ -0,0 +1,8 @@
+package local;
+
+// Version 1 of a plugin class, each version is compiled to its own directory.
+public class JnigiPlugin {
+    public static String version() {
+        return "1";
+    }
+}
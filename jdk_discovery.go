@@ -0,0 +1,365 @@
+package jnigi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// JDK is an installed Java runtime, a JDK or a JRE, found by FindJDKs.
+type JDK struct {
+	// Home is the root directory of the runtime.
+	Home string
+	// LibPath is the path of the JVM shared library, pass it to LoadJVMLib.
+	LibPath string
+	// Source is where the runtime was found, for example "JAVA_HOME" or "PATH".
+	Source string
+	// Version, Vendor, VendorVersion and Arch are the JAVA_VERSION, IMPLEMENTOR,
+	// IMPLEMENTOR_VERSION and OS_ARCH of the release file of the runtime, for example "17.0.2",
+	// "Eclipse Adoptium", "Temurin-17.0.2+8" and "x86_64". They are empty if the runtime has no
+	// release file or the file does not have the value.
+	Version       string
+	Vendor        string
+	VendorVersion string
+	Arch          string
+}
+
+// MajorVersion returns the feature version of the runtime, for example 8 for version 1.8.0_292 and
+// 17 for version 17.0.2, or 0 if the version is not known.
+func (d *JDK) MajorVersion() int {
+	v := strings.TrimPrefix(d.Version, "1.")
+	if i := strings.IndexAny(v, ".-+_"); i >= 0 {
+		v = v[:i]
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (d *JDK) String() string {
+	s := d.Home + " (" + d.Source
+	if d.Version != "" {
+		s += ", version " + d.Version
+	}
+	if d.Vendor != "" {
+		s += ", vendor " + d.Vendor
+	}
+	if d.VendorVersion != "" {
+		s += " " + d.VendorVersion
+	}
+	if d.Arch != "" {
+		s += ", arch " + d.Arch
+	}
+	return s + ")"
+}
+
+// JDKFilter selects a runtime in FindJDK.
+type JDKFilter struct {
+	// MinVersion is the lowest feature version, for example 17, 0 for any version.
+	MinVersion int
+	// Vendor is matched case insensitively against a part of the vendor or vendor version, for
+	// example "adoptium" or "temurin", "" for any vendor.
+	Vendor string
+}
+
+func (f JDKFilter) match(d *JDK) bool {
+	if f.MinVersion > 0 && d.MajorVersion() < f.MinVersion {
+		return false
+	}
+	if f.Vendor != "" {
+		vendor := strings.ToLower(f.Vendor)
+		if !strings.Contains(strings.ToLower(d.Vendor), vendor) &&
+			!strings.Contains(strings.ToLower(d.VendorVersion), vendor) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f JDKFilter) String() string {
+	var conds []string
+	if f.MinVersion > 0 {
+		conds = append(conds, "version >= "+strconv.Itoa(f.MinVersion))
+	}
+	if f.Vendor != "" {
+		conds = append(conds, "vendor "+strconv.Quote(f.Vendor))
+	}
+	if len(conds) == 0 {
+		return "any"
+	}
+	return strings.Join(conds, " and ")
+}
+
+// jlinkImageDirs are the directories, relative to the directory of the executable, searched for a
+// runtime image made by jlink or jpackage.
+var jlinkImageDirs = []string{
+	".",
+	"runtime",
+	"jre",
+	filepath.Join("..", "runtime"),
+	filepath.Join("..", "lib", "runtime"),
+}
+
+// FindJDKs returns the Java runtimes that have a JVM shared library, in the order they are searched:
+//
+//	JAVA_HOME             the JAVA_HOME environment variable
+//	jlink image           a runtime image next to the executable, see jlinkImageDirs
+//	default               the platform default used by AttemptToFindJVMLibPath
+//	PATH                  the runtime of the java command found in PATH, following symlinks
+//	system                /usr/lib/jvm/* on Linux, /Library/Java/JavaVirtualMachines on macOS and
+//	                      Program Files\Java on Windows
+//	SDKMAN                $SDKMAN_DIR/candidates/java/*, or ~/.sdkman if SDKMAN_DIR is not set
+//
+// A runtime found more than once, for example through a symlink, is returned once.
+func FindJDKs() []JDK {
+	return searchJDKs().jdks
+}
+
+// FindJDK returns the first runtime of FindJDKs that matches filter. The error lists the places
+// searched and the runtimes that did not match.
+func FindJDK(filter JDKFilter) (*JDK, error) {
+	s := searchJDKs()
+	var rejected []string
+	for i := range s.jdks {
+		if filter.match(&s.jdks[i]) {
+			return &s.jdks[i], nil
+		}
+		rejected = append(rejected, s.jdks[i].String())
+	}
+
+	msg := "JNIGI: no Java runtime found matching " + filter.String() + ", searched " + strings.Join(s.searched, ", ")
+	if len(rejected) > 0 {
+		msg += "; found " + strings.Join(rejected, ", ")
+	}
+	return nil, errors.New(msg)
+}
+
+// jdkSearch collects runtimes and describes the places searched for the FindJDK error.
+type jdkSearch struct {
+	jdks     []JDK
+	seen     map[string]bool
+	searched []string
+}
+
+func searchJDKs() *jdkSearch {
+	s := &jdkSearch{seen: make(map[string]bool)}
+
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		s.searchDir("JAVA_HOME", home)
+	} else {
+		s.searched = append(s.searched, "JAVA_HOME (not set)")
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+			exe = resolved
+		}
+		var dirs []string
+		for _, dir := range jlinkImageDirs {
+			dirs = append(dirs, filepath.Join(filepath.Dir(exe), dir))
+		}
+		s.searchDirs("jlink image", filepath.Dir(exe), dirs)
+	}
+
+	s.searchDir("default", defaultJavaHome())
+
+	if java, err := exec.LookPath("java"); err == nil {
+		if resolved, err := filepath.EvalSymlinks(java); err == nil {
+			java = resolved
+		}
+		s.searchDir("PATH", filepath.Dir(filepath.Dir(java)))
+	} else {
+		s.searched = append(s.searched, "PATH (no java command)")
+	}
+
+	if pattern := systemJDKGlob(); pattern != "" {
+		dirs, _ := filepath.Glob(pattern)
+		s.searchDirs("system", pattern, dirs)
+	}
+
+	sdkman := os.Getenv("SDKMAN_DIR")
+	if sdkman == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			sdkman = filepath.Join(home, ".sdkman")
+		}
+	}
+	if sdkman != "" {
+		pattern := filepath.Join(sdkman, "candidates", "java", "*")
+		dirs, _ := filepath.Glob(pattern)
+		s.searchDirs("SDKMAN", pattern, dirs)
+	}
+
+	return s
+}
+
+// searchDir adds the runtime in home and records the search as source=home.
+func (s *jdkSearch) searchDir(source, home string) {
+	desc := source + "=" + home
+	switch s.add(source, home) {
+	case jdkNotFound:
+		desc += " (no JVM library)"
+	case jdkDuplicate:
+		desc += " (already found)"
+	}
+	s.searched = append(s.searched, desc)
+}
+
+// searchDirs adds the runtimes in dirs and records the search as source=desc with the number of
+// runtimes added, runtimes that were already found are not counted.
+func (s *jdkSearch) searchDirs(source, desc string, dirs []string) {
+	n := 0
+	for _, dir := range dirs {
+		if s.add(source, dir) == jdkAdded {
+			n++
+		}
+	}
+	s.searched = append(s.searched, fmt.Sprintf("%s=%s (%d found)", source, desc, n))
+}
+
+// jdkAddResult is the result of jdkSearch.add.
+type jdkAddResult int
+
+const (
+	// jdkNotFound means there is no runtime with a JVM library in the directory.
+	jdkNotFound jdkAddResult = iota
+	// jdkAdded means the runtime was added.
+	jdkAdded
+	// jdkDuplicate means the runtime, possibly through another path, was already added.
+	jdkDuplicate
+)
+
+// add adds the runtime in home if it has a JVM library and was not added before.
+func (s *jdkSearch) add(source, home string) jdkAddResult {
+	home = filepath.Clean(home)
+	// The java command of JDK 8 and earlier is in <jdk>/jre/bin, the release file is in the JDK.
+	if filepath.Base(home) == "jre" && !fileExists(filepath.Join(home, "release")) &&
+		fileExists(filepath.Join(filepath.Dir(home), "release")) {
+		home = filepath.Dir(home)
+	}
+	resolved, err := filepath.EvalSymlinks(home)
+	if err != nil {
+		return jdkNotFound
+	}
+	if s.seen[resolved] {
+		return jdkDuplicate
+	}
+	libPath := jvmLibPath(home)
+	if libPath == "" {
+		return jdkNotFound
+	}
+	s.seen[resolved] = true
+
+	d := JDK{Home: home, LibPath: libPath, Source: source}
+	release := readReleaseFile(filepath.Join(home, "release"))
+	d.Version = release["JAVA_VERSION"]
+	d.Vendor = release["IMPLEMENTOR"]
+	d.VendorVersion = release["IMPLEMENTOR_VERSION"]
+	d.Arch = release["OS_ARCH"]
+	s.jdks = append(s.jdks, d)
+	return jdkAdded
+}
+
+// jvmLibPath returns the path of the JVM shared library of the runtime in home, or "" if there is
+// none. JDK 8 and earlier have the library in jre/lib/<arch>/server.
+func jvmLibPath(home string) string {
+	var patterns []string
+	switch runtime.GOOS {
+	case "windows":
+		patterns = []string{
+			filepath.Join("bin", "server", "jvm.dll"),
+			filepath.Join("jre", "bin", "server", "jvm.dll"),
+			filepath.Join("bin", "client", "jvm.dll"),
+		}
+	case "darwin":
+		patterns = []string{
+			filepath.Join("lib", "server", "libjvm.dylib"),
+			filepath.Join("jre", "lib", "server", "libjvm.dylib"),
+		}
+	default:
+		patterns = []string{
+			filepath.Join("lib", "server", "libjvm.so"),
+			filepath.Join("lib", "*", "server", "libjvm.so"),
+			filepath.Join("jre", "lib", "*", "server", "libjvm.so"),
+		}
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(home, pattern))
+		for _, path := range matches {
+			if fileExists(path) {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// readReleaseFile returns the KEY="value" lines of the release file of a runtime, or nil if it
+// cannot be read.
+func readReleaseFile(path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"`)
+		}
+		values[strings.TrimSpace(line[:i])] = value
+	}
+	return values
+}
+
+// defaultJavaHome returns the platform default runtime directory.
+func defaultJavaHome() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(`c:\`, "Program Files", "Java", "jdk")
+	case "darwin":
+		return "/Library/Java/Home"
+	default:
+		return "/usr/lib/jvm/default-java"
+	}
+}
+
+// systemJDKGlob returns the pattern matching the runtimes installed in the platform's system
+// directory, or "" if there is none.
+func systemJDKGlob() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(`c:\`, "Program Files", "Java", "*")
+	case "darwin":
+		return "/Library/Java/JavaVirtualMachines/*/Contents/Home"
+	case "android":
+		return ""
+	default:
+		return "/usr/lib/jvm/*"
+	}
+}
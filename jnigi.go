@@ -37,6 +37,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -60,21 +62,29 @@ type ObjectRef struct {
 	jobject   jobject
 	className string
 	isArray   bool
+	// kind is the kind of reference, env the Env a local reference was created in and frameDepth and
+	// frameID the local frame it was created in, javaVM is the JVM of a weak global reference
+	kind       RefType
+	env        *Env
+	frameDepth int
+	frameID    uint64
+	javaVM     unsafe.Pointer
+	debug      *refInfo
 }
 
 // NewObjectRef returns new *ObjectRef with Nil JNI object reference and class name set to className.
 func NewObjectRef(className string) *ObjectRef {
-	return &ObjectRef{0, className, false}
+	return &ObjectRef{className: className}
 }
 
 // NewObjectArrayRef returns new *ObjectRef with Nil JNI object array reference and class name set to className.
 func NewObjectArrayRef(className string) *ObjectRef {
-	return &ObjectRef{0, className, true}
+	return &ObjectRef{className: className, isArray: true}
 }
 
 // WrapJObject wraps a JNI object value in an ObjectRef
 func WrapJObject(jobj uintptr, className string, isArray bool) *ObjectRef {
-	return &ObjectRef{jobject(jobj), className, isArray}
+	return &ObjectRef{jobject: jobject(jobj), className: className, isArray: isArray}
 }
 
 // GetClassName returns class name of object reference.
@@ -89,16 +99,51 @@ func (o *ObjectRef) IsArray() bool {
 
 // Cast return a new *ObjectRef containing the receiver jobject and with class name set to className.
 func (o *ObjectRef) Cast(className string) *ObjectRef {
-	return &ObjectRef{o.jobject, className, o.isArray}
+	c := *o
+	c.className = className
+	return &c
 }
 
-// IsNil is true if ObjectRef has a Nil Java value
+// CheckedCast is like Cast but first checks that the object referenced by o is an instance of
+// className (an array of className if o is an object array), returning an error if it is not.
+// A Nil reference can be cast to any class.
+func (o *ObjectRef) CheckedCast(env *Env, className string) (*ObjectRef, error) {
+	if !o.IsNil() {
+		checkName := className
+		if o.isArray {
+			checkName = "[L" + className + ";"
+		}
+		ok, err := o.IsInstanceOf(env, checkName)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			runtimeName := "unknown"
+			if class, err := env.GetObjectClass(o); err == nil {
+				runtimeName = class.Name()
+				class.Release(env)
+			}
+			return nil, fmt.Errorf("JNIGI: object of class %s can not be cast to %s", runtimeName, checkName)
+		}
+	}
+	return o.Cast(className), nil
+}
+
+// IsNil is true if ObjectRef has a Nil Java value. A weak global reference is also Nil if its object
+// has been garbage collected, this can only be checked on a thread attached to the JVM, on other
+// threads it is only Nil if it was deleted.
 func (o *ObjectRef) IsNil() bool {
+	if o.jobject != 0 && o.kind == WeakGlobalRefType {
+		return o.weakCleared()
+	}
 	return o.jobject == 0
 }
 
 // IsInstanceOf returns true if o is an instance of className
 func (o *ObjectRef) IsInstanceOf(env *Env, className string) (bool, error) {
+	if err := env.checkRef("IsInstanceOf", o); err != nil {
+		return false, err
+	}
 	class, err := env.callFindClass(className)
 	if err != nil {
 		return false, err
@@ -139,43 +184,107 @@ func (f ExceptionHandlerFunc) CatchException(env *Env, exception *ObjectRef) err
 type Env struct {
 	jniEnv           unsafe.Pointer
 	preCalcSig       string
-	classCache       map[string]jclass
+	classCache       *classCache
 	addtlClassLoader unsafe.Pointer
 	ExceptionHandler ExceptionHandler
+	// frame is the current local frame, only tracked when reference debugging is on
+	frame *refFrame
+	// autoDeleteConverted is set by SetAutoDeleteConverted
+	autoDeleteConverted bool
+	// counters counts the references of the JVM, localRefs the live local references of this Env
+	// and localFrames the live local references of each local frame, lastFrameID is the id of the
+	// last local frame started
+	counters    *refCounters
+	localRefs   int64
+	localFrames []localFrame
+	lastFrameID uint64
+	// thread is the OS thread the Env was created or attached on, a JNIEnv is only valid on its own
+	// thread
+	thread uintptr
 }
 
 // WrapEnv wraps an JNI Env value in an Env
 func WrapEnv(envPtr unsafe.Pointer) *Env {
-	return &Env{jniEnv: envPtr, classCache: make(map[string]jclass)}
+	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
+	if getJavaVM(envPtr, p) < 0 {
+		return &Env{jniEnv: envPtr, classCache: newClassCache(), counters: &refCounters{}, thread: osThreadID()}
+	}
+	return newJVM(*(*unsafe.Pointer)(p), nil).newEnv(envPtr)
 }
 
 // JVM holds a JavaVM value, you only need one of these in your app.
 type JVM struct {
-	javaVM           unsafe.Pointer
+	javaVM unsafe.Pointer
+	// addtlClassLoader is read and written atomically, see SetClassLoader
 	addtlClassLoader unsafe.Pointer
+	classCache       *classCache
+	counters         *refCounters
+}
+
+// newJVM returns a JVM for javaVM with the state shared by all Envs of the JVM.
+func newJVM(javaVM unsafe.Pointer, classLoader unsafe.Pointer) *JVM {
+	return &JVM{
+		javaVM:           javaVM,
+		addtlClassLoader: classLoader,
+		classCache:       sharedClassCache(javaVM),
+		counters:         sharedRefCounters(javaVM),
+	}
 }
 
 // JVMInitArgs holds a JavaVMInitArgs value
 type JVMInitArgs struct {
 	javaVMInitArgs unsafe.Pointer
+	// freeAfterCreate is set by JVMConfig.Build, CreateJVM then frees the C memory
+	freeAfterCreate bool
+	// hooks are installed by CreateJVM
+	hooks *jvmHooks
 }
 
 // CreateJVM calls JNI CreateJavaVM and returns references to the JVM and the initial environment.
-// Use NewJVMInitArgs to create jvmInitArgs.
+// Use NewJVMInitArgs to create jvmInitArgs. If it was created with NEGOTIATE_VERSION the highest JNI
+// version supported by the JVM is used, see Env.Version.
 //
 // Must call runtime.LockOSThread() first.
 func CreateJVM(jvmInitArgs *JVMInitArgs) (*JVM, *Env, error) {
+	if jvmInitArgs.javaVMInitArgs == nil {
+		return nil, nil, errors.New("JNIGI: CreateJVM with freed JVMInitArgs")
+	}
+	if jvmInitArgs.freeAfterCreate {
+		defer jvmInitArgs.Free()
+	}
+	// the JVM only supports one JVM per process
+	if jvms, err := GetCreatedJVMs(); err == nil && len(jvms) > 0 {
+		return nil, nil, ErrJVMExists
+	}
+	if jvmInitArgs.hooks != nil {
+		setJVMHooks(jvmInitArgs.hooks)
+	}
 	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
 	p2 := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
-
-	if jni_CreateJavaVM(p2, p, jvmInitArgs.javaVMInitArgs) < 0 {
+	defer free(p)
+	defer free(p2)
+
+	version := jvmInitArgs.version()
+	versions := []int{version}
+	if version == NEGOTIATE_VERSION {
+		versions = knownVersions
+	}
+	var r jint
+	for _, v := range versions {
+		jvmInitArgs.setVersion(v)
+		if r = jni_CreateJavaVM(p2, p, jvmInitArgs.javaVMInitArgs); r != jniEVersion {
+			break
+		}
+	}
+	if r == jniEVersion {
+		return nil, nil, errors.New("JNIGI: JNI version " + VersionString(version) + " is not supported by the JVM")
+	}
+	if r < 0 {
 		return nil, nil, errors.New("Couldn't instantiate JVM")
 	}
-	jvm := &JVM{javaVM: *(*unsafe.Pointer)(p2)}
-	env := &Env{jniEnv: *(*unsafe.Pointer)(p), classCache: make(map[string]jclass)}
-
-	free(p)
-	free(p2)
+	jvm := newJVM(*(*unsafe.Pointer)(p2), nil)
+	env := jvm.newEnv(*(*unsafe.Pointer)(p))
 	return jvm, env, nil
 }
 
@@ -199,57 +308,214 @@ func UseJVM(pvm unsafe.Pointer, penv unsafe.Pointer, thiz unsafe.Pointer) (*JVM,
 	if thiz != nil {
 		classLoader = getClassLoader(penv, thiz)
 	}
-	jvm := &JVM{javaVM: pvm, addtlClassLoader: classLoader}
-	env := &Env{jniEnv: penv, classCache: make(map[string]jclass), addtlClassLoader: classLoader}
+	jvm := newJVM(pvm, classLoader)
+	env := jvm.newEnv(penv)
 	return jvm, env
 }
 
-// A reference to a class loader object
-type ClassLoaderRef struct {
-	ref unsafe.Pointer
-}
+// ErrJVMExists is returned by CreateJVM if a JVM was already created in the process, use
+// GetCreatedJVMs to get it.
+var ErrJVMExists = errors.New("JNIGI: a JVM already exists in this process, use GetCreatedJVMs")
+
+// GetCreatedJVMs calls JNI GetCreatedJavaVMs, it returns the JVMs created in the process. There is
+// at most one JVM in a process, and none after it is destroyed.
+//
+// This lets Go code running in a Java process, for example as a shared library loaded with
+// System.loadLibrary, find the JVM from any entry point, use JVM.AttachCurrentThread or JVM.GetEnv
+// to get an Env. The JNI function is looked up in the loaded libraries if LoadJVMLib was not called.
+func GetCreatedJVMs() ([]*JVM, error) {
+	ptrSize := unsafe.Sizeof((unsafe.Pointer)(nil))
+	nVMs := malloc(unsafe.Sizeof(jsize(0)))
+	defer free(nVMs)
+
+	bufLen := 1
+	for {
+		vmBuf := calloc(uintptr(bufLen), ptrSize)
+		r, err := jni_GetCreatedJavaVMs(vmBuf, bufLen, nVMs)
+		n := int(*(*jsize)(nVMs))
+		var jvms []*JVM
+		for i := 0; err == nil && r >= 0 && i < n && i < bufLen; i++ {
+			jvms = append(jvms, newJVM(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(vmBuf) + ptrSize*uintptr(i))), nil))
+		}
+		free(vmBuf)
 
-// Get a class loader object from an existing object obj
-func (r *Env) GetClassLoader(obj *ObjectRef) *ClassLoaderRef {
-	classLoader := getClassLoader(r.jniEnv, (unsafe.Pointer)(obj.jobject))
-	return &ClassLoaderRef{classLoader}
+		if err != nil {
+			return nil, err
+		}
+		if r < 0 {
+			return nil, errors.New("JNIGI: JNI_GetCreatedJavaVMs failed")
+		}
+		if n <= bufLen {
+			return jvms, nil
+		}
+		bufLen = n
+	}
 }
 
-// Set the env to look up classes using classloader, (it still fall back to JNI findClass function)
+// Set the env to look up classes using classloader, (it still fall back to JNI findClass function).
+// A nil classLoader removes the class loader.
 func (r *Env) SetClassLoader(classLoader *ClassLoaderRef) {
+	if classLoader == nil {
+		r.addtlClassLoader = nil
+		return
+	}
 	r.addtlClassLoader = classLoader.ref
 }
 
+// SetClassLoader sets the class loader used by Envs returned by AttachCurrentThread, see
+// Env.SetClassLoader. Envs already attached are not changed. It is safe to call while other
+// goroutines attach threads.
+func (j *JVM) SetClassLoader(classLoader *ClassLoaderRef) {
+	var ref unsafe.Pointer
+	if classLoader != nil {
+		ref = classLoader.ref
+	}
+	atomic.StorePointer(&j.addtlClassLoader, ref)
+}
+
+// classLoader returns the class loader set with SetClassLoader.
+func (j *JVM) classLoader() unsafe.Pointer {
+	return atomic.LoadPointer(&j.addtlClassLoader)
+}
+
 // AttachCurrentThread calls JNI AttachCurrentThread.
 // Must call runtime.LockOSThread() first.
 func (j *JVM) AttachCurrentThread() *Env {
+	env, err := j.AttachCurrentThreadWithOptions("", nil, false)
+	if err != nil {
+		panic("AttachCurrentThread failed")
+	}
+	return env
+}
+
+// ErrDetached is returned by GetEnv if the current thread is not attached to the JVM.
+var ErrDetached = errors.New("JNIGI: current thread is not attached to the JVM")
+
+// GetEnv calls JNI GetEnv, it returns the Env of the current thread if it is attached to the JVM,
+// otherwise ErrDetached is returned. Must call runtime.LockOSThread() first.
+func (j *JVM) GetEnv() (*Env, error) {
 	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
 
-	//	p := (**C.JNIEnv)(malloc(unsafe.Sizeof((*C.JNIEnv)(nil))))
+	switch r := getEnv(j.javaVM, p, DEFAULT_VERSION); r {
+	case jniOK:
+		return j.newEnv(*(*unsafe.Pointer)(p)), nil
+	case jniEDetached:
+		return nil, ErrDetached
+	default:
+		return nil, fmt.Errorf("JNIGI: getEnv error %d", r)
+	}
+}
 
-	if attachCurrentThread(j.javaVM, p, nil) < 0 {
-		panic("AttachCurrentThread failed")
+// AttachCurrentThreadWithOptions calls JNI AttachCurrentThread, or AttachCurrentThreadAsDaemon if
+// daemon is true. The Java thread is named name, if name is empty the JVM chooses a name. If
+// threadGroup is not nil the thread is added to that java/lang/ThreadGroup. A daemon thread does
+// not stop the JVM from exiting in Destroy.
+// Must call runtime.LockOSThread() first.
+func (j *JVM) AttachCurrentThreadWithOptions(name string, threadGroup *ObjectRef, daemon bool) (*Env, error) {
+	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
+
+	var nameCstr unsafe.Pointer
+	if name != "" {
+		nameCstr = cString(name)
+		defer free(nameCstr)
+	}
+	var group jobject
+	if threadGroup != nil {
+		group = threadGroup.jobject
+	}
+	args := newJVMAttachArgs(DEFAULT_VERSION, nameCstr, group)
+	defer free(args)
+
+	attach := attachCurrentThread
+	if daemon {
+		attach = attachCurrentThreadAsDaemon
 	}
+	if attach(j.javaVM, p, args) < 0 {
+		return nil, errors.New("JNIGI: attachCurrentThread error")
+	}
+	return j.newEnv(*(*unsafe.Pointer)(p)), nil
+}
 
+// AttachIfNeeded returns the Env of the current thread, attaching it with
+// AttachCurrentThreadWithOptions if it is not attached. The returned detach function detaches the
+// thread only if it was attached by AttachIfNeeded, so it is safe to defer in code that may be
+// called from Java or from an attached thread.
+// Must call runtime.LockOSThread() first.
+func (j *JVM) AttachIfNeeded(name string, threadGroup *ObjectRef, daemon bool) (env *Env, detach func() error, err error) {
+	env, err = j.GetEnv()
+	if err == nil {
+		return env, func() error { return nil }, nil
+	}
+	if err != ErrDetached {
+		return nil, nil, err
+	}
+	env, err = j.AttachCurrentThreadWithOptions(name, threadGroup, daemon)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, func() error { return j.DetachCurrentThread(env) }, nil
+}
+
+func (j *JVM) newEnv(jniEnv unsafe.Pointer) *Env {
 	return &Env{
-		jniEnv:           *(*unsafe.Pointer)(p),
-		classCache:       make(map[string]jclass),
-		addtlClassLoader: j.addtlClassLoader,
+		jniEnv:           jniEnv,
+		classCache:       j.classCache,
+		addtlClassLoader: j.classLoader(),
+		counters:         j.counters,
+		thread:           osThreadID(),
 	}
 }
 
 // DetachCurrentThread calls JNI DetachCurrentThread, pass Env returned from AttachCurrentThread for current thread.
+// The class cache is shared by all Envs of the JVM, so it is kept.
 func (j *JVM) DetachCurrentThread(env *Env) error {
-	env.DeleteGlobalRefCache()
-
+	env.detachRefFrames()
+	env.untrackLocals()
 	if detachCurrentThread(j.javaVM) < 0 {
 		return errors.New("JNIGI: detachCurrentThread error")
 	}
 	return nil
 }
 
-// Destroy calls JNI DestroyJavaVM
+// Destroy calls JNI DestroyJavaVM. The pool used by Do and the jnigi-ref-cleaner thread are stopped,
+// and the class cache and other global references held by jnigi are deleted first if the current
+// thread is attached.
 func (j *JVM) Destroy() error {
+	j.closeDefaultPool()
+	j.stopRefCleaner()
+
+	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
+	attached := getEnv(j.javaVM, p, DEFAULT_VERSION) == jniOK
+	var env unsafe.Pointer
+	if attached {
+		env = *(*unsafe.Pointer)(p)
+	}
+
+	if attached {
+		j.classCache.clear(env)
+	}
+	removeSharedClassCache(j.javaVM)
+	removeSharedRefCounters(j.javaVM)
+
+	utf8Mu.Lock()
+	if utf8 != nil && attached {
+		deleteGlobalRef(env, utf8.jobject)
+	}
+	utf8 = nil
+	utf8Mu.Unlock()
+
+	helperClassesMu.Lock()
+	if attached {
+		for _, class := range helperClasses {
+			deleteGlobalRef(env, jobject(class))
+		}
+	}
+	helperClasses = nil
+	helperClassesMu.Unlock()
+
 	if destroyJavaVM(j.javaVM) < 0 {
 		return errors.New("JNIGI: destroyJavaVM error")
 	}
@@ -264,7 +530,7 @@ func (j *Env) GetJVM() (*JVM, error) {
 		return nil, errors.New("Couldn't get JVM")
 	}
 
-	jvm := &JVM{javaVM: *(*unsafe.Pointer)(p), addtlClassLoader: j.addtlClassLoader}
+	jvm := newJVM(*(*unsafe.Pointer)(p), j.addtlClassLoader)
 
 	free(p)
 
@@ -313,6 +579,10 @@ func (j *Env) NewObject(className string, args ...interface{}) (*ObjectRef, erro
 		return nil, err
 	}
 
+	return j.newObject(class, className, args...)
+}
+
+func (j *Env) newObject(class jclass, className string, args ...interface{}) (*ObjectRef, error) {
 	if err := replaceConvertedArgs(args); err != nil {
 		return nil, err
 	}
@@ -350,7 +620,7 @@ func (j *Env) NewObject(className string, args ...interface{}) (*ObjectRef, erro
 		return nil, j.handleException()
 	}
 
-	return &ObjectRef{obj, className, false}, nil
+	return j.newLocalRef(obj, className, false), nil
 }
 
 // FindCLass returns reference to java/lang/Class
@@ -361,11 +631,11 @@ func (j *Env) FindClass(className string) (*ObjectRef, error) {
 		return nil, err
 	}
 
-	return &ObjectRef{jobject(class), "java/lang/Class", false}, nil
+	return &ObjectRef{jobject: jobject(class), className: "java/lang/Class", kind: GlobalRefType}, nil
 }
 
 func (j *Env) callFindClass(className string) (jclass, error) {
-	if v, ok := j.classCache[className]; ok {
+	if v, ok := j.classCache.lookup(classKey{j.addtlClassLoader, className}); ok {
 		return v, nil
 	}
 	cnCstr := cString(className)
@@ -374,14 +644,16 @@ func (j *Env) callFindClass(className string) (jclass, error) {
 	if class == 0 {
 		return 0, j.handleException()
 	}
-	ref := newGlobalRef(j.jniEnv, jobject(class))
-	deleteLocalRef(j.jniEnv, jobject(class))
-	j.classCache[className] = jclass(ref)
 
-	return jclass(ref), nil
+	return j.cacheClass(className, class), nil
 }
 
 func (j *Env) callGetMethodID(static bool, class jclass, name, sig string) (jmethodID, error) {
+	key := memberKey{static: static, name: name, sig: sig}
+	if id, ok := j.classCache.member(class, key); ok {
+		return jmethodID(id), nil
+	}
+
 	mnCstr := cString(name)
 	defer free(mnCstr)
 
@@ -399,6 +671,7 @@ func (j *Env) callGetMethodID(static bool, class jclass, name, sig string) (jmet
 		return 0, j.handleException()
 	}
 
+	j.classCache.putMember(class, key, uintptr(mid))
 	return mid, nil
 }
 
@@ -420,7 +693,7 @@ func (j *Env) FromObjectArray(objRef *ObjectRef) []*ObjectRef {
 		if j.exceptionCheck() {
 			panic(j.handleException())
 		}
-		v[i] = &ObjectRef{jobj, objRef.className, false}
+		v[i] = j.newLocalRef(jobj, objRef.className, false)
 	}
 
 	return v
@@ -552,7 +825,7 @@ func (j *Env) ToObjectArray(objRefs []*ObjectRef, className string) (arrayRef *O
 	if oa == 0 {
 		panic(j.handleException())
 	}
-	arrayRef.jobject = jobject(oa)
+	arrayRef = j.newLocalRef(jobject(oa), className, true)
 
 	for i, obj := range objRefs {
 		setObjectArrayElement(j.jniEnv, oa, jsize(i), obj.jobject)
@@ -624,7 +897,7 @@ func (b *ByteArray) ReleaseCritical(env *Env, bytes []byte) {
 
 // GetObject returns byte array as *ObjectRef.
 func (b *ByteArray) GetObject() *ObjectRef {
-	return &ObjectRef{jobject(b.arr), "java/lang/Object", false}
+	return &ObjectRef{jobject: jobject(b.arr), className: "java/lang/Object"}
 }
 
 // SetObject sets byte array from o.
@@ -881,9 +1154,14 @@ func (j *Env) createArgs(args []interface{}) (ptr unsafe.Pointer, refs []jobject
 	for i, arg := range args {
 		switch v := arg.(type) {
 		case *convertedArg:
+			// the reference is deleted with refs
+			j.untrackLocal(v.ObjectRef)
 			argList[i] = uint64(v.ObjectRef.jobject)
 			refs = append(refs, v.ObjectRef.jobject)
 		case jobj:
+			if o, ok := v.(*ObjectRef); ok {
+				err = j.checkRef("argument", o)
+			}
 			argList[i] = uint64(v.jobj())
 		case bool:
 			if v {
@@ -1122,6 +1400,82 @@ func typeSignature(t Type, className string) (sig string) {
 	return
 }
 
+// parseTypeSignature parses the JNI type signature at the start of sig and returns its type, the class
+// name for object types and the remainder of sig.
+func parseTypeSignature(sig string) (t Type, className string, rest string, err error) {
+	if len(sig) > 0 && sig[0] == '[' {
+		t = Array
+		sig = sig[1:]
+		// arrays of arrays are treated as object arrays with an array element class
+		if len(sig) > 0 && sig[0] == '[' {
+			_, _, after, err := parseTypeSignature(sig)
+			if err != nil {
+				return 0, "", "", err
+			}
+			return Object | Array, sig[:len(sig)-len(after)], after, nil
+		}
+	}
+	if len(sig) == 0 {
+		return 0, "", "", errors.New("JNIGI: unexpected end of signature")
+	}
+	switch sig[0] {
+	case 'V':
+		t |= Void
+	case 'Z':
+		t |= Boolean
+	case 'B':
+		t |= Byte
+	case 'C':
+		t |= Char
+	case 'S':
+		t |= Short
+	case 'I':
+		t |= Int
+	case 'J':
+		t |= Long
+	case 'F':
+		t |= Float
+	case 'D':
+		t |= Double
+	case 'L':
+		end := strings.IndexByte(sig, ';')
+		if end < 0 {
+			return 0, "", "", fmt.Errorf("JNIGI: invalid object type in signature %q", sig)
+		}
+		return t | Object, sig[1:end], sig[end+1:], nil
+	default:
+		return 0, "", "", fmt.Errorf("JNIGI: invalid type in signature %q", sig)
+	}
+	return t, "", sig[1:], nil
+}
+
+// parseMethodSignature returns the parameter signatures and the return type of method signature sig.
+func parseMethodSignature(sig string) (params []string, rType Type, rClassName string, err error) {
+	if len(sig) == 0 || sig[0] != '(' {
+		return nil, 0, "", fmt.Errorf("JNIGI: invalid method signature %q", sig)
+	}
+	rest := sig[1:]
+	for len(rest) > 0 && rest[0] != ')' {
+		_, _, after, err := parseTypeSignature(rest)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		params = append(params, rest[:len(rest)-len(after)])
+		rest = after
+	}
+	if len(rest) == 0 {
+		return nil, 0, "", fmt.Errorf("JNIGI: invalid method signature %q", sig)
+	}
+	rType, rClassName, rest, err = parseTypeSignature(rest[1:])
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if rest != "" {
+		return nil, 0, "", fmt.Errorf("JNIGI: invalid method signature %q", sig)
+	}
+	return params, rType, rClassName, nil
+}
+
 func sigForMethod(returnType Type, returnClass string, args []interface{}) (string, error) {
 	var paramStr string
 	for i := range args {
@@ -1208,12 +1562,22 @@ func (o *ObjectRef) CallMethod(env *Env, methodName string, dest interface{}, ar
 		return err
 	}
 
+	return env.assignReturnValue(retVal, rType, dest)
+}
+
+// assignReturnValue stores retVal, the value returned by a JNI call or field access of type rType, in dest.
+// Java arrays of primitive types are converted to Go slices and their reference deleted.
+func (j *Env) assignReturnValue(retVal interface{}, rType Type, dest interface{}) error {
 	if v, ok := dest.(ToGoConverter); ok && (rType&Object == Object || rType&Array == Array) {
-		return v.ConvertToGo(retVal.(*ObjectRef))
+		obj := retVal.(*ObjectRef)
+		if _, keep := dest.(*ArrayRef); j.autoDeleteConverted && !keep {
+			defer j.DeleteLocalRef(obj)
+		}
+		return v.ConvertToGo(obj)
 	} else if rType.isArray() && rType != Object|Array {
 		// If return type is an array of convertable java to go types, do the conversion
-		converted, err := env.ToGoArray(retVal.(*ObjectRef).jobject, rType)
-		deleteLocalRef(env.jniEnv, retVal.(*ObjectRef).jobject)
+		converted, err := j.ToGoArray(retVal.(*ObjectRef).jobject, rType)
+		j.DeleteLocalRef(retVal.(*ObjectRef))
 		if err != nil {
 			return err
 		}
@@ -1222,10 +1586,12 @@ func (o *ObjectRef) CallMethod(env *Env, methodName string, dest interface{}, ar
 	} else {
 		return assignDest(retVal, dest)
 	}
-
 }
 
 func (o *ObjectRef) genericCallMethod(env *Env, methodName string, rType Type, rClassName string, args ...interface{}) (interface{}, error) {
+	if err := env.checkRef("CallMethod", o); err != nil {
+		return nil, err
+	}
 	class, err := o.getClass(env)
 	if err != nil {
 		return nil, err
@@ -1263,36 +1629,41 @@ func (o *ObjectRef) genericCallMethod(env *Env, methodName string, rType Type, r
 		}
 	}()
 
+	return env.callMethodByID(o.jobject, mid, rType, rClassName, jniArgs)
+}
+
+// callMethodByID calls the method mid on obj and returns the result converted to a Go value of type rType.
+func (j *Env) callMethodByID(obj jobject, mid jmethodID, rType Type, rClassName string, jniArgs unsafe.Pointer) (interface{}, error) {
 	var retVal interface{}
 
 	switch {
 	case rType == Void:
-		callVoidMethodA(env.jniEnv, o.jobject, mid, jniArgs)
+		callVoidMethodA(j.jniEnv, obj, mid, jniArgs)
 	case rType == Boolean:
-		retVal = toBool(callBooleanMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = toBool(callBooleanMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Byte:
-		retVal = byte(callByteMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = byte(callByteMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Char:
-		retVal = uint16(callCharMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = uint16(callCharMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Short:
-		retVal = int16(callShortMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = int16(callShortMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Int:
-		retVal = int32(callIntMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = int32(callIntMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Long:
-		retVal = int64(callLongMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = int64(callLongMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Float:
-		retVal = float32(callFloatMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = float32(callFloatMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Double:
-		retVal = float64(callDoubleMethodA(env.jniEnv, o.jobject, mid, jniArgs))
+		retVal = float64(callDoubleMethodA(j.jniEnv, obj, mid, jniArgs))
 	case rType == Object || rType.isArray():
-		obj := callObjectMethodA(env.jniEnv, o.jobject, mid, jniArgs)
-		retVal = &ObjectRef{obj, rClassName, rType.isArray()}
+		ret := callObjectMethodA(j.jniEnv, obj, mid, jniArgs)
+		retVal = j.newLocalRef(ret, rClassName, rType.isArray())
 	default:
 		return nil, errors.New("JNIGI unknown return type")
 	}
 
-	if env.exceptionCheck() {
-		return nil, env.handleException()
+	if j.exceptionCheck() {
+		return nil, j.handleException()
 	}
 
 	return retVal, nil
@@ -1310,23 +1681,13 @@ func (o *ObjectRef) CallNonvirtualMethod(env *Env, className string, methodName
 		return err
 	}
 
-	if v, ok := dest.(ToGoConverter); ok && (rType&Object == Object || rType&Array == Array) {
-		return v.ConvertToGo(retVal.(*ObjectRef))
-	} else if rType.isArray() && rType != Object|Array {
-		// If return type is an array of convertable java to go types, do the conversion
-		converted, err := env.ToGoArray(retVal.(*ObjectRef).jobject, rType)
-		deleteLocalRef(env.jniEnv, retVal.(*ObjectRef).jobject)
-		if err != nil {
-			return err
-		}
-
-		return assignDest(converted, dest)
-	} else {
-		return assignDest(retVal, dest)
-	}
+	return env.assignReturnValue(retVal, rType, dest)
 }
 
 func (o *ObjectRef) genericCallNonvirtualMethod(env *Env, className string, methodName string, rType Type, rClassName string, args ...interface{}) (interface{}, error) {
+	if err := env.checkRef("CallNonvirtualMethod", o); err != nil {
+		return nil, err
+	}
 	class, err := env.callFindClass(className)
 	if err != nil {
 		return nil, err
@@ -1387,7 +1748,7 @@ func (o *ObjectRef) genericCallNonvirtualMethod(env *Env, className string, meth
 		retVal = float64(callNonvirtualDoubleMethodA(env.jniEnv, o.jobject, class, mid, jniArgs))
 	case rType == Object || rType.isArray():
 		obj := callNonvirtualObjectMethodA(env.jniEnv, o.jobject, class, mid, jniArgs)
-		retVal = &ObjectRef{obj, rClassName, rType.isArray()}
+		retVal = env.newLocalRef(obj, rClassName, rType.isArray())
 	default:
 		return nil, errors.New("JNIGI unknown return type")
 	}
@@ -1401,38 +1762,29 @@ func (o *ObjectRef) genericCallNonvirtualMethod(env *Env, className string, meth
 
 // CallStaticMethod calls static method methodName in class className with arguments args and stores return value in dest.
 func (j *Env) CallStaticMethod(className string, methodName string, dest interface{}, args ...interface{}) error {
-	rType, rClassName, err := typeOfReturnValue(dest)
+	class, err := j.callFindClass(className)
 	if err != nil {
 		return err
 	}
 
-	retVal, err := j.genericCallStaticMethod(className, methodName, rType, rClassName, args...)
+	return j.callStaticMethod(class, methodName, dest, args...)
+}
+
+func (j *Env) callStaticMethod(class jclass, methodName string, dest interface{}, args ...interface{}) error {
+	rType, rClassName, err := typeOfReturnValue(dest)
 	if err != nil {
 		return err
 	}
 
-	if v, ok := dest.(ToGoConverter); ok && (rType&Object == Object || rType&Array == Array) {
-		return v.ConvertToGo(retVal.(*ObjectRef))
-	} else if rType.isArray() && rType != Object|Array {
-		// If return type is an array of convertable java to go types, do the conversion
-		converted, err := j.ToGoArray(retVal.(*ObjectRef).jobject, rType)
-		deleteLocalRef(j.jniEnv, retVal.(*ObjectRef).jobject)
-		if err != nil {
-			return err
-		}
-
-		return assignDest(converted, dest)
-	} else {
-		return assignDest(retVal, dest)
-	}
-}
-
-func (j *Env) genericCallStaticMethod(className string, methodName string, rType Type, rClassName string, args ...interface{}) (interface{}, error) {
-	class, err := j.callFindClass(className)
+	retVal, err := j.genericCallStaticMethod(class, methodName, rType, rClassName, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	return j.assignReturnValue(retVal, rType, dest)
+}
+
+func (j *Env) genericCallStaticMethod(class jclass, methodName string, rType Type, rClassName string, args ...interface{}) (interface{}, error) {
 	if err := replaceConvertedArgs(args); err != nil {
 		return nil, err
 	}
@@ -1465,6 +1817,11 @@ func (j *Env) genericCallStaticMethod(className string, methodName string, rType
 		}
 	}()
 
+	return j.callStaticMethodByID(class, mid, rType, rClassName, jniArgs)
+}
+
+// callStaticMethodByID calls the static method mid of class and returns the result converted to a Go value of type rType.
+func (j *Env) callStaticMethodByID(class jclass, mid jmethodID, rType Type, rClassName string, jniArgs unsafe.Pointer) (interface{}, error) {
 	var retVal interface{}
 
 	switch {
@@ -1488,7 +1845,7 @@ func (j *Env) genericCallStaticMethod(className string, methodName string, rType
 		retVal = float64(callStaticDoubleMethodA(j.jniEnv, class, mid, jniArgs))
 	case rType == Object || rType.isArray():
 		obj := callStaticObjectMethodA(j.jniEnv, class, mid, jniArgs)
-		retVal = &ObjectRef{obj, rClassName, rType.isArray()}
+		retVal = j.newLocalRef(obj, rClassName, rType.isArray())
 	default:
 		return nil, errors.New("JNIGI unknown return type")
 	}
@@ -1501,6 +1858,11 @@ func (j *Env) genericCallStaticMethod(className string, methodName string, rType
 }
 
 func (j *Env) callGetFieldID(static bool, class jclass, name, sig string) (jfieldID, error) {
+	key := memberKey{field: true, static: static, name: name, sig: sig}
+	if id, ok := j.classCache.member(class, key); ok {
+		return jfieldID(id), nil
+	}
+
 	fnCstr := cString(name)
 	defer free(fnCstr)
 
@@ -1517,6 +1879,7 @@ func (j *Env) callGetFieldID(static bool, class jclass, name, sig string) (jfiel
 		return 0, j.handleException()
 	}
 
+	j.classCache.putMember(class, key, uintptr(fid))
 	return fid, nil
 }
 
@@ -1532,23 +1895,13 @@ func (o *ObjectRef) GetField(env *Env, fieldName string, dest interface{}) error
 		return err
 	}
 
-	if v, ok := dest.(ToGoConverter); ok && (fType&Object == Object || fType&Array == Array) {
-		return v.ConvertToGo(fieldVal.(*ObjectRef))
-	} else if fType.isArray() && fType != Object|Array {
-		// If return type is an array of convertable java to go types, do the conversion
-		converted, err := env.ToGoArray(fieldVal.(*ObjectRef).jobject, fType)
-		deleteLocalRef(env.jniEnv, fieldVal.(*ObjectRef).jobject)
-		if err != nil {
-			return err
-		}
-
-		return assignDest(converted, dest)
-	} else {
-		return assignDest(fieldVal, dest)
-	}
+	return env.assignReturnValue(fieldVal, fType, dest)
 }
 
 func (o *ObjectRef) genericGetField(env *Env, fieldName string, fType Type, fClassName string) (interface{}, error) {
+	if err := env.checkRef("GetField", o); err != nil {
+		return nil, err
+	}
 	class, err := o.getClass(env)
 	if err != nil {
 		return nil, err
@@ -1567,34 +1920,39 @@ func (o *ObjectRef) genericGetField(env *Env, fieldName string, fType Type, fCla
 		return nil, err
 	}
 
+	return env.getFieldByID(o.jobject, fid, fType, fClassName)
+}
+
+// getFieldByID gets the value of field fid in obj converted to a Go value of type fType.
+func (j *Env) getFieldByID(obj jobject, fid jfieldID, fType Type, fClassName string) (interface{}, error) {
 	var retVal interface{}
 
 	switch {
 	case fType == Boolean:
-		retVal = toBool(getBooleanField(env.jniEnv, o.jobject, fid))
+		retVal = toBool(getBooleanField(j.jniEnv, obj, fid))
 	case fType == Byte:
-		retVal = byte(getByteField(env.jniEnv, o.jobject, fid))
+		retVal = byte(getByteField(j.jniEnv, obj, fid))
 	case fType == Char:
-		retVal = uint16(getCharField(env.jniEnv, o.jobject, fid))
+		retVal = uint16(getCharField(j.jniEnv, obj, fid))
 	case fType == Short:
-		retVal = int16(getShortField(env.jniEnv, o.jobject, fid))
+		retVal = int16(getShortField(j.jniEnv, obj, fid))
 	case fType == Int:
-		retVal = int32(getIntField(env.jniEnv, o.jobject, fid))
+		retVal = int32(getIntField(j.jniEnv, obj, fid))
 	case fType == Long:
-		retVal = int64(getLongField(env.jniEnv, o.jobject, fid))
+		retVal = int64(getLongField(j.jniEnv, obj, fid))
 	case fType == Float:
-		retVal = float32(getFloatField(env.jniEnv, o.jobject, fid))
+		retVal = float32(getFloatField(j.jniEnv, obj, fid))
 	case fType == Double:
-		retVal = float64(getDoubleField(env.jniEnv, o.jobject, fid))
+		retVal = float64(getDoubleField(j.jniEnv, obj, fid))
 	case fType == Object || fType.isArray():
-		obj := getObjectField(env.jniEnv, o.jobject, fid)
-		retVal = &ObjectRef{obj, fClassName, fType.isArray()}
+		ret := getObjectField(j.jniEnv, obj, fid)
+		retVal = j.newLocalRef(ret, fClassName, fType.isArray())
 	default:
 		return nil, errors.New("JNIGI unknown field type")
 	}
 
-	if env.exceptionCheck() {
-		return nil, env.handleException()
+	if j.exceptionCheck() {
+		return nil, j.handleException()
 	}
 
 	return retVal, nil
@@ -1602,6 +1960,9 @@ func (o *ObjectRef) genericGetField(env *Env, fieldName string, fType Type, fCla
 
 // SetField sets field fieldName in o to value.
 func (o *ObjectRef) SetField(env *Env, fieldName string, value interface{}) error {
+	if err := env.checkRef("SetField", o); err != nil {
+		return err
+	}
 	class, err := o.getClass(env)
 	if err != nil {
 		return err
@@ -1625,40 +1986,50 @@ func (o *ObjectRef) SetField(env *Env, fieldName string, value interface{}) erro
 		return err
 	}
 
+	return env.setFieldByID(o.jobject, fid, value)
+}
+
+// setFieldByID sets field fid in obj to value.
+func (j *Env) setFieldByID(obj jobject, fid jfieldID, value interface{}) error {
 	switch v := value.(type) {
 	case bool:
-		setBooleanField(env.jniEnv, o.jobject, fid, fromBool(v))
+		setBooleanField(j.jniEnv, obj, fid, fromBool(v))
 	case byte:
-		setByteField(env.jniEnv, o.jobject, fid, jbyte(v))
+		setByteField(j.jniEnv, obj, fid, jbyte(v))
 	case uint16:
-		setCharField(env.jniEnv, o.jobject, fid, jchar(v))
+		setCharField(j.jniEnv, obj, fid, jchar(v))
 	case int16:
-		setShortField(env.jniEnv, o.jobject, fid, jshort(v))
+		setShortField(j.jniEnv, obj, fid, jshort(v))
 	case int32:
-		setIntField(env.jniEnv, o.jobject, fid, jint(v))
+		setIntField(j.jniEnv, obj, fid, jint(v))
 	case int:
-		setIntField(env.jniEnv, o.jobject, fid, jint(assignJavaIntFromInt(v)))
+		setIntField(j.jniEnv, obj, fid, jint(assignJavaIntFromInt(v)))
 	case int64:
-		setLongField(env.jniEnv, o.jobject, fid, jlong(v))
+		setLongField(j.jniEnv, obj, fid, jlong(v))
 	case float32:
-		setFloatField(env.jniEnv, o.jobject, fid, jfloat(v))
+		setFloatField(j.jniEnv, obj, fid, jfloat(v))
 	case float64:
-		setDoubleField(env.jniEnv, o.jobject, fid, jdouble(v))
+		setDoubleField(j.jniEnv, obj, fid, jdouble(v))
 	case jobj:
-		setObjectField(env.jniEnv, o.jobject, fid, v.jobj())
+		if o, ok := v.(*ObjectRef); ok {
+			if err := j.checkRef("field value", o); err != nil {
+				return err
+			}
+		}
+		setObjectField(j.jniEnv, obj, fid, v.jobj())
 	case []bool, []byte, []int16, []uint16, []int32, []int, []int64, []float32, []float64:
-		array, err := env.ToJavaArray(v)
+		array, err := j.ToJavaArray(v)
 		if err != nil {
 			return err
 		}
-		defer deleteLocalRef(env.jniEnv, array)
-		setObjectField(env.jniEnv, o.jobject, fid, jobject(array))
+		defer deleteLocalRef(j.jniEnv, array)
+		setObjectField(j.jniEnv, obj, fid, jobject(array))
 	default:
 		return errors.New("JNIGI unknown field value")
 	}
 
-	if env.exceptionCheck() {
-		return env.handleException()
+	if j.exceptionCheck() {
+		return j.handleException()
 	}
 
 	return nil
@@ -1666,38 +2037,29 @@ func (o *ObjectRef) SetField(env *Env, fieldName string, value interface{}) erro
 
 // GetField gets field fieldName in class className, stores value in dest.
 func (j *Env) GetStaticField(className string, fieldName string, dest interface{}) error {
-	fType, fClassName, err := typeOfReturnValue(dest)
+	class, err := j.callFindClass(className)
 	if err != nil {
 		return err
 	}
 
-	fieldVal, err := j.genericGetStaticField(className, fieldName, fType, fClassName)
+	return j.getStaticField(class, fieldName, dest)
+}
+
+func (j *Env) getStaticField(class jclass, fieldName string, dest interface{}) error {
+	fType, fClassName, err := typeOfReturnValue(dest)
 	if err != nil {
 		return err
 	}
 
-	if v, ok := dest.(ToGoConverter); ok && (fType&Object == Object || fType&Array == Array) {
-		return v.ConvertToGo(fieldVal.(*ObjectRef))
-	} else if fType.isArray() && fType != Object|Array {
-		// If return type is an array of convertable java to go types, do the conversion
-		converted, err := j.ToGoArray(fieldVal.(*ObjectRef).jobject, fType)
-		deleteLocalRef(j.jniEnv, fieldVal.(*ObjectRef).jobject)
-		if err != nil {
-			return err
-		}
-
-		return assignDest(converted, dest)
-	} else {
-		return assignDest(fieldVal, dest)
-	}
-}
-
-func (j *Env) genericGetStaticField(className string, fieldName string, fType Type, fClassName string) (interface{}, error) {
-	class, err := j.callFindClass(className)
+	fieldVal, err := j.genericGetStaticField(class, fieldName, fType, fClassName)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	return j.assignReturnValue(fieldVal, fType, dest)
+}
+
+func (j *Env) genericGetStaticField(class jclass, fieldName string, fType Type, fClassName string) (interface{}, error) {
 	var fieldSig string
 	if j.preCalcSig != "" {
 		fieldSig = j.preCalcSig
@@ -1711,6 +2073,11 @@ func (j *Env) genericGetStaticField(className string, fieldName string, fType Ty
 		return nil, err
 	}
 
+	return j.getStaticFieldByID(class, fid, fType, fClassName)
+}
+
+// getStaticFieldByID gets the value of static field fid in class converted to a Go value of type fType.
+func (j *Env) getStaticFieldByID(class jclass, fid jfieldID, fType Type, fClassName string) (interface{}, error) {
 	var retVal interface{}
 
 	switch {
@@ -1732,7 +2099,7 @@ func (j *Env) genericGetStaticField(className string, fieldName string, fType Ty
 		retVal = float64(getStaticDoubleField(j.jniEnv, class, fid))
 	case fType == Object || fType.isArray():
 		obj := getStaticObjectField(j.jniEnv, class, fid)
-		retVal = &ObjectRef{obj, fClassName, fType.isArray()}
+		retVal = j.newLocalRef(obj, fClassName, fType.isArray())
 	default:
 		return nil, errors.New("JNIGI unknown field type")
 	}
@@ -1751,6 +2118,10 @@ func (j *Env) SetStaticField(className string, fieldName string, value interface
 		return err
 	}
 
+	return j.setStaticField(class, fieldName, value)
+}
+
+func (j *Env) setStaticField(class jclass, fieldName string, value interface{}) error {
 	vType, vClassName, err := typeOfValue(value)
 	if err != nil {
 		return err
@@ -1769,6 +2140,11 @@ func (j *Env) SetStaticField(className string, fieldName string, value interface
 		return err
 	}
 
+	return j.setStaticFieldByID(class, fid, value)
+}
+
+// setStaticFieldByID sets static field fid in class to value.
+func (j *Env) setStaticFieldByID(class jclass, fid jfieldID, value interface{}) error {
 	switch v := value.(type) {
 	case bool:
 		setStaticBooleanField(j.jniEnv, class, fid, fromBool(v))
@@ -1789,6 +2165,11 @@ func (j *Env) SetStaticField(className string, fieldName string, value interface
 	case float64:
 		setStaticDoubleField(j.jniEnv, class, fid, jdouble(v))
 	case jobj:
+		if o, ok := v.(*ObjectRef); ok {
+			if err := j.checkRef("field value", o); err != nil {
+				return err
+			}
+		}
 		setStaticObjectField(j.jniEnv, class, fid, v.jobj())
 	case []bool, []byte, []int16, []uint16, []int32, []int, []int64, []float32, []float64:
 		array, err := j.ToJavaArray(v)
@@ -1850,19 +2231,52 @@ func (j *Env) RegisterNative(className, methodName string, returnType TypeSpec,
 
 // NewGlobalRef creates a new object reference to o in Env j.
 func (j *Env) NewGlobalRef(o *ObjectRef) *ObjectRef {
+	j.reportRef("NewGlobalRef", o)
 	g := newGlobalRef(j.jniEnv, o.jobject)
-	return &ObjectRef{g, o.className, o.isArray}
+	return j.newGlobalRef(g, o.className, o.isArray)
+}
+
+// NewWeakGlobalRef creates a new weak global reference to o in Env j. A weak global reference does
+// not keep the object from being garbage collected, use Upgrade or UpgradeGlobal to use the object.
+func (j *Env) NewWeakGlobalRef(o *ObjectRef) *ObjectRef {
+	j.reportRef("NewWeakGlobalRef", o)
+	w := newWeakGlobalRef(j.jniEnv, o.jobject)
+	return j.newWeakGlobalRef(w, o.className, o.isArray)
 }
 
-// DeleteGlobalRef deletes global object reference o.
+// DeleteGlobalRef deletes global object reference o. If o is a weak global reference it is deleted
+// with JNI DeleteWeakGlobalRef.
 func (j *Env) DeleteGlobalRef(o *ObjectRef) {
-	deleteGlobalRef(j.jniEnv, o.jobject)
+	if o.kind == WeakGlobalRefType {
+		j.deleteWeakGlobalRef("DeleteGlobalRef", o)
+		return
+	}
+	if j.checkDelete("DeleteGlobalRef", o, GlobalRefType) {
+		deleteGlobalRef(j.jniEnv, o.jobject)
+		j.untrackGlobal(o)
+	}
 	o.jobject = 0
 }
 
-// DeleteLocalRef deletes object reference o in Env j.
+// DeleteLocalRef deletes object reference o in Env j. If o is a weak global reference it is deleted
+// with JNI DeleteWeakGlobalRef.
 func (j *Env) DeleteLocalRef(o *ObjectRef) {
-	deleteLocalRef(j.jniEnv, o.jobject)
+	if o.kind == WeakGlobalRefType {
+		j.deleteWeakGlobalRef("DeleteLocalRef", o)
+		return
+	}
+	if j.checkDelete("DeleteLocalRef", o, LocalRefType) {
+		deleteLocalRef(j.jniEnv, o.jobject)
+		j.untrackLocal(o)
+	}
+	o.jobject = 0
+}
+
+func (j *Env) deleteWeakGlobalRef(op string, o *ObjectRef) {
+	if j.checkDelete(op, o, WeakGlobalRefType) {
+		deleteWeakGlobalRef(j.jniEnv, o.jobject)
+		j.untrackGlobal(o)
+	}
 	o.jobject = 0
 }
 
@@ -1887,6 +2301,8 @@ func (j *Env) PushLocalFrame(capacity int32) error {
 	if !success {
 		return errors.New("JNIGI: pushLocalFrame error")
 	}
+	j.pushRefFrame()
+	j.trackPushFrame()
 	return nil
 }
 
@@ -1895,15 +2311,54 @@ func (j *Env) PopLocalFrame(result *ObjectRef) *ObjectRef {
 	if result == nil {
 		result = &ObjectRef{}
 	}
+	j.reportRef("PopLocalFrame", result)
 	o := popLocalFrame(j.jniEnv, result.jobject)
 	result.jobject = 0
-	return &ObjectRef{o, result.className, result.isArray}
+	j.popRefFrame()
+	j.trackPopFrame()
+	return j.newLocalRef(o, result.className, result.isArray)
 }
 
-var utf8 *ObjectRef
+// WithLocalFrame calls f in a new local frame of at least capacity local references. The frame is
+// popped when f returns, or panics, deleting the local references created by f. The reference
+// returned by f is kept as a new local reference in the outer frame and returned.
+func (j *Env) WithLocalFrame(capacity int32, f func() (*ObjectRef, error)) (*ObjectRef, error) {
+	if err := j.PushLocalFrame(capacity); err != nil {
+		return nil, err
+	}
+	popped := false
+	defer func() {
+		if !popped {
+			j.PopLocalFrame(nil)
+		}
+	}()
+
+	result, err := f()
+	popped = true
+	if err != nil || result == nil {
+		j.PopLocalFrame(nil)
+		return nil, err
+	}
+	return j.PopLocalFrame(result), nil
+}
+
+// SetAutoDeleteConverted sets whether object references returned by method calls and field gets are
+// deleted after they are converted to a Go value by a ToGoConverter dest, so converters do not need
+// to delete them. An ArrayRef dest keeps its reference. Converters must not keep the reference
+// when this is on.
+func (j *Env) SetAutoDeleteConverted(enabled bool) {
+	j.autoDeleteConverted = enabled
+}
+
+var (
+	utf8Mu sync.Mutex
+	utf8   *ObjectRef
+)
 
 // GetUTF8String return global reference to java/lang/String containing "UTF-8"
 func (j *Env) GetUTF8String() *ObjectRef {
+	utf8Mu.Lock()
+	defer utf8Mu.Unlock()
 	if utf8 == nil {
 		// make sure we don't use any preCalSig set when we do NewObject
 		savePrecalSig := j.preCalcSig
@@ -1913,7 +2368,7 @@ func (j *Env) GetUTF8String() *ObjectRef {
 		if err != nil {
 			panic(err)
 		}
-		global := j.NewGlobalRef(str)
+		global := &ObjectRef{jobject: newGlobalRef(j.jniEnv, str.jobject), className: "java/lang/String", kind: GlobalRefType}
 		j.DeleteLocalRef(str)
 		utf8 = global
 		j.preCalcSig = savePrecalSig
@@ -1922,13 +2377,11 @@ func (j *Env) GetUTF8String() *ObjectRef {
 	return utf8
 }
 
-// DeleteGlobalRefCache deletes all globalRef that are in classCache. This methods should
-// be called when an instance of *Env gets out of scope
+// DeleteGlobalRefCache does nothing. The class cache is shared by all Envs of the JVM, so an Env
+// has no cache of its own to delete, the shared cache is deleted by JVM.Destroy.
+//
+// Deprecated: The class cache no longer needs to be deleted when an Env is no longer used.
 func (j *Env) DeleteGlobalRefCache() {
-	for _, v := range j.classCache {
-		deleteGlobalRef(j.jniEnv, jobject(v))
-	}
-	j.classCache = make(map[string]jclass)
 }
 
 // StackTraceElement is a struct holding the contents of java.lang.StackTraceElement
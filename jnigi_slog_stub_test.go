@@ -0,0 +1,10 @@
+//go:build !go1.21
+// +build !go1.21
+
+package jnigi
+
+import "testing"
+
+func PTestSlogBridge(t *testing.T) {
+	t.Log("log/slog requires go1.21, skipping")
+}
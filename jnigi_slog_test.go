@@ -0,0 +1,137 @@
+//go:build go1.21
+// +build go1.21
+
+package jnigi
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordHandler is a slog.Handler that keeps the records it handles.
+type recordHandler struct {
+	mu      sync.Mutex
+	level   slog.Level
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func (h *recordHandler) get() []slog.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]slog.Record(nil), h.records...)
+}
+
+func recordAttrs(r slog.Record) map[string]slog.Value {
+	attrs := make(map[string]slog.Value)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	return attrs
+}
+
+func PTestSlogBridge(t *testing.T) {
+	h := &recordHandler{level: slog.LevelInfo}
+	bridge, err := env.InstallSlogBridge(SlogBridge{Logger: slog.New(h), JavaLogger: "jnigi.test", ReplaceHandlers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, err := env.javaLogger("jnigi.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(logger)
+	level := func(name string) *ObjectRef {
+		l := NewObjectRef("java/util/logging/Level")
+		if err := env.GetStaticField("java/util/logging/Level", name, l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	param := fromGoStr(t, "x")
+	env.PrecalculateSignature("(Ljava/util/logging/Level;Ljava/lang/String;Ljava/lang/Object;)V")
+	if err := logger.CallMethod(env, "log", nil, level("WARNING"), fromGoStr(t, "hello {0}"), param); err != nil {
+		t.Fatal(err)
+	}
+	if records := h.get(); assert.Len(t, records, 1) {
+		assert.Equal(t, slog.LevelWarn, records[0].Level)
+		assert.Equal(t, "hello x", records[0].Message)
+		attrs := recordAttrs(records[0])
+		assert.Equal(t, "jnigi.test", attrs["logger"].String())
+		assert.Equal(t, []string{"x"}, attrs["params"].Any())
+	}
+
+	exc, err := env.NewObject("java/lang/Exception", fromGoStr(t, "boom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(exc)
+	env.PrecalculateSignature("(Ljava/util/logging/Level;Ljava/lang/String;Ljava/lang/Throwable;)V")
+	if err := logger.CallMethod(env, "log", nil, level("SEVERE"), fromGoStr(t, "failed"), exc); err != nil {
+		t.Fatal(err)
+	}
+	if records := h.get(); assert.Len(t, records, 2) {
+		assert.Equal(t, slog.LevelError, records[1].Level)
+		throwableErr, ok := recordAttrs(records[1])["error"].Any().(*ThrowableError)
+		if assert.True(t, ok) {
+			assert.Equal(t, "java.lang.Exception", throwableErr.ClassName)
+			assert.Equal(t, "boom", throwableErr.Message)
+		}
+	}
+
+	// the Java level follows the slog level
+	var loggable bool
+	env.PrecalculateSignature("(Ljava/util/logging/Level;)Z")
+	if err := logger.CallMethod(env, "isLoggable", &loggable, level("FINE")); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, loggable)
+	if err := env.SetJavaLogLevel("jnigi.test", slog.LevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	env.PrecalculateSignature("(Ljava/util/logging/Level;)Z")
+	if err := logger.CallMethod(env, "isLoggable", &loggable, level("FINE")); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, loggable)
+	configuredLoggersMu.Lock()
+	assert.Contains(t, configuredLoggers, "jnigi.test")
+	configuredLoggersMu.Unlock()
+
+	// records are no longer passed to the slog handler once the bridge is uninstalled
+	if err := bridge.Uninstall(env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, bridge.Uninstall(env))
+	env.PrecalculateSignature("(Ljava/util/logging/Level;Ljava/lang/String;)V")
+	if err := logger.CallMethod(env, "log", nil, level("WARNING"), fromGoStr(t, "after")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, h.get(), 2)
+	slogBridges.mu.Lock()
+	assert.Empty(t, slogBridges.bridges)
+	slogBridges.mu.Unlock()
+
+	assert.Equal(t, slog.LevelDebug, SlogLevel(700))
+	assert.Equal(t, "WARNING", JavaLogLevel(slog.LevelWarn+1))
+}
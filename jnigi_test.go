@@ -5,12 +5,22 @@
 package jnigi
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,19 +32,45 @@ var jvm *JVM
 func TestAll(t *testing.T) {
 	PTestInit(t)
 	PTestBasic(t)
+	PTestVersion(t)
+	PTestJVMConfig(t)
+	PTestJVMHooks(t)
+	PTestFindJDKs(t)
+	PTestGetCreatedJVMs(t)
 	PTestTypes(t)
 	PTestObjectArrays(t)
 	PTestConvert(t)
 	PTestInstanceOf(t)
 	PTestByteArray(t)
 	PTestAttach(t)
+	PTestSharedClassCache(t)
+	PTestPool(t)
+	PTestAttachOptions(t)
+	PTestRefDebug(t)
+	PTestWeakGlobalRef(t)
+	PTestManagedRef(t)
+	PTestStats(t)
+	PTestMonitor(t)
 	PTestGetJVM(t)
 	PTestEnsureLocalCapacity(t)
 	PTestPushPopLocalFrame(t)
+	PTestWithLocalFrame(t)
 	PTestHandleException(t)
 	PTestCast(t)
 	PTestNonVirtual(t)
 	PTestRegisterNative(t)
+	PTestPreparedHandles(t)
+	PTestClass(t)
+	PTestDescribeClass(t)
+	PTestModule(t)
+	PTestReflected(t)
+	PTestDefineClass(t)
+	PTestJarClassLoader(t)
+	PTestRedirectStdio(t)
+	PTestSlogBridge(t)
+	PTestHelperClassRetry(t)
+	PTestClassLoaders(t)
+	PTestIsolatedClassLoaders(t)
 	PTestDeleteGlobalRefCache(t)
 	PTestDestroy(t)
 }
@@ -48,7 +84,7 @@ func PTestInit(t *testing.T) {
 	}
 	runtime.LockOSThread()
 	cwd, _ := os.Getwd()
-	jvm2, e2, err := CreateJVM(NewJVMInitArgs(false, true, DEFAULT_VERSION, []string{"-Xcheck:jni", "-Djava.class.path=" + filepath.Join(cwd, "java/test/out")}))
+	jvm2, e2, err := CreateJVM(NewJVMInitArgs(false, true, NEGOTIATE_VERSION, []string{"-Xcheck:jni", "-Djava.class.path=" + filepath.Join(cwd, "java/test/out")}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,6 +94,278 @@ func PTestInit(t *testing.T) {
 	t.Logf("%x", e2.jniEnv)
 }
 
+func PTestVersion(t *testing.T) {
+	assert.Equal(t, "1.6", VersionString(JNI_VERSION_1_6))
+	assert.Equal(t, "21", VersionString(JNI_VERSION_21))
+
+	// the JVM was created with NEGOTIATE_VERSION
+	version := env.Version()
+	t.Logf("JNI version %s", VersionString(version))
+	assert.True(t, version >= JNI_VERSION_1_8)
+	assert.Equal(t, haveGetModule && version >= JNI_VERSION_9, env.Supports(FeatureGetModule))
+
+	threadRef := NewObjectRef("java/lang/Thread")
+	if err := env.CallStaticMethod("java/lang/Thread", "currentThread", threadRef); err != nil {
+		t.Fatal(err)
+	}
+	virtual, err := env.IsVirtualThread(threadRef)
+	if env.Supports(FeatureIsVirtualThread) {
+		assert.Nil(t, err)
+		assert.False(t, virtual)
+	} else {
+		assert.Equal(t, ErrUnsupported, err)
+	}
+	env.DeleteLocalRef(threadRef)
+}
+
+func PTestJVMConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jnigi-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a.jar names b.jar and lib/c d.jar in its manifest, they are added after it
+	manifest := "Manifest-Version: 1.0\r\nClass-Path: b.jar lib/c%20d\r\n .jar\r\n\r\n"
+	write := func(name string, data []byte) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("jars/a.jar", makeJar(t, map[string][]byte{"META-INF/MANIFEST.MF": []byte(manifest)}))
+	write("jars/z.jar", makeJar(t, map[string][]byte{}))
+	write("jars/notes.txt", nil)
+	write("args", []byte("# comment\n-Da=1 \"-Db=two words\"\n'-Dc=x\\\n    y'\n"))
+
+	sep := string(os.PathListSeparator)
+	jars := filepath.Join(dir, "jars")
+	config := NewJVMConfig().
+		Classpath(filepath.Join(dir, "jars")+string(os.PathSeparator)+"*", "classes").
+		MaxHeap(512<<20).
+		SystemProperty("file.encoding", "UTF-8").
+		CheckJNI(true).
+		Verbose("gc").
+		Option("@"+filepath.Join(dir, "args"), "@@notafile", "-Xss1m")
+	options, err := config.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"-Xmx512m",
+		"-Dfile.encoding=UTF-8",
+		"-Xcheck:jni",
+		"-verbose:gc",
+		"-Da=1",
+		"-Db=two words",
+		"-Dc=xy",
+		"@notafile",
+		"-Xss1m",
+		"-Djava.class.path=" + strings.Join([]string{
+			filepath.Join(jars, "a.jar"),
+			filepath.Join(jars, "b.jar"),
+			filepath.Join(jars, "lib", "c d.jar"),
+			filepath.Join(jars, "z.jar"),
+			"classes",
+		}, sep),
+	}, options)
+
+	// the options PTestInit passes to NewJVMInitArgs
+	cwd, _ := os.Getwd()
+	classes := filepath.Join(cwd, "java/test/out")
+	options, err = NewJVMConfig().Version(NEGOTIATE_VERSION).CheckJNI(true).Classpath(classes).Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"-Xcheck:jni", "-Djava.class.path=" + classes}, options)
+
+	// the C memory is freed by Free, or by CreateJVM
+	start := env.Stats().CAllocs
+	args, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, options, args.options())
+	args.Free()
+	assert.Equal(t, start, env.Stats().CAllocs)
+
+	// JDK_JAVA_OPTIONS is read before the other options
+	os.Setenv("JDK_JAVA_OPTIONS", "-Denv='from env'")
+	defer os.Unsetenv("JDK_JAVA_OPTIONS")
+	options, err = NewJVMConfig().EnvironmentOptions(true).Option("-Xss1m").Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"-Denv=from env", "-Xss1m"}, options)
+
+	// mistakes are returned by Build
+	_, err = NewJVMConfig().
+		MaxHeap(-1).
+		SystemProperty("a=b", "c").
+		Verbose("everything").
+		Classpath("a" + sep + "b").
+		Option("@" + filepath.Join(dir, "missing")).
+		Build()
+	if assert.NotNil(t, err) {
+		for _, s := range []string{"max heap", "a=b", "everything", "class path entry", "missing"} {
+			assert.Contains(t, err.Error(), s)
+		}
+	}
+}
+
+func PTestJVMHooks(t *testing.T) {
+	args, err := NewJVMConfig().
+		Option("-Xss1m").
+		Output(ioutil.Discard).
+		OnExit(func(code int) {}).
+		OnAbort(func() {}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"-Xss1m", "vfprintf", "exit", "abort"}, args.options())
+	args.Free()
+}
+
+func PTestFindJDKs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jnigi-jdks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lib := filepath.Join("lib", "server", "libjvm.so")
+	if runtime.GOOS == "windows" {
+		lib = filepath.Join("bin", "server", "jvm.dll")
+	} else if runtime.GOOS == "darwin" {
+		lib = filepath.Join("lib", "server", "libjvm.dylib")
+	}
+	makeJDK := func(home, release string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(home, lib)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(home, lib), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(home, "release"), []byte(release), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	javaHome := filepath.Join(dir, "jdk8")
+	makeJDK(javaHome, "JAVA_VERSION=\"1.8.0_292\"\nIMPLEMENTOR=\"Test Vendor\"\nOS_ARCH=\"amd64\"\n")
+	sdkmanJDK := filepath.Join(dir, "sdkman", "candidates", "java", "99.0.1-test")
+	makeJDK(sdkmanJDK, "JAVA_VERSION=\"99.0.1\"\nIMPLEMENTOR=\"Test Vendor\"\nIMPLEMENTOR_VERSION=\"Testium-99.0.1+1\"\n")
+	// the current version symlink is the same runtime
+	os.Symlink(sdkmanJDK, filepath.Join(dir, "sdkman", "candidates", "java", "current"))
+
+	for name, value := range map[string]string{"JAVA_HOME": javaHome, "SDKMAN_DIR": filepath.Join(dir, "sdkman")} {
+		orig, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if set {
+			defer os.Setenv(name, orig)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	jdks := FindJDKs()
+	if assert.NotEmpty(t, jdks) {
+		assert.Equal(t, JDK{
+			Home:    javaHome,
+			LibPath: filepath.Join(javaHome, lib),
+			Source:  "JAVA_HOME",
+			Version: "1.8.0_292",
+			Vendor:  "Test Vendor",
+			Arch:    "amd64",
+		}, jdks[0])
+		assert.Equal(t, 8, jdks[0].MajorVersion())
+	}
+	var sdkman []string
+	for _, jdk := range jdks {
+		if jdk.Source == "SDKMAN" {
+			sdkman = append(sdkman, jdk.Home)
+		}
+	}
+	assert.Equal(t, []string{sdkmanJDK}, sdkman)
+
+	jdk, err := FindJDK(JDKFilter{MinVersion: 99, Vendor: "test vendor"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, sdkmanJDK, jdk.Home)
+		assert.Equal(t, 99, jdk.MajorVersion())
+	}
+	jdk, err = FindJDK(JDKFilter{Vendor: "testium"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, sdkmanJDK, jdk.Home)
+		assert.Equal(t, "Testium-99.0.1+1", jdk.VendorVersion)
+	}
+
+	_, err = FindJDK(JDKFilter{MinVersion: 1000})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "version >= 1000")
+		assert.Contains(t, err.Error(), "JAVA_HOME="+javaHome)
+		assert.Contains(t, err.Error(), "version 99.0.1")
+	}
+
+	// the java command of a JDK 8 is in jre/bin, the JDK with its release file is used
+	jreLib := filepath.Join("jre", "lib", "amd64", "server", "libjvm.so")
+	if runtime.GOOS == "windows" {
+		jreLib = filepath.Join("jre", "bin", "server", "jvm.dll")
+	} else if runtime.GOOS == "darwin" {
+		jreLib = filepath.Join("jre", "lib", "server", "libjvm.dylib")
+	}
+	jdk8 := filepath.Join(dir, "path-jdk8")
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(jdk8, jreLib)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(jdk8, jreLib), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(jdk8, "release"), []byte("JAVA_VERSION=\"1.8.0_392\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &jdkSearch{seen: make(map[string]bool)}
+	s.searchDir("PATH", filepath.Join(jdk8, "jre"))
+	if assert.Len(t, s.jdks, 1) {
+		assert.Equal(t, jdk8, s.jdks[0].Home)
+		assert.Equal(t, filepath.Join(jdk8, jreLib), s.jdks[0].LibPath)
+		assert.Equal(t, 8, s.jdks[0].MajorVersion())
+	}
+
+	// a runtime found again is reported but not counted
+	s.searchDir("JAVA_HOME", jdk8)
+	s.searchDirs("system", "dirs", []string{jdk8, filepath.Join(dir, "none")})
+	assert.Len(t, s.jdks, 1)
+	assert.Equal(t, []string{
+		"PATH=" + filepath.Join(jdk8, "jre"),
+		"JAVA_HOME=" + jdk8 + " (already found)",
+		"system=dirs (0 found)",
+	}, s.searched)
+}
+
+func PTestGetCreatedJVMs(t *testing.T) {
+	jvms, err := GetCreatedJVMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, jvms, 1) {
+		assert.Equal(t, jvm.javaVM, jvms[0].javaVM)
+		e, err := jvms[0].GetEnv()
+		if assert.Nil(t, err) {
+			assert.Equal(t, env.jniEnv, e.jniEnv)
+		}
+	}
+
+	// only one JVM can be created
+	args, err := NewJVMConfig().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = CreateJVM(args)
+	assert.Equal(t, ErrJVMExists, err)
+}
+
 func PTestBasic(t *testing.T) {
 	// new object, int method
 	obj, err := env.NewObject("java/lang/Object")
@@ -174,459 +482,2124 @@ func PTestBasic(t *testing.T) {
 	}
 }
 
-func PTestAttach(t *testing.T) {
-	x := make(chan byte)
-
-	obj, err := env.NewObject("java/lang/Object")
+func PTestSharedClassCache(t *testing.T) {
+	class, err := env.GetClass("java/lang/StringBuilder")
 	if err != nil {
 		t.Fatal(err)
 	}
-	gObj := env.NewGlobalRef(obj)
 
-	go func() {
-		runtime.LockOSThread()
-		nenv := jvm.AttachCurrentThread()
-		t.Logf("%x", nenv.jniEnv)
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			nenv := jvm.AttachCurrentThread()
+			defer jvm.DetachCurrentThread(nenv)
 
-		var v int
-		if err := gObj.CallMethod(nenv, "hashCode", &v); err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%d", v)
-		if err := jvm.DetachCurrentThread(nenv); err != nil {
+			other, err := nenv.GetClass("java/lang/StringBuilder")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if other.class != class.class {
+				errs <- errors.New("class not shared between Envs")
+				return
+			}
+			obj, err := other.NewInstance(nenv)
+			if err != nil {
+				errs <- err
+				return
+			}
+			nenv.DeleteLocalRef(obj)
+			errs <- nil
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
 			t.Fatal(err)
 		}
-		runtime.UnlockOSThread()
-
-		x <- 4
-	}()
-
-	<-x
-	env.DeleteGlobalRef(gObj)
-	env.DeleteLocalRef(obj)
+	}
 }
 
-func PTestObjectArrays(t *testing.T) {
-	var subject = "splitXme"
-	str, err := env.NewObject("java/lang/String", []byte(subject))
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer env.DeleteLocalRef(str)
-	regex, err := env.NewObject("java/lang/String", []byte("X"))
+func PTestPool(t *testing.T) {
+	pool, err := jvm.NewPool(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(regex)
 
-	v := NewObjectArrayRef("java/lang/String")
-	if err := str.CallMethod(env, "split", v, regex); err != nil {
-		t.Fatal(err)
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- pool.Do(context.Background(), func(env *Env) error {
+				str, err := env.NewObject("java/lang/String", []byte(strconv.Itoa(i)))
+				if err != nil {
+					return err
+				}
+				var v int
+				if err := str.CallMethod(env, "length", &v); err != nil {
+					return err
+				}
+				if v != len(strconv.Itoa(i)) {
+					return errors.New("wrong length")
+				}
+				return nil
+			})
+		}(i)
 	}
-
-	parts := env.FromObjectArray(v)
-	var got []string
-	for _, p := range parts {
-		var part []byte
-		if err := p.CallMethod(env, "getBytes", &part); err != nil {
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
 			t.Fatal(err)
 		}
-		got = append(got, string(part))
 	}
-	if !assert.Equal(t, subject, strings.Join(got, "X")) {
-		t.Fail()
+	assert.Equal(t, uint64(n), pool.Stats().Completed)
+
+	// block both threads, Do then waits until the context is done
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go pool.Do(context.Background(), func(env *Env) error {
+			<-release
+			return nil
+		})
+	}
+	for pool.Stats().Running != 2 {
+		runtime.Gosched()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = pool.Do(ctx, func(env *Env) error { return nil })
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, pool.Stats().Queued)
+	close(release)
+
+	func() {
+		defer func() {
+			pnc, ok := recover().(*PoolPanic)
+			if !assert.True(t, ok) {
+				return
+			}
+			assert.Equal(t, "in pool", pnc.Value)
+			assert.Contains(t, string(pnc.Stack), "PTestPool")
+		}()
+		pool.Do(context.Background(), func(env *Env) error { panic("in pool") })
+	}()
+
+	// an exception left pending by the function is returned as its error
+	err = pool.Do(context.Background(), func(env *Env) error {
+		env.ExceptionHandler = ThrowableToStringExceptionHandler
+		throwStdioException(env.jniEnv, "java/lang/IllegalStateException", "left pending")
+		return nil
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "left pending")
 	}
+	err = pool.Do(context.Background(), func(env *Env) error {
+		_, err := env.NewObject("java/lang/NoSuchClass")
+		return err
+	})
+	assert.NotNil(t, err)
 
-	array := env.ToObjectArray(parts, "java/lang/String")
+	pool.Close()
+	assert.Equal(t, ErrPoolClosed, pool.Do(context.Background(), func(env *Env) error { return nil }))
 
-	class := NewObjectRef("java/lang/Class")
-	if err := array.CallMethod(env, "getClass", class); err != nil {
-		t.Fatal(err)
-	}
-	defer env.DeleteLocalRef(class)
-	jClassName := NewObjectRef("java/lang/String")
-	if err := class.CallMethod(env, "getName", jClassName); err != nil {
+	var v int
+	err = jvm.Do(context.Background(), func(env *Env) error {
+		return env.CallStaticMethod("java/lang/Math", "abs", &v, -3)
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(jClassName)
-	var className []byte
-	if err := jClassName.CallMethod(env, "getBytes", &className); err != nil {
+	assert.Equal(t, 3, v)
+}
+
+func PTestAttachOptions(t *testing.T) {
+	mainEnv, err := jvm.GetEnv()
+	if err != nil {
 		t.Fatal(err)
 	}
-	if !assert.Equal(t, "[Ljava.lang.String;", string(className)) {
-		t.Fail()
-	}
-}
+	assert.Equal(t, env.jniEnv, mainEnv.jniEnv)
 
-type GoString string
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		errs <- func() error {
+			if _, err := jvm.GetEnv(); err != ErrDetached {
+				return fmt.Errorf("expected ErrDetached, got %v", err)
+			}
 
-func (g *GoString) ConvertToGo(obj *ObjectRef) error {
-	defer env.DeleteLocalRef(obj)
-	var goBytes []byte
-	if err := obj.CallMethod(env, "getBytes", &goBytes); err != nil {
-		return err
-	}
-	*g = GoString(goBytes)
-	return nil
-}
+			nenv, detach, err := jvm.AttachIfNeeded("jnigi-test", nil, true)
+			if err != nil {
+				return err
+			}
+			thread := NewObjectRef("java/lang/Thread")
+			if err := nenv.CallStaticMethod("java/lang/Thread", "currentThread", thread); err != nil {
+				return err
+			}
+			nameStr := NewObjectRef("java/lang/String")
+			if err := thread.CallMethod(nenv, "getName", nameStr); err != nil {
+				return err
+			}
+			var name []byte
+			if err := nameStr.CallMethod(nenv, "getBytes", &name); err != nil {
+				return err
+			}
+			var daemon bool
+			if err := thread.CallMethod(nenv, "isDaemon", &daemon); err != nil {
+				return err
+			}
+			if string(name) != "jnigi-test" || !daemon {
+				return fmt.Errorf("thread %s daemon %v", name, daemon)
+			}
 
-func (g *GoString) ConvertToJava() (obj *ObjectRef, err error) {
-	return env.NewObject("java/lang/String", []byte(string(*g)))
-}
+			// already attached, the inner detach does nothing
+			_, innerDetach, err := jvm.AttachIfNeeded("other", nil, false)
+			if err != nil {
+				return err
+			}
+			if err := innerDetach(); err != nil {
+				return err
+			}
+			if _, err := jvm.GetEnv(); err != nil {
+				return err
+			}
 
-func (g *GoString) GetClassName() string {
-	return "java/lang/String"
+			if err := detach(); err != nil {
+				return err
+			}
+			if _, err := jvm.GetEnv(); err != ErrDetached {
+				return fmt.Errorf("expected ErrDetached after detach, got %v", err)
+			}
+			return nil
+		}()
+	}()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
 }
 
-func (g *GoString) IsArray() bool {
-	return false
-}
+func PTestRefDebug(t *testing.T) {
+	var reported []error
+	SetRefDebug(true, func(err error) {
+		reported = append(reported, err)
+	})
+	defer SetRefDebug(false, nil)
 
-func PTestConvert(t *testing.T) {
-	var testString GoString = "test string"
-	str, err := env.NewObject("java/lang/String", &testString)
+	obj, err := env.NewObject("java/lang/Object")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(str)
+	assert.Equal(t, LocalRefType, obj.RefType())
+	assert.Equal(t, env, obj.Env())
+	assert.Equal(t, LocalRefType, env.GetObjectRefType(obj))
+
+	global := env.NewGlobalRef(obj)
+	assert.Equal(t, GlobalRefType, global.RefType())
+	assert.Nil(t, global.Env())
+	assert.Equal(t, GlobalRefType, env.GetObjectRefType(global))
+
+	// wrong kind delete is reported and not done
+	env.DeleteLocalRef(global.Cast("java/lang/Object"))
+	if assert.Len(t, reported, 1) {
+		refErr, ok := reported[0].(*RefError)
+		if assert.True(t, ok) {
+			assert.Equal(t, GlobalRefType, refErr.Kind)
+			assert.Contains(t, refErr.Stack, "PTestRefDebug")
+		}
+	}
 
-	var firstWord GoString
-	if err := str.CallMethod(env, "substring", &firstWord, 0, 4); err != nil {
+	// double delete
+	copied := *global
+	env.DeleteGlobalRef(global)
+	env.DeleteGlobalRef(&copied)
+	assert.Len(t, reported, 2)
+	var v int
+	_, ok := copied.CallMethod(env, "hashCode", &v).(*RefError)
+	assert.True(t, ok)
+
+	// stale local reference
+	if err := env.PushLocalFrame(4); err != nil {
 		t.Fatal(err)
 	}
-	if !assert.Equal(t, GoString("test"), firstWord) {
-		t.Fail()
-	}
-}
-
-func PTestInstanceOf(t *testing.T) {
-	alist, err := env.NewObject("java/util/ArrayList")
+	inner, err := env.NewObject("java/lang/Object")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(alist)
-
-	str, err := env.NewObject("java/lang/String")
+	env.PopLocalFrame(nil)
+	_, ok = inner.CallMethod(env, "hashCode", &v).(*RefError)
+	assert.True(t, ok)
+	_, ok = env.CallStaticMethod("java/util/Objects", "hashCode", &v, inner).(*RefError)
+	assert.True(t, ok)
+	hashCode, err := env.GetMethod("java/lang/Object", "hashCode", "()I")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(str)
-
-	var dummy bool
-	if err := alist.CallMethod(env, "add", &dummy, str.Cast("java/lang/Object")); err != nil {
+	_, ok = hashCode.Call(env, inner, &v).(*RefError)
+	assert.True(t, ok)
+	hashCode.Release(env)
+	_, err = env.GetObjectClass(inner)
+	_, ok = err.(*RefError)
+	assert.True(t, ok)
+	objectClass, err := env.GetClass("java/lang/Object")
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	obj := NewObjectRef("java/lang/Object")
-	if err := alist.CallMethod(env, "get", obj, 0); err != nil {
+	assert.False(t, objectClass.IsInstance(env, inner))
+	assert.Len(t, reported, 3)
+	reported = reported[:2]
+	holder, err := env.NewObject("java/util/concurrent/atomic/AtomicReference")
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(obj)
+	_, ok = holder.SetField(env, "value", inner).(*RefError)
+	assert.True(t, ok)
+	env.DeleteLocalRef(holder)
 
-	if isInstance, err := obj.IsInstanceOf(env, "java/lang/String"); err != nil {
-		t.Fatal(err)
-	} else if !isInstance {
-		t.Error("InstanceOf test failed")
-	}
+	// local reference used on another thread
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		nenv := jvm.AttachCurrentThread()
+		defer jvm.DetachCurrentThread(nenv)
+		errs <- obj.CallMethod(nenv, "hashCode", &v)
+	}()
+	_, ok = (<-errs).(*RefError)
+	assert.True(t, ok)
+
+	assert.Nil(t, obj.CallMethod(env, "hashCode", &v))
+	env.DeleteLocalRef(obj)
+	assert.Len(t, reported, 2)
 }
 
-func PTestByteArray(t *testing.T) {
-	ba := env.NewByteArray(5)
-	bytes := ba.GetCritical(env)
-	copy(bytes, []byte("hello"))
-	ba.ReleaseCritical(env, bytes)
-	str, err := env.NewObject("java/lang/String", ba)
+func PTestWeakGlobalRef(t *testing.T) {
+	obj, err := env.NewObject("java/lang/Object")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !assert.Equal(t, "hello", toGoStr(t, str)) {
-		t.Fail()
-	}
-	env.DeleteLocalRef(str)
+	weak := env.NewWeakGlobalRef(obj)
+	assert.Equal(t, WeakGlobalRefType, weak.RefType())
+	assert.Equal(t, WeakGlobalRefType, env.GetObjectRefType(weak))
+	assert.False(t, weak.IsNil())
 
-	testStr := "hello world"
-	str, err = env.NewObject("java/lang/String", []byte(testStr))
-	if err != nil {
+	var want, got int
+	if err := obj.CallMethod(env, "hashCode", &want); err != nil {
+		t.Fatal(err)
+	}
+	local, ok := weak.Upgrade(env)
+	if assert.True(t, ok) {
+		assert.Equal(t, LocalRefType, local.RefType())
+		if err := local.CallMethod(env, "hashCode", &got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+		env.DeleteLocalRef(local)
+	}
+	global, ok := weak.UpgradeGlobal(env)
+	if assert.True(t, ok) {
+		assert.Equal(t, GlobalRefType, global.RefType())
+		env.DeleteGlobalRef(global)
+	}
+
+	// once the object is collected the weak reference is Nil and can not be upgraded
+	env.DeleteLocalRef(obj)
+	for i := 0; i < 50 && !weak.IsNil(); i++ {
+		if err := env.CallStaticMethod("java/lang/System", "gc", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.True(t, weak.IsNil())
+	_, ok = weak.Upgrade(env)
+	assert.False(t, ok)
+	env.DeleteGlobalRef(weak)
+	assert.True(t, weak.IsNil())
+
+	obj, err = env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak = env.NewWeakGlobalRef(obj)
+	env.DeleteLocalRef(weak)
+	assert.True(t, weak.IsNil())
+	env.DeleteLocalRef(obj)
+}
+
+func PTestManagedRef(t *testing.T) {
+	newManaged := func() *ManagedRef {
+		obj, err := env.NewObject("java/lang/Object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer env.DeleteLocalRef(obj)
+		m, err := env.NewManagedRef(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := newManaged()
+	assert.Equal(t, GlobalRefType, m.Ref().RefType())
+	var v int
+	if err := m.Ref().CallMethod(env, "hashCode", &v); err != nil {
+		t.Fatal(err)
+	}
+	start := jvm.ManagedRefStats()
+	m.Release(env)
+	assert.True(t, m.Ref().IsNil())
+	stats := jvm.ManagedRefStats()
+	assert.Equal(t, start.Released+1, stats.Released)
+	assert.Equal(t, start.Live-1, stats.Live)
+
+	// unreachable managed references are deleted by the jnigi-ref-cleaner thread
+	for i := 0; i < 10; i++ {
+		newManaged()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runtime.GC()
+		stats = jvm.ManagedRefStats()
+		if stats.Released >= start.Released+11 && stats.Pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("managed references not released: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, start.Live-1, stats.Live)
+
+	// enqueue does not block when the queue is full
+	c := &refCleaner{
+		queue: make(chan jobject, 1),
+		stop:  make(chan struct{}),
+		wake:  make(chan struct{}, 1),
+	}
+	for i := 1; i <= 3; i++ {
+		c.enqueue(jobject(i))
+	}
+	assert.Equal(t, int64(3), c.pending)
+	assert.Equal(t, []jobject{2, 3}, c.overflow)
+	assert.Len(t, c.wake, 1)
+	close(c.stop)
+	c.enqueue(4)
+	assert.Equal(t, int64(3), c.pending)
+}
+
+func PTestStats(t *testing.T) {
+	start := env.Stats()
+
+	obj, err := env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := env.NewGlobalRef(obj)
+	weak := env.NewWeakGlobalRef(obj)
+	stats := env.Stats()
+	assert.Equal(t, start.LocalRefs+1, stats.LocalRefs)
+	assert.Equal(t, start.GlobalRefs+1, stats.GlobalRefs)
+	assert.Equal(t, start.WeakGlobalRefs+1, stats.WeakGlobalRefs)
+	assert.Equal(t, stats.GlobalRefs, jvm.Stats().GlobalRefs)
+
+	env.DeleteGlobalRef(weak)
+	env.DeleteGlobalRef(global)
+	env.DeleteLocalRef(obj)
+	assert.Equal(t, start, env.Stats())
+
+	// references of a popped frame are counted as deleted, the result moves to the outer frame
+	result, err := env.WithLocalFrame(8, func() (*ObjectRef, error) {
+		var last *ObjectRef
+		for i := 0; i < 3; i++ {
+			if last, err = env.NewObject("java/lang/Object"); err != nil {
+				return nil, err
+			}
+		}
+		assert.Equal(t, start.LocalRefs+3, env.Stats().LocalRefs)
+		return last, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, start.LocalRefs+1, env.Stats().LocalRefs)
+	env.DeleteLocalRef(result)
+
+	// a reference of a popped frame is not counted against a later frame at the same depth
+	var stale *ObjectRef
+	for i := 0; i < 2; i++ {
+		if err := env.PushLocalFrame(4); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := env.NewObject("java/lang/Object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale == nil {
+			stale = obj
+			env.PopLocalFrame(nil)
+			continue
+		}
+		env.untrackLocal(stale)
+		assert.Equal(t, start.LocalRefs+1, env.Stats().LocalRefs)
+		env.PopLocalFrame(nil)
+	}
+	assert.Equal(t, start, env.Stats())
+
+	// a reference is only untracked by the Env it was created in
+	obj, err = env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	WrapEnv(env.jniEnv).untrackLocal(obj)
+	assert.Equal(t, start.LocalRefs+1, env.Stats().LocalRefs)
+	env.DeleteLocalRef(obj)
+	assert.Equal(t, start, env.Stats())
+
+	// converted arguments and returns are not counted as leaked
+	str, err := env.NewObject("java/lang/String", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := GoString("def")
+	var ret GoString
+	if err := str.CallMethod(env, "concat", &ret, &arg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, GoString("abcdef"), ret)
+	env.DeleteLocalRef(str)
+	assert.Equal(t, start, env.Stats())
+}
+
+func PTestMonitor(t *testing.T) {
+	obj, err := env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := env.NewGlobalRef(obj)
+	env.DeleteLocalRef(obj)
+	defer env.DeleteGlobalRef(lock)
+
+	// exiting a monitor that is not held is an IllegalMonitorStateException
+	assert.NotNil(t, env.MonitorExit(lock))
+
+	// waiting with a timeout returns once the timeout has passed
+	err = env.Synchronized(lock, func() error {
+		start := time.Now()
+		if err := env.Wait(lock, 20*time.Millisecond); err != nil {
+			return err
+		}
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the monitor is exited when f panics
+	func() {
+		defer func() {
+			assert.Equal(t, "sync panic", recover())
+		}()
+		env.Synchronized(lock, func() error {
+			panic("sync panic")
+		})
+	}()
+
+	// a waiting thread is woken by Notify, and Synchronized is mutually exclusive
+	waiting := make(chan struct{})
+	done := make(chan error)
+	counter := 0
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		nenv := jvm.AttachCurrentThread()
+		defer jvm.DetachCurrentThread(nenv)
+		done <- nenv.Synchronized(lock, func() error {
+			close(waiting)
+			if err := nenv.Wait(lock, 0); err != nil {
+				return err
+			}
+			counter++
+			return nil
+		})
+	}()
+	<-waiting
+	err = env.Synchronized(lock, func() error {
+		counter++
+		return env.Notify(lock)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, counter)
+
+	err = env.Synchronized(lock, func() error {
+		return env.NotifyAll(lock)
+	})
+	assert.Nil(t, err)
+
+	// an Env can not be used for monitors on another OS thread, even before its first MonitorEnter
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		called := false
+		err := env.Synchronized(lock, func() error {
+			called = true
+			return nil
+		})
+		if err == nil {
+			err = errors.New("Synchronized on another thread succeeded")
+		} else if err == errMonitorThread && !called {
+			err = env.MonitorEnter(lock)
+			if err == errMonitorThread {
+				err = env.MonitorExit(lock)
+			}
+		}
+		done <- err
+	}()
+	assert.Equal(t, errMonitorThread, <-done)
+}
+
+func PTestModule(t *testing.T) {
+	assert.Equal(t, "--add-opens=java.base/java.lang=ALL-UNNAMED", AddOpensOption("java.base", "java.lang"))
+	assert.Equal(t, "--add-exports=java.base/sun.nio.ch=a,b", AddExportsOption("java.base", "sun.nio.ch", "a", "b"))
+
+	if !env.Supports(FeatureGetModule) {
+		t.Log("GetModule not supported")
+		return
+	}
+
+	stringClass, err := env.GetClass("java/lang/String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := env.GetModule(stringClass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(base.GetObject())
+	name, err := base.Name(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "java.base", name)
+
+	desc, err := base.Descriptor(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "java.base", desc.Name)
+	assert.False(t, desc.Open)
+	assert.Contains(t, desc.Packages, "java.util")
+	assert.Contains(t, desc.Exports, ModulePackage{Package: "java.lang"})
+
+	exported, err := base.IsExported(env, "java.lang", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exported)
+
+	testClass, err := env.GetClass("local/JnigiTesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unnamed, err := env.GetModule(testClass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(unnamed.GetObject())
+	named, err := unnamed.IsNamed(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, named)
+	desc, err = unnamed.Descriptor(env)
+	assert.Nil(t, err)
+	assert.Nil(t, desc)
+
+	found, err := env.FindModule("java.base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err = found.Name(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "java.base", name)
+	env.DeleteLocalRef(found.GetObject())
+	found, err = env.FindModule("no.such.module")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	// open a package at runtime
+	if err := env.AddOpens(base, "java.util.concurrent", unnamed); err != nil {
+		t.Fatal(err)
+	}
+	open, err := base.IsOpen(env, "java.util.concurrent", unnamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, open)
+	if err := env.AddReads(base, nil); err != nil {
+		t.Fatal(err)
+	}
+	reads, err := base.CanRead(env, unnamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, reads)
+}
+
+func PTestAttach(t *testing.T) {
+	x := make(chan byte)
+
+	obj, err := env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gObj := env.NewGlobalRef(obj)
+
+	go func() {
+		runtime.LockOSThread()
+		nenv := jvm.AttachCurrentThread()
+		t.Logf("%x", nenv.jniEnv)
+
+		var v int
+		if err := gObj.CallMethod(nenv, "hashCode", &v); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%d", v)
+		if err := jvm.DetachCurrentThread(nenv); err != nil {
+			t.Fatal(err)
+		}
+		runtime.UnlockOSThread()
+
+		x <- 4
+	}()
+
+	<-x
+	env.DeleteGlobalRef(gObj)
+	env.DeleteLocalRef(obj)
+}
+
+func PTestObjectArrays(t *testing.T) {
+	var subject = "splitXme"
+	str, err := env.NewObject("java/lang/String", []byte(subject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+	regex, err := env.NewObject("java/lang/String", []byte("X"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(regex)
+
+	v := NewObjectArrayRef("java/lang/String")
+	if err := str.CallMethod(env, "split", v, regex); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := env.FromObjectArray(v)
+	var got []string
+	for _, p := range parts {
+		var part []byte
+		if err := p.CallMethod(env, "getBytes", &part); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(part))
+	}
+	if !assert.Equal(t, subject, strings.Join(got, "X")) {
+		t.Fail()
+	}
+
+	array := env.ToObjectArray(parts, "java/lang/String")
+
+	class := NewObjectRef("java/lang/Class")
+	if err := array.CallMethod(env, "getClass", class); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(class)
+	jClassName := NewObjectRef("java/lang/String")
+	if err := class.CallMethod(env, "getName", jClassName); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(jClassName)
+	var className []byte
+	if err := jClassName.CallMethod(env, "getBytes", &className); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "[Ljava.lang.String;", string(className)) {
+		t.Fail()
+	}
+}
+
+type GoString string
+
+func (g *GoString) ConvertToGo(obj *ObjectRef) error {
+	defer env.DeleteLocalRef(obj)
+	var goBytes []byte
+	if err := obj.CallMethod(env, "getBytes", &goBytes); err != nil {
+		return err
+	}
+	*g = GoString(goBytes)
+	return nil
+}
+
+func (g *GoString) ConvertToJava() (obj *ObjectRef, err error) {
+	return env.NewObject("java/lang/String", []byte(string(*g)))
+}
+
+func (g *GoString) GetClassName() string {
+	return "java/lang/String"
+}
+
+func (g *GoString) IsArray() bool {
+	return false
+}
+
+func PTestConvert(t *testing.T) {
+	var testString GoString = "test string"
+	str, err := env.NewObject("java/lang/String", &testString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+
+	var firstWord GoString
+	if err := str.CallMethod(env, "substring", &firstWord, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("test"), firstWord) {
+		t.Fail()
+	}
+}
+
+func PTestInstanceOf(t *testing.T) {
+	alist, err := env.NewObject("java/util/ArrayList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(alist)
+
+	str, err := env.NewObject("java/lang/String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+
+	var dummy bool
+	if err := alist.CallMethod(env, "add", &dummy, str.Cast("java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := NewObjectRef("java/lang/Object")
+	if err := alist.CallMethod(env, "get", obj, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(obj)
+
+	if isInstance, err := obj.IsInstanceOf(env, "java/lang/String"); err != nil {
+		t.Fatal(err)
+	} else if !isInstance {
+		t.Error("InstanceOf test failed")
+	}
+}
+
+func PTestByteArray(t *testing.T) {
+	ba := env.NewByteArray(5)
+	bytes := ba.GetCritical(env)
+	copy(bytes, []byte("hello"))
+	ba.ReleaseCritical(env, bytes)
+	str, err := env.NewObject("java/lang/String", ba)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "hello", toGoStr(t, str)) {
+		t.Fail()
+	}
+	env.DeleteLocalRef(str)
+
+	testStr := "hello world"
+	str, err = env.NewObject("java/lang/String", []byte(testStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+
+	arr := NewArrayRef(Byte | Array)
+	if err := str.CallMethod(env, "getBytes", arr, env.GetUTF8String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ba2 := env.NewByteArrayFromObject(arr.ObjectRef)
+
+	bytes = ba2.CopyBytes(env)
+	if !assert.Equal(t, "hello world", string(bytes)) {
+		t.Fail()
+	}
+
+	ba3 := env.NewByteArrayFromSlice([]byte("hello world!"))
+	bytes = ba3.CopyBytes(env)
+	if !assert.Equal(t, "hello world!", string(bytes)) {
+		t.Fail()
+	}
+}
+
+func PTestGetJVM(t *testing.T) {
+	_, err := env.GetJVM()
+	if err != nil {
+		t.Fatalf("GetJavaVM failed %s", err)
+	}
+	t.Logf("Call GetJavaJVM: passed")
+}
+
+func PTestDestroy(t *testing.T) {
+	env.DeleteGlobalRefCache()
+	err := jvm.Destroy()
+	if err != nil {
+		t.Fatalf("DestroyJVM failed %s", err)
+	}
+}
+
+func PTestEnsureLocalCapacity(t *testing.T) {
+	if err := env.EnsureLocalCapacity(256); err != nil {
+		t.Fatalf("EnsureLocalCapacity failed %s", err)
+	}
+	t.Logf("Call EnsureLocalCapacity: passed")
+}
+
+// keptString is a converter that does not delete the reference it converts.
+type keptString struct {
+	obj *ObjectRef
+}
+
+func (k *keptString) ConvertToGo(obj *ObjectRef) error {
+	k.obj = obj
+	return nil
+}
+
+func (k *keptString) GetClassName() string {
+	return "java/lang/String"
+}
+
+func (k *keptString) IsArray() bool {
+	return false
+}
+
+func PTestWithLocalFrame(t *testing.T) {
+	var objs []*ObjectRef
+	result, err := env.WithLocalFrame(16, func() (*ObjectRef, error) {
+		for i := 0; i < 100; i++ {
+			obj, err := env.NewObject("java/lang/StringBuilder")
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		return objs[50], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dummy int
+	if err := result.CallMethod(env, "hashCode", &dummy); err != nil {
+		t.Fatal(err)
+	}
+	env.DeleteLocalRef(result)
+
+	// the frame is popped on panic, so its references are stale
+	SetRefDebug(true, nil)
+	var inner *ObjectRef
+	func() {
+		defer func() {
+			assert.Equal(t, "in frame", recover())
+		}()
+		env.WithLocalFrame(4, func() (*ObjectRef, error) {
+			inner, _ = env.NewObject("java/lang/Object")
+			panic("in frame")
+		})
+	}()
+	_, ok := inner.CallMethod(env, "hashCode", &dummy).(*RefError)
+	assert.True(t, ok)
+	SetRefDebug(false, nil)
+
+	_, err = env.WithLocalFrame(4, func() (*ObjectRef, error) {
+		return nil, errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+
+	// converted return values are deleted
+	str, err := env.NewObject("java/lang/String", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+	env.SetAutoDeleteConverted(true)
+	defer env.SetAutoDeleteConverted(false)
+	var kept keptString
+	if err := str.CallMethod(env, "toString", &kept); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, kept.obj.IsNil())
+	arr := NewArrayRef(Byte | Array)
+	if err := str.CallMethod(env, "getBytes", arr); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, arr.IsNil())
+	env.DeleteLocalRef(arr.ObjectRef)
+}
+
+func PTestPushPopLocalFrame(t *testing.T) {
+	if err := env.PushLocalFrame(64); err != nil {
+		t.Fatalf("PushLocalFrame failed %s", err)
+	}
+	t.Logf("Call PushLocalFrame: passed")
+
+	obj, err := env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dummy int
+	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop local frame with obj reference; obj should now be in previous frame
+	obj = env.PopLocalFrame(obj)
+	t.Logf("Call PopLocalFrame: passed")
+
+	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
+		t.Fatalf("hashCode after PopLocalFrame failed %s", err)
+	}
+
+	env.DeleteLocalRef(obj)
+
+	// Now do again with nil argument to pop
+	if err := env.PushLocalFrame(32); err != nil {
+		t.Fatalf("PushLocalFrame failed %s", err)
+	}
+	t.Logf("Call PushLocalFrame: passed")
+
+	obj, err = env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pop local frame with nil
+	obj = env.PopLocalFrame(nil)
+	t.Logf("Call PopLocalFrame: passed")
+
+	if !obj.IsNil() {
+		t.Fatal("PopLocalFrame return value is not nil")
+	}
+}
+
+func runWithStderrRedir(f func() error) error {
+	// redirect standard err
+	stdErrFd := int(os.Stderr.Fd())
+	newFd, err := syscall.Dup(stdErrFd)
+	if err != nil {
+		return err
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 000)
+	if err != nil {
+		return err
+	}
+	syscall.Dup2(int(devNull.Fd()), stdErrFd)
+	err = f()
+	syscall.Dup2(newFd, stdErrFd)
+
+	return err
+}
+
+func newObjWithStderrRedir(class string) error {
+	err := runWithStderrRedir(func() error {
+		_, err := env.NewObject(class)
+		return err
+	})
+	return err
+}
+
+func PTestHandleException(t *testing.T) {
+	jexceptErrMsg := "Java exception occurred. check stderr/logcat"
+	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
+		t.Fatal("did not return error")
+	} else if !assert.Equal(t, jexceptErrMsg, err.Error()) {
+		t.Fatal("did not return standard error")
+	}
+
+	env.ExceptionHandler = ThrowableToStringExceptionHandler
+	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
+		t.Fatal("did not return error")
+	} else if !assert.Equal(t, "java.lang.NoClassDefFoundError: java/foo/bar", err.Error()) {
+		t.Fatal("did not return standard error")
+	}
+
+	env.ExceptionHandler = ThrowableErrorExceptionHandler
+	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
+		t.Fatal("did not return error")
+	} else {
+		throwableError, ok := err.(ThrowableError)
+		if !ok {
+			t.Fatalf("expected ThrowableError, but got %T", err)
+		}
+
+		// get the cause stack trace, then set this to nil so rest of structure can be tested
+		var causeST []StackTraceElement
+		if v := throwableError.Cause; v != nil {
+			causeST = v.StackTrace
+			throwableError.Cause.StackTrace = nil
+		}
+
+		want := ThrowableError{
+			ClassName:        "java.lang.NoClassDefFoundError",
+			LocalizedMessage: "java/foo/bar",
+			Message:          "java/foo/bar",
+			StackTrace:       []StackTraceElement{},
+			AsString:         "java.lang.NoClassDefFoundError: java/foo/bar",
+			Cause: &ThrowableError{
+				ClassName:        "java.lang.ClassNotFoundException",
+				LocalizedMessage: "java.foo.bar",
+				Message:          "java.foo.bar",
+				StackTrace:       nil,
+				AsString:         "java.lang.ClassNotFoundException: java.foo.bar",
+				Cause:            (*ThrowableError)(nil),
+			},
+		}
+
+		if !assert.Equal(t, want, throwableError) {
+			t.Fail()
+		}
+		if !assert.Equal(t, "java.lang.NoClassDefFoundError: java/foo/bar", throwableError.Error()) {
+			t.Fail()
+		}
+		if !assert.Equal(t, "java.lang.ClassNotFoundException: java.foo.bar", throwableError.Cause.Error()) {
+			t.Fail()
+		}
+
+		if !assert.NotNil(t, causeST) {
+			t.Fail()
+		} else {
+			for _, v := range causeST {
+				if !assert.NotEmpty(t, v) {
+					t.Fail()
+				}
+			}
+		}
+
+	}
+
+	env.ExceptionHandler = nil
+
+	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
+		t.Fatal("did not return error")
+	} else if !assert.Equal(t, jexceptErrMsg, err.Error()) {
+		t.Error("did not return standard error")
+	}
+
+}
+
+func PTestCast(t *testing.T) {
+	str, err := env.NewObject("java/lang/String", []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// create new object ref with class name java/lang/Foo
+	c := &ObjectRef{jobject: str.JObject(), className: "java/lang/Foo"}
+	var goBytes []byte
+	if err := c.Cast("java/lang/String").CallMethod(env, "getBytes", &goBytes, env.GetUTF8String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func PTestNonVirtual(t *testing.T) {
+	obj, err := env.NewObject("local/JnigiTestExtend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var val int
+	if err := obj.CallNonvirtualMethod(env, "local/JnigiTestBase", "meaning", &val); err != nil {
+		t.Fatal(err)
+	}
+
+	if !assert.Equal(t, 42, val) {
+		t.Fail()
+	}
+}
+
+func PTestRegisterNative(t *testing.T) {
+	if err := env.RegisterNative("local/JnigiTesting", "Greet", ObjectType("java/lang/String"), []interface{}{ObjectType("java/lang/String")}, c_go_callback_Greet); err != nil {
+		t.Fatal(err)
+	}
+	objRef, err := env.NewObject("local/JnigiTesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameRef, err := env.NewObject("java/lang/String", []byte("World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strRef := NewObjectRef("java/lang/String")
+	if err := objRef.CallMethod(env, "Greet", strRef, nameRef); err != nil {
+		t.Fatal(err)
+	}
+	goStr := toGoStr(t, strRef)
+	if !assert.Equal(t, "Hello World!", goStr) {
+		t.Fail()
+	}
+}
+
+func PTestDeleteGlobalRefCache(t *testing.T) {
+	str, err := env.NewObject("java/lang/String", []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+	var goBytes []byte
+	if err := str.CallMethod(env, "getBytes", &goBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	env.DeleteGlobalRefCache()
+
+	// The shared cache is kept for the other Envs of the JVM.
+	if !assert.NotEmpty(t, env.classCache.named) || !assert.NotEmpty(t, env.classCache.members) {
+		t.Fail()
+	}
+	if err := str.CallMethod(env, "getBytes", &goBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func PTestPreparedHandles(t *testing.T) {
+	str, err := env.NewObject("java/lang/String", []byte("hello world"))
+	if err != nil {
 		t.Fatal(err)
 	}
 	defer env.DeleteLocalRef(str)
 
-	arr := NewArrayRef(Byte | Array)
-	if err := str.CallMethod(env, "getBytes", arr, env.GetUTF8String()); err != nil {
+	substring, err := env.GetMethod("java/lang/String", "substring", "(II)Ljava/lang/String;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer substring.Release(env)
+	for i := 0; i < 3; i++ {
+		var part GoString
+		if err := substring.Call(env, str, &part, i, 5); err != nil {
+			t.Fatal(err)
+		}
+		if !assert.Equal(t, GoString("hello"[i:]), part) {
+			t.Fail()
+		}
+	}
+
+	getBytes, err := env.GetMethod("java/lang/String", "getBytes", "()[B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer getBytes.Release(env)
+	var goBytes []byte
+	if err := getBytes.Call(env, str, &goBytes); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "hello world", string(goBytes)) {
+		t.Fail()
+	}
+	if err := getBytes.Call(env, nil, &goBytes); err == nil {
+		t.Error("expected error calling method on nil object")
+	}
+
+	valueOf, err := env.GetStaticMethod("java/lang/String", "valueOf", "(I)Ljava/lang/String;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer valueOf.Release(env)
+	var num GoString
+	if err := valueOf.Call(env, nil, &num, 42); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("42"), num) {
+		t.Fail()
+	}
+
+	if _, err := env.GetMethod("java/lang/String", "length", "()"); err == nil {
+		t.Error("expected error for invalid signature")
+	}
+
+	pt, err := env.NewObject("java/awt/Point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(pt)
+	x, err := env.GetFieldHandle("java/awt/Point", "x", "I")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Release(env)
+	if err := x.Set(env, pt, 7); err != nil {
+		t.Fatal(err)
+	}
+	var gotX int
+	if err := x.Get(env, pt, &gotX); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 7, gotX) {
+		t.Fail()
+	}
+	if err := x.SetInt(env, pt, 8); err != nil {
+		t.Fatal(err)
+	}
+	typedX, err := x.GetInt(env, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(8), typedX)
+
+	// values and arguments must match the signature
+	assert.NotNil(t, x.Set(env, pt, int64(9)))
+	assert.NotNil(t, x.SetLong(env, pt, 9))
+	if _, err := x.GetLong(env, pt); err == nil {
+		t.Error("expected error getting int field as long")
+	}
+	var notCalled GoString
+	assert.NotNil(t, substring.Call(env, str, &notCalled, int64(0), 5))
+	assert.NotNil(t, substring.Call(env, str, &notCalled, 0))
+	assert.NotNil(t, valueOf.Call(env, nil, &notCalled, str))
+
+	// object arguments must be instances of the parameter class
+	concat, err := env.GetMethod("java/lang/String", "concat", "(Ljava/lang/String;)Ljava/lang/String;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer concat.Release(env)
+	obj, err := env.NewObject("java/lang/Object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(obj)
+	assert.NotNil(t, concat.Call(env, str, &notCalled, obj))
+	var joined GoString
+	if err := concat.Call(env, str, &joined, str); err != nil {
 		t.Fatal(err)
 	}
+	assert.Equal(t, GoString("hello worldhello world"), joined)
 
-	ba2 := env.NewByteArrayFromObject(arr.ObjectRef)
+	april, err := env.GetStaticFieldHandle("java/util/Calendar", "APRIL", "I")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer april.Release(env)
+	var calPos int
+	if err := april.Get(env, nil, &calPos); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 5, calPos) {
+		t.Fail()
+	}
+}
 
-	bytes = ba2.CopyBytes(env)
-	if !assert.Equal(t, "hello world", string(bytes)) {
+func PTestClass(t *testing.T) {
+	alist, err := env.GetClass("java/util/ArrayList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "java/util/ArrayList", alist.Name()) {
 		t.Fail()
 	}
 
-	ba3 := env.NewByteArrayFromSlice([]byte("hello world!"))
-	bytes = ba3.CopyBytes(env)
-	if !assert.Equal(t, "hello world!", string(bytes)) {
+	super, err := alist.Superclass(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "java/util/AbstractList", super.Name()) {
+		t.Fail()
+	}
+	super.Release(env)
+
+	list, err := env.GetClass("java/util/List")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interfaces, err := alist.Interfaces(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, iface := range interfaces {
+		names = append(names, iface.Name())
+		iface.Release(env)
+	}
+	if !assert.Contains(t, names, "java/util/List") {
+		t.Fail()
+	}
+	if !list.IsAssignableFrom(env, alist) || alist.IsAssignableFrom(env, list) {
+		t.Error("IsAssignableFrom test failed")
+	}
+	if isInterface, err := list.IsInterface(env); err != nil {
+		t.Fatal(err)
+	} else if !isInterface {
+		t.Error("IsInterface test failed")
+	}
+
+	if obj, err := env.GetClass("java/lang/Object"); err != nil {
+		t.Fatal(err)
+	} else if super, err := obj.Superclass(env); err != nil {
+		t.Fatal(err)
+	} else if super != nil {
+		t.Error("expected java/lang/Object to have no superclass")
+	}
+
+	strArray, err := env.GetClass("[Ljava/lang/String;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strArray.IsArray() || alist.IsArray() {
+		t.Error("IsArray test failed")
+	}
+	component, err := strArray.ComponentType(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "java/lang/String", component.Name()) {
+		t.Fail()
+	}
+	component.Release(env)
+	intArray, err := env.GetClass("[I")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err = intArray.ComponentType(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "int", component.Name()) {
+		t.Fail()
+	}
+	component.Release(env)
+
+	str, err := env.GetClass("java/lang/String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := str.NewInstance(env, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(inst)
+	if !assert.Equal(t, "hello", toGoStr(t, inst)) {
+		t.Fail()
+	}
+	// the class of an object owns its reference, it is not added to the class cache
+	cached := len(env.classCache.members)
+	globals := env.Stats().GlobalRefs
+	instClass, err := env.GetObjectClass(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "java/lang/String", instClass.Name()) || !str.IsInstance(env, inst) {
+		t.Fail()
+	}
+	assert.Equal(t, cached, len(env.classCache.members))
+	assert.Equal(t, globals+1, env.Stats().GlobalRefs)
+	instClass.Release(env)
+	instClass.Release(env)
+	assert.Equal(t, globals, env.Stats().GlobalRefs)
+	str.Release(env)
+	if !str.IsInstance(env, inst) {
+		t.Error("a class of the class cache is not released")
+	}
+
+	var num GoString
+	if err := str.CallStaticMethod(env, "valueOf", &num, 42); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("42"), num) {
 		t.Fail()
 	}
+
+	obj := inst.Cast("java/lang/Object")
+	if _, err := obj.CheckedCast(env, "java/lang/CharSequence"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.CheckedCast(env, "java/lang/Integer"); err == nil {
+		t.Error("expected CheckedCast to java/lang/Integer to fail")
+	}
 }
 
-func PTestGetJVM(t *testing.T) {
-	_, err := env.GetJVM()
+func PTestDescribeClass(t *testing.T) {
+	desc, err := env.DescribeClass("java/util/ArrayList")
 	if err != nil {
-		t.Fatalf("GetJavaVM failed %s", err)
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, "java/util/ArrayList", desc.Name) || !assert.Equal(t, "java/util/AbstractList", desc.Superclass) {
+		t.Fail()
+	}
+	if !desc.Modifiers.Is(ModPublic) || desc.Modifiers.Is(ModInterface) {
+		t.Errorf("unexpected class modifiers %s", desc.Modifiers)
+	}
+	if !assert.Contains(t, desc.Interfaces, "java/util/List") {
+		t.Fail()
+	}
+
+	var ctorSigs []string
+	for _, c := range desc.Constructors {
+		if !assert.Equal(t, "<init>", c.Name) {
+			t.Fail()
+		}
+		ctorSigs = append(ctorSigs, c.Signature)
+	}
+	if !assert.Contains(t, ctorSigs, "(I)V") || !assert.Contains(t, ctorSigs, "(Ljava/util/Collection;)V") {
+		t.Fail()
+	}
+
+	var found bool
+	for _, m := range desc.FindMethods("get") {
+		if m.Signature == "(I)Ljava/lang/Object;" && m.DeclaringClass == "java/util/ArrayList" {
+			found = true
+			if !assert.Equal(t, "public E java.util.ArrayList.get(int)", m.GenericString) {
+				t.Fail()
+			}
+		}
+	}
+	if !found {
+		t.Error("ArrayList.get(int) not described")
+	}
+
+	// inherited public method
+	found = false
+	for _, m := range desc.FindMethods("getClass") {
+		if m.DeclaringClass == "java/lang/Object" && m.Signature == "()Ljava/lang/Class;" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Object.getClass() not described")
+	}
+
+	cal, err := env.DescribeClass("java/util/Calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	april := cal.FindField("APRIL")
+	if april == nil {
+		t.Fatal("Calendar.APRIL not described")
+	}
+	if !assert.Equal(t, "I", april.Signature) || !assert.Equal(t, "public static final", april.Modifiers.String()) {
+		t.Fail()
 	}
-	t.Logf("Call GetJavaJVM: passed")
 }
 
-func PTestDestroy(t *testing.T) {
-	env.DeleteGlobalRefCache()
-	err := jvm.Destroy()
+func PTestReflected(t *testing.T) {
+	strClass, err := env.GetClass("java/lang/String")
 	if err != nil {
-		t.Fatalf("DestroyJVM failed %s", err)
+		t.Fatal(err)
+	}
+	noParams := env.ToObjectArray([]*ObjectRef{}, "java/lang/Class")
+	defer env.DeleteLocalRef(noParams)
+
+	env.PrecalculateSignature("(Ljava/lang/String;[Ljava/lang/Class;)Ljava/lang/reflect/Method;")
+	reflected := NewObjectRef("java/lang/reflect/Method")
+	if err := strClass.GetObject().CallMethod(env, "getMethod", reflected, fromGoStr(t, "length"), noParams); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(reflected)
+
+	length, err := env.FromReflectedMethod(reflected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer length.Release(env)
+	if !assert.Equal(t, "()I", length.Signature()) || length.IsStatic() {
+		t.Fail()
+	}
+	var n int
+	if err := length.Call(env, fromGoStr(t, "hello"), &n); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 5, n) {
+		t.Fail()
+	}
+
+	byteArrayClass, err := env.GetClass("[B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := env.ToObjectArray([]*ObjectRef{byteArrayClass.GetObject()}, "java/lang/Class")
+	defer env.DeleteLocalRef(params)
+	env.PrecalculateSignature("([Ljava/lang/Class;)Ljava/lang/reflect/Constructor;")
+	reflectedCtor := NewObjectRef("java/lang/reflect/Constructor")
+	if err := strClass.GetObject().CallMethod(env, "getConstructor", reflectedCtor, params); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(reflectedCtor)
+
+	ctor, err := env.FromReflectedMethod(reflectedCtor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctor.Release(env)
+	if !ctor.IsConstructor() {
+		t.Error("expected constructor")
+	}
+	str, err := ctor.NewObject(env, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(str)
+	if !assert.Equal(t, "abc", toGoStr(t, str)) {
+		t.Fail()
+	}
+
+	valueOf, err := env.GetStaticMethod("java/lang/String", "valueOf", "(I)Ljava/lang/String;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer valueOf.Release(env)
+	back, err := env.ToReflectedMethod(valueOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(back)
+	var genericString GoString
+	env.PrecalculateSignature("()Ljava/lang/String;")
+	if err := back.CallMethod(env, "toGenericString", &genericString); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("public static java.lang.String java.lang.String.valueOf(int)"), genericString) {
+		t.Fail()
+	}
+
+	x, err := env.GetFieldHandle("java/awt/Point", "x", "I")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Release(env)
+	reflectedField, err := env.ToReflectedField(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(reflectedField)
+	x2, err := env.FromReflectedField(reflectedField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x2.Release(env)
+	if !assert.Equal(t, "x", x2.Name()) || !assert.Equal(t, "I", x2.Signature()) {
+		t.Fail()
+	}
+	pt, err := env.NewObject("java/awt/Point", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(pt)
+	var gotX int
+	if err := x2.Get(env, pt, &gotX); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 3, gotX) {
+		t.Fail()
+	}
+}
+
+func toGoStr(t *testing.T, o *ObjectRef) string {
+	var goBytes []byte
+	if err := o.CallMethod(env, "getBytes", &goBytes); err != nil {
+		t.Fatal(err)
+	}
+	return string(goBytes)
+}
+
+func fromGoStr(t *testing.T, str string) *ObjectRef {
+	jstr, err := env.NewObject("java/lang/String", []byte(str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jstr
+}
+
+func PTestDefineClass(t *testing.T) {
+	cwd, _ := os.Getwd()
+	bytecode, err := ioutil.ReadFile(filepath.Join(cwd, "java/test/out_define/local/JnigiDefined.class"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loader := NewObjectRef("java/lang/ClassLoader")
+	if err := env.CallStaticMethod("java/lang/ClassLoader", "getSystemClassLoader", loader); err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(loader)
+
+	class, err := env.DefineClass("local/JnigiDefined", loader, bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v int
+	defer class.Release(env)
+	if err := class.CallStaticMethod(env, "twice", &v, 21); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 42, v) {
+		t.Fail()
+	}
+
+	obj, err := env.NewObject("local/JnigiDefined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(obj)
+	var greeting GoString
+	env.PrecalculateSignature("()Ljava/lang/String;")
+	if err := obj.CallMethod(env, "greeting", &greeting); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("defined"), greeting) {
+		t.Fail()
+	}
+
+	// defining the same class twice fails with java.lang.LinkageError
+	if _, err := env.DefineClass("local/JnigiDefined", loader, bytecode); err == nil {
+		t.Error("expected error defining class twice")
+	}
+
+	if _, err := env.DefineClass("local/JnigiDefined", nil, []byte{1, 2, 3}); err == nil {
+		t.Error("expected error for invalid bytecode")
+	}
+
+	// the same class can be defined in other loaders, each call returns its own class
+	var classes []*Class
+	for i := 0; i < 2; i++ {
+		other, err := env.NewObject("java/security/SecureClassLoader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer env.DeleteLocalRef(other)
+		c, err := env.DefineClass("local/JnigiDefined", other.Cast("java/lang/ClassLoader"), bytecode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Release(env)
+		classes = append(classes, c)
+	}
+	assert.False(t, toBool(isSameObject(env.jniEnv, jobject(classes[0].class), jobject(classes[1].class))))
+	assert.False(t, toBool(isSameObject(env.jniEnv, jobject(classes[0].class), jobject(class.class))))
+	if err := classes[1].CallStaticMethod(env, "twice", &v, 2); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, v)
+}
+
+func PTestHelperClassRetry(t *testing.T) {
+	helperClassesMu.Lock()
+	origClasses, origDefs := helperClasses, helperClassDefs
+	helperClasses = nil
+	helperClassDefs = make(map[string]helperClassDef)
+	for name, def := range origDefs {
+		helperClassDefs[name] = def
+	}
+	helperClassDefs["jnigi/Invalid"] = helperClassDef{
+		bytecode: func() []byte { return []byte{1, 2, 3} },
+		requires: []string{jarURLConnClass},
+	}
+	helperClassesMu.Unlock()
+	defer func() {
+		helperClassesMu.Lock()
+		for _, c := range helperClasses {
+			deleteGlobalRef(env.jniEnv, jobject(c))
+		}
+		helperClasses, helperClassDefs = origClasses, origDefs
+		helperClassesMu.Unlock()
+	}()
+
+	// the required class is kept, the failed one is not
+	if _, err := env.helperClass("jnigi/Invalid"); err == nil {
+		t.Fatal("expected error defining invalid helper class")
+	}
+	helperClassesMu.Lock()
+	assert.Contains(t, helperClasses, jarURLConnClass)
+	assert.NotContains(t, helperClasses, "jnigi/Invalid")
+	helperClassesMu.Unlock()
+
+	// the helper classes defined before are found instead of defined again, and only the classes
+	// used are defined
+	class, err := env.helperClass(jarLoaderClass)
+	if err != nil {
+		t.Fatal(err)
 	}
+	assert.True(t, toBool(isSameObject(env.jniEnv, jobject(class), jobject(origClasses[jarLoaderClass]))))
+	helperClassesMu.Lock()
+	assert.Len(t, helperClasses, 3)
+	assert.Contains(t, helperClasses, jarURLHandlerClass)
+	assert.NotContains(t, helperClasses, goOutputStreamClass)
+	helperClassesMu.Unlock()
 }
 
-func PTestEnsureLocalCapacity(t *testing.T) {
-	if err := env.EnsureLocalCapacity(256); err != nil {
-		t.Fatalf("EnsureLocalCapacity failed %s", err)
-	}
-	t.Logf("Call EnsureLocalCapacity: passed")
+// writeRecorder records each Write call.
+type writeRecorder struct {
+	mu     sync.Mutex
+	writes []string
 }
 
-func PTestPushPopLocalFrame(t *testing.T) {
-	if err := env.PushLocalFrame(64); err != nil {
-		t.Fatalf("PushLocalFrame failed %s", err)
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func (w *writeRecorder) get() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+func PTestRedirectStdio(t *testing.T) {
+	// restore the original streams afterwards
+	for _, s := range []struct{ field, setter, class string }{
+		{"out", "setOut", "java/io/PrintStream"},
+		{"err", "setErr", "java/io/PrintStream"},
+		{"in", "setIn", "java/io/InputStream"},
+	} {
+		orig := NewObjectRef(s.class)
+		if err := env.GetStaticField("java/lang/System", s.field, orig); err != nil {
+			t.Fatal(err)
+		}
+		setter := s.setter
+		defer func() {
+			if err := env.CallStaticMethod("java/lang/System", setter, nil, orig); err != nil {
+				t.Fatal(err)
+			}
+			env.DeleteLocalRef(orig)
+		}()
 	}
-	t.Logf("Call PushLocalFrame: passed")
 
-	obj, err := env.NewObject("java/lang/Object")
-	if err != nil {
+	var stdout, stderr writeRecorder
+	if err := env.RedirectStdio(&stdout, &stderr, strings.NewReader("hi")); err != nil {
 		t.Fatal(err)
 	}
 
-	var dummy int
-	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
+	// each write is one complete line
+	out := NewObjectRef("java/io/PrintStream")
+	if err := env.GetStaticField("java/lang/System", "out", out); err != nil {
 		t.Fatal(err)
 	}
-
-	// Pop local frame with obj reference; obj should now be in previous frame
-	obj = env.PopLocalFrame(obj)
-	t.Logf("Call PopLocalFrame: passed")
-
-	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
-		t.Fatalf("hashCode after PopLocalFrame failed %s", err)
+	defer env.DeleteLocalRef(out)
+	if err := out.CallMethod(env, "print", nil, fromGoStr(t, "a")); err != nil {
+		t.Fatal(err)
 	}
-
-	env.DeleteLocalRef(obj)
-
-	// Now do again with nil argument to pop
-	if err := env.PushLocalFrame(32); err != nil {
-		t.Fatalf("PushLocalFrame failed %s", err)
+	assert.Empty(t, stdout.get())
+	if err := out.CallMethod(env, "println", nil, fromGoStr(t, "b\nc")); err != nil {
+		t.Fatal(err)
 	}
-	t.Logf("Call PushLocalFrame: passed")
+	assert.Equal(t, []string{"ab\n", "c\n"}, stdout.get())
 
-	obj, err = env.NewObject("java/lang/Object")
+	exc, err := env.NewObject("java/lang/Exception", fromGoStr(t, "boom"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := obj.CallMethod(env, "hashCode", &dummy); err != nil {
+	defer env.DeleteLocalRef(exc)
+	if err := exc.CallMethod(env, "printStackTrace", nil); err != nil {
 		t.Fatal(err)
 	}
-
-	// Pop local frame with nil
-	obj = env.PopLocalFrame(nil)
-	t.Logf("Call PopLocalFrame: passed")
-
-	if !obj.IsNil() {
-		t.Fatal("PopLocalFrame return value is not nil")
+	if errLines := stderr.get(); assert.NotEmpty(t, errLines) {
+		assert.Equal(t, "java.lang.Exception: boom\n", errLines[0])
 	}
-}
 
-func runWithStderrRedir(f func() error) error {
-	// redirect standard err
-	stdErrFd := int(os.Stderr.Fd())
-	newFd, err := syscall.Dup(stdErrFd)
-	if err != nil {
-		return err
+	in := NewObjectRef("java/io/InputStream")
+	if err := env.GetStaticField("java/lang/System", "in", in); err != nil {
+		t.Fatal(err)
 	}
-	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 000)
-	if err != nil {
-		return err
+	defer env.DeleteLocalRef(in)
+	var read []int
+	for i := 0; i < 3; i++ {
+		var b int
+		if err := in.CallMethod(env, "read", &b); err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, b)
 	}
-	syscall.Dup2(int(devNull.Fd()), stdErrFd)
-	err = f()
-	syscall.Dup2(newFd, stdErrFd)
-
-	return err
-}
+	assert.Equal(t, []int{'h', 'i', -1}, read)
 
-func newObjWithStderrRedir(class string) error {
-	err := runWithStderrRedir(func() error {
-		_, err := env.NewObject(class)
-		return err
-	})
-	return err
-}
-
-func PTestHandleException(t *testing.T) {
-	jexceptErrMsg := "Java exception occurred. check stderr/logcat"
-	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
-		t.Fatal("did not return error")
-	} else if !assert.Equal(t, jexceptErrMsg, err.Error()) {
-		t.Fatal("did not return standard error")
+	// a partial line is written when the stream is replaced
+	if err := out.CallMethod(env, "print", nil, fromGoStr(t, "d")); err != nil {
+		t.Fatal(err)
 	}
-
-	env.ExceptionHandler = ThrowableToStringExceptionHandler
-	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
-		t.Fatal("did not return error")
-	} else if !assert.Equal(t, "java.lang.NoClassDefFoundError: java/foo/bar", err.Error()) {
-		t.Fatal("did not return standard error")
+	var stdout2 writeRecorder
+	if err := env.RedirectStdio(&stdout2, nil, nil); err != nil {
+		t.Fatal(err)
 	}
+	assert.Equal(t, []string{"ab\n", "c\n", "d"}, stdout.get())
+}
 
-	env.ExceptionHandler = ThrowableErrorExceptionHandler
-	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
-		t.Fatal("did not return error")
-	} else {
-		throwableError, ok := err.(ThrowableError)
-		if !ok {
-			t.Fatalf("expected ThrowableError, but got %T", err)
+func makeJar(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		// get the cause stack trace, then set this to nil so rest of structure can be tested
-		var causeST []StackTraceElement
-		if v := throwableError.Cause; v != nil {
-			causeST = v.StackTrace
-			throwableError.Cause.StackTrace = nil
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
 		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
 
-		want := ThrowableError{
-			ClassName:        "java.lang.NoClassDefFoundError",
-			LocalizedMessage: "java/foo/bar",
-			Message:          "java/foo/bar",
-			StackTrace:       []StackTraceElement{},
-			AsString:         "java.lang.NoClassDefFoundError: java/foo/bar",
-			Cause: &ThrowableError{
-				ClassName:        "java.lang.ClassNotFoundException",
-				LocalizedMessage: "java.foo.bar",
-				Message:          "java.foo.bar",
-				StackTrace:       nil,
-				AsString:         "java.lang.ClassNotFoundException: java.foo.bar",
-				Cause:            (*ThrowableError)(nil),
-			},
+func PTestJarClassLoader(t *testing.T) {
+	cwd, _ := os.Getwd()
+	readClass := func(name string) []byte {
+		b, err := ioutil.ReadFile(filepath.Join(cwd, "java/test/out_jar", name))
+		if err != nil {
+			t.Fatal(err)
 		}
+		return b
+	}
 
-		if !assert.Equal(t, want, throwableError) {
-			t.Fail()
-		}
-		if !assert.Equal(t, "java.lang.NoClassDefFoundError: java/foo/bar", throwableError.Error()) {
-			t.Fail()
-		}
-		if !assert.Equal(t, "java.lang.ClassNotFoundException: java.foo.bar", throwableError.Cause.Error()) {
-			t.Fail()
-		}
+	jar1 := makeJar(t, map[string][]byte{
+		"local/JnigiJarTest.class":                      readClass("local/JnigiJarTest.class"),
+		"META-INF/services/java.util.function.Supplier": []byte("local.JnigiJarTest\n"),
+	})
+	jar2 := makeJar(t, map[string][]byte{
+		"local/JnigiJarTest$Other.class":                readClass("local/JnigiJarTest$Other.class"),
+		"local/message.txt":                             []byte("hello from memory"),
+		"META-INF/services/java.util.function.Supplier": []byte("local.JnigiJarTest$Other\n"),
+	})
 
-		if !assert.NotNil(t, causeST) {
-			t.Fail()
-		} else {
-			for _, v := range causeST {
-				if !assert.NotEmpty(t, v) {
-					t.Fail()
-				}
-			}
-		}
+	loader, err := env.NewJarClassLoader(jar1, jar2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loader.Release(env)
+	defer func(prev unsafe.Pointer) {
+		env.addtlClassLoader = prev
+	}(env.addtlClassLoader)
+	env.SetClassLoader(loader)
 
+	obj, err := env.NewObject("local/JnigiJarTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(obj)
+	var got GoString
+	env.PrecalculateSignature("()Ljava/lang/String;")
+	if err := obj.CallMethod(env, "get", &got); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("from jar"), got) {
+		t.Fail()
 	}
 
-	env.ExceptionHandler = nil
+	name, err := env.NewObject("java/lang/String", []byte("/local/message.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.DeleteLocalRef(name)
+	env.PrecalculateSignature("(Ljava/lang/String;)Ljava/lang/String;")
+	if err := env.CallStaticMethod("local/JnigiJarTest", "resource", &got, name); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, GoString("hello from memory"), got) {
+		t.Fail()
+	}
 
-	if err := newObjWithStderrRedir("java/foo/bar"); err == nil {
-		t.Fatal("did not return error")
-	} else if !assert.Equal(t, jexceptErrMsg, err.Error()) {
-		t.Error("did not return standard error")
+	var n int
+	if err := env.CallStaticMethod("local/JnigiJarTest", "providers", &n); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, 2, n) {
+		t.Fail()
 	}
 
+	if _, err := env.NewJarClassLoader([]byte("not a jar")); err == nil {
+		t.Error("expected error for invalid jar")
+	}
 }
 
-func PTestCast(t *testing.T) {
-	str, err := env.NewObject("java/lang/String", []byte("hello world"))
+func PTestClassLoaders(t *testing.T) {
+	cwd, _ := os.Getwd()
+	urlLoader, err := env.NewURLClassLoader(nil, filepath.Join(cwd, "java/test/out_jar"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	// create new object ref with class name java/lang/Foo
-	c := &ObjectRef{str.JObject(), "java/lang/Foo", false}
-	var goBytes []byte
-	if err := c.Cast("java/lang/String").CallMethod(env, "getBytes", &goBytes, env.GetUTF8String()); err != nil {
+
+	// loadClass delegates to the parent loader
+	if _, err := urlLoader.LoadClass(env, "java/util/ArrayList"); err != nil {
 		t.Fatal(err)
 	}
-}
-
-func PTestNonVirtual(t *testing.T) {
-	obj, err := env.NewObject("local/JnigiTestExtend")
+	class, err := urlLoader.LoadClass(env, "local/JnigiJarTest")
 	if err != nil {
 		t.Fatal(err)
 	}
-	var val int
-	if err := obj.CallNonvirtualMethod(env, "local/JnigiTestBase", "meaning", &val); err != nil {
+	obj, err := class.NewInstance(env)
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	if !assert.Equal(t, 42, val) {
+	var got GoString
+	env.PrecalculateSignature("()Ljava/lang/String;")
+	if err := obj.CallMethod(env, "get", &got); err != nil {
+		t.Fatal(err)
+	}
+	env.DeleteLocalRef(obj)
+	if !assert.Equal(t, GoString("from jar"), got) {
 		t.Fail()
 	}
-}
 
-func PTestRegisterNative(t *testing.T) {
-	if err := env.RegisterNative("local/JnigiTesting", "Greet", ObjectType("java/lang/String"), []interface{}{ObjectType("java/lang/String")}, c_go_callback_Greet); err != nil {
+	// findClass only searches the loader itself
+	urlLoader.SetLookup(LookupFindClass)
+	if !assert.Equal(t, LookupFindClass, urlLoader.Lookup()) {
+		t.Fail()
+	}
+	if _, err := urlLoader.LoadClass(env, "local/JnigiJarTest$Other"); err != nil {
 		t.Fatal(err)
 	}
-	objRef, err := env.NewObject("local/JnigiTesting")
+	if _, err := urlLoader.LoadClass(env, "java/lang/Integer"); err == nil {
+		t.Error("expected findClass to not find system class")
+	}
+	urlLoader.SetLookup(LookupLoadClass)
+
+	// a child loader finds classes of its parent
+	child, err := env.NewJarClassLoaderWithParent(urlLoader, makeJar(t, map[string][]byte{"local/child.txt": []byte("child")}))
 	if err != nil {
 		t.Fatal(err)
 	}
-	nameRef, err := env.NewObject("java/lang/String", []byte("World"))
+	childClass, err := child.LoadClass(env, "local/JnigiJarTest")
 	if err != nil {
 		t.Fatal(err)
 	}
-	strRef := NewObjectRef("java/lang/String")
-	if err := objRef.CallMethod(env, "Greet", strRef, nameRef); err != nil {
+	if !toBool(isSameObject(env.jniEnv, jobject(class.class), jobject(childClass.class))) {
+		t.Error("expected class to be loaded by parent loader")
+	}
+	if err := child.Release(env); err != nil {
 		t.Fatal(err)
 	}
-	goStr := toGoStr(t, strRef)
-	if !assert.Equal(t, "Hello World!", goStr) {
-		t.Fail()
+
+	// Envs attached after JVM.SetClassLoader use the loader
+	jvm.SetClassLoader(urlLoader)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		nenv := jvm.AttachCurrentThread()
+		defer jvm.DetachCurrentThread(nenv)
+
+		obj, err := nenv.NewObject("local/JnigiJarTest$Other")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		nenv.DeleteLocalRef(obj)
+	}()
+	<-done
+	jvm.SetClassLoader(nil)
+
+	if err := urlLoader.Release(env); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func PTestDeleteGlobalRefCache(t *testing.T) {
-	str, err := env.NewObject("java/lang/String", []byte("hello world"))
+func PTestIsolatedClassLoaders(t *testing.T) {
+	cwd, _ := os.Getwd()
+	v2Class, err := ioutil.ReadFile(filepath.Join(cwd, "java/test/out_plugin_v2/local/JnigiPlugin.class"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer env.DeleteLocalRef(str)
-	var goBytes []byte
-	if err := str.CallMethod(env, "getBytes", &goBytes); err != nil {
+	v2Jar := makeJar(t, map[string][]byte{"local/JnigiPlugin.class": v2Class})
+
+	parent, err := env.NewURLClassLoader(nil, filepath.Join(cwd, "java/test/out_plugin_v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Release(env)
+	parentFirst, err := env.NewJarClassLoaderWithParent(parent, v2Jar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parentFirst.Release(env)
+	childFirst, err := env.NewChildFirstJarClassLoader(parent, v2Jar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childFirstURL, err := env.NewChildFirstURLClassLoader(parent, filepath.Join(cwd, "java/test/out_plugin_v2"))
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer childFirstURL.Release(env)
 
-	env.DeleteGlobalRefCache()
+	defer func(prev unsafe.Pointer) {
+		env.addtlClassLoader = prev
+	}(env.addtlClassLoader)
+
+	version := func(loader *ClassLoaderRef) string {
+		env.SetClassLoader(loader)
+		var v GoString
+		env.PrecalculateSignature("()Ljava/lang/String;")
+		if err := env.CallStaticMethod("local/JnigiPlugin", "version", &v); err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
 
-	if !assert.Empty(t, env.classCache) {
+	// classes with the same name are cached for each loader
+	if !assert.Equal(t, "1", version(parent)) ||
+		!assert.Equal(t, "1", version(parentFirst)) ||
+		!assert.Equal(t, "2", version(childFirst)) ||
+		!assert.Equal(t, "2", version(childFirstURL)) ||
+		!assert.Equal(t, "1", version(parent)) {
 		t.Fail()
 	}
-}
 
-func toGoStr(t *testing.T, o *ObjectRef) string {
-	var goBytes []byte
-	if err := o.CallMethod(env, "getBytes", &goBytes); err != nil {
+	env.SetClassLoader(childFirst)
+	before, err := env.GetClass("local/JnigiPlugin")
+	if err != nil {
 		t.Fatal(err)
 	}
-	return string(goBytes)
-}
+	beforeRef := env.NewGlobalRef(before.GetObject())
+	defer env.DeleteGlobalRef(beforeRef)
 
-func fromGoStr(t *testing.T, str string) *ObjectRef {
-	jstr, err := env.NewObject("java/lang/String", []byte(str))
+	oldRef := childFirst.ref
+	reloaded, err := env.ReloadClassLoader(childFirst)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return jstr
+	defer reloaded.Release(env)
+	if env.addtlClassLoader != reloaded.ref {
+		t.Error("expected env to use reloaded class loader")
+	}
+	for key := range env.classCache.named {
+		if key.loader == oldRef {
+			t.Errorf("class %s of released loader still cached", key.name)
+		}
+	}
+
+	after, err := env.GetClass("local/JnigiPlugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toBool(isSameObject(env.jniEnv, beforeRef.jobject, jobject(after.class))) {
+		t.Error("expected new class after reload")
+	}
+	if !assert.Equal(t, "2", version(reloaded)) {
+		t.Fail()
+	}
+
+	other := env.GetClassLoader(beforeRef)
+	defer other.Release(env)
+	assert.Equal(t, LookupFindClass, other.Lookup())
+	if _, err := env.ReloadClassLoader(other); err == nil {
+		t.Error("expected error reloading class loader not created by jnigi")
+	}
 }
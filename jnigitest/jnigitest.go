@@ -0,0 +1,56 @@
+// Package jnigitest has helpers for testing code that uses jnigi.
+package jnigitest
+
+import (
+	"testing"
+
+	"github.com/timob/jnigi"
+)
+
+// Option changes what AssertNoLeaks checks.
+type Option func(*options)
+
+type options struct {
+	cAllocs bool
+}
+
+// CheckCAllocs makes AssertNoLeaks also check the C allocations made by jnigi. They are counted for
+// the whole process, so pool threads, the jnigi-ref-cleaner thread or parallel tests allocating
+// while f runs cause false failures, only use it when nothing else uses jnigi.
+func CheckCAllocs() Option {
+	return func(o *options) {
+		o.cAllocs = true
+	}
+}
+
+// AssertNoLeaks calls f and fails t if f leaves local, global or weak global references behind, and
+// C allocations made by jnigi with CheckCAllocs. Local references are counted for env, global
+// references for its JVM, so other goroutines using the JVM while f runs can cause false failures.
+// Returns true if nothing leaked.
+func AssertNoLeaks(t testing.TB, env *jnigi.Env, f func(), opts ...Option) bool {
+	t.Helper()
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	before := env.Stats()
+	f()
+	after := env.Stats()
+
+	ok := true
+	check := func(what string, before, after int64) {
+		if after > before {
+			t.Errorf("jnigitest: %d %s leaked (%d before, %d after)", after-before, what, before, after)
+			ok = false
+		}
+	}
+	check("local references", before.LocalRefs, after.LocalRefs)
+	check("global references", before.GlobalRefs, after.GlobalRefs)
+	check("weak global references", before.WeakGlobalRefs, after.WeakGlobalRefs)
+	if o.cAllocs {
+		check("C allocations", before.CAllocs, after.CAllocs)
+	}
+	return ok
+}
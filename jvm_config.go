@@ -0,0 +1,465 @@
+package jnigi
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// JVMConfig builds the JVMInitArgs for CreateJVM from typed settings. Mistakes are collected and
+// returned by Build instead of panicking. For example:
+//
+//	args, err := jnigi.NewJVMConfig().
+//		Classpath("lib/*", "app.jar").
+//		MaxHeap(512 << 20).
+//		SystemProperty("file.encoding", "UTF-8").
+//		Build()
+//
+// Options are passed to the JVM in the order they are added, the class path is passed last.
+type JVMConfig struct {
+	version            int
+	ignoreUnrecognized bool
+	envOptions         bool
+	classpath          []string
+	options            []string
+	errs               []string
+	hooks              jvmHooks
+}
+
+// NewJVMConfig returns a JVMConfig for JNI version DEFAULT_VERSION with no options.
+func NewJVMConfig() *JVMConfig {
+	return &JVMConfig{version: DEFAULT_VERSION}
+}
+
+func (c *JVMConfig) errorf(format string, args ...interface{}) *JVMConfig {
+	c.errs = append(c.errs, fmt.Sprintf(format, args...))
+	return c
+}
+
+// Version sets the JNI version, it can be NEGOTIATE_VERSION.
+func (c *JVMConfig) Version(version int) *JVMConfig {
+	c.version = version
+	return c
+}
+
+// IgnoreUnrecognized makes the JVM ignore options it does not recognize instead of failing.
+func (c *JVMConfig) IgnoreUnrecognized(ignore bool) *JVMConfig {
+	c.ignoreUnrecognized = ignore
+	return c
+}
+
+// Classpath adds entries to the class path. An entry ending in * is expanded to the jar files in its
+// directory, like the java launcher does. The jars named by the Class-Path attribute of the manifest
+// of each jar file are added after it.
+func (c *JVMConfig) Classpath(entries ...string) *JVMConfig {
+	for _, entry := range entries {
+		if entry == "" || strings.ContainsRune(entry, os.PathListSeparator) {
+			c.errorf("invalid class path entry %q, use one argument per entry", entry)
+			continue
+		}
+		c.classpath = append(c.classpath, entry)
+	}
+	return c
+}
+
+// MaxHeap sets the maximum heap size in bytes, the -Xmx option.
+func (c *JVMConfig) MaxHeap(bytes int64) *JVMConfig {
+	if bytes <= 0 {
+		return c.errorf("invalid max heap size %d", bytes)
+	}
+	return c.Option("-Xmx" + heapSize(bytes))
+}
+
+// heapSize formats bytes with the largest unit that divides it.
+func heapSize(bytes int64) string {
+	switch {
+	case bytes%(1<<30) == 0:
+		return fmt.Sprintf("%dg", bytes>>30)
+	case bytes%(1<<20) == 0:
+		return fmt.Sprintf("%dm", bytes>>20)
+	case bytes%(1<<10) == 0:
+		return fmt.Sprintf("%dk", bytes>>10)
+	default:
+		return fmt.Sprintf("%d", bytes)
+	}
+}
+
+// SystemProperty sets Java system property key to value, the -D option. Use Classpath rather than
+// the java.class.path property.
+func (c *JVMConfig) SystemProperty(key, value string) *JVMConfig {
+	if key == "" || strings.ContainsAny(key, "= \t") {
+		return c.errorf("invalid system property name %q", key)
+	}
+	return c.Option("-D" + key + "=" + value)
+}
+
+// JavaAgent loads the Java agent in jar with options, the -javaagent option. options can be empty.
+func (c *JVMConfig) JavaAgent(jar string, options string) *JVMConfig {
+	if jar == "" {
+		return c.errorf("empty java agent jar path")
+	}
+	if _, err := os.Stat(jar); err != nil {
+		return c.errorf("java agent: %v", err)
+	}
+	if options != "" {
+		return c.Option("-javaagent:" + jar + "=" + options)
+	}
+	return c.Option("-javaagent:" + jar)
+}
+
+// CheckJNI turns on additional checks of JNI calls, the -Xcheck:jni option.
+func (c *JVMConfig) CheckJNI(enabled bool) *JVMConfig {
+	if !enabled {
+		return c
+	}
+	return c.Option("-Xcheck:jni")
+}
+
+// Verbose turns on verbose output of kinds, which can be class, gc, jni and module.
+func (c *JVMConfig) Verbose(kinds ...string) *JVMConfig {
+	for _, kind := range kinds {
+		switch kind {
+		case "class", "gc", "jni", "module":
+			c.Option("-verbose:" + kind)
+		default:
+			c.errorf("unknown verbose kind %q", kind)
+		}
+	}
+	return c
+}
+
+// Option adds raw JVM options. An option starting with @ is an argument file, it is replaced with
+// the options read from the file using the java launcher's rules. Start an option with @@ to pass it
+// with a single @.
+func (c *JVMConfig) Option(options ...string) *JVMConfig {
+	for _, option := range options {
+		switch {
+		case strings.HasPrefix(option, "@@"):
+			c.options = append(c.options, option[1:])
+		case strings.HasPrefix(option, "@"):
+			c.ArgFile(option[1:])
+		case option == "":
+			c.errorf("empty option")
+		default:
+			c.options = append(c.options, option)
+		}
+	}
+	return c
+}
+
+// ArgFile adds the options read from argument file path, see Option.
+func (c *JVMConfig) ArgFile(path string) *JVMConfig {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c.errorf("argument file: %v", err)
+	}
+	args, err := parseArgs(string(data))
+	if err != nil {
+		return c.errorf("argument file %s: %v", path, err)
+	}
+	c.options = append(c.options, args...)
+	return c
+}
+
+// EnvironmentOptions adds the options in the JDK_JAVA_OPTIONS environment variable when Build is
+// called, before the other options, like the java launcher does. JAVA_TOOL_OPTIONS does not need to
+// be added, the JVM reads it itself in CreateJVM.
+func (c *JVMConfig) EnvironmentOptions(enabled bool) *JVMConfig {
+	c.envOptions = enabled
+	return c
+}
+
+// Output sends the JVM's diagnostic output to w instead of stderr, using the vfprintf hook. This is
+// output written by the JVM itself, like -verbose and -Xcheck:jni messages, not System.out and
+// System.err. Writes to w are serialized.
+func (c *JVMConfig) Output(w io.Writer) *JVMConfig {
+	c.hooks.output = w
+	return c
+}
+
+// OnExit calls f when the JVM exits the process, for example when Java code calls System.exit, using
+// the exit hook. The process exits with code when f returns. f runs on a JVM thread, so Go code
+// waiting on the JVM may not make progress.
+func (c *JVMConfig) OnExit(f func(code int)) *JVMConfig {
+	c.hooks.exit = f
+	return c
+}
+
+// OnAbort calls f when the JVM aborts the process after a fatal error, using the abort hook. The
+// process aborts when f returns. The process is crashing, so f should only record what it needs to,
+// for example flush logs.
+func (c *JVMConfig) OnAbort(f func()) *JVMConfig {
+	c.hooks.abort = f
+	return c
+}
+
+// Options returns the options that Build passes to the JVM, or an error if the config is not valid.
+func (c *JVMConfig) Options() ([]string, error) {
+	var options []string
+	errs := c.errs
+	if c.envOptions {
+		env := &JVMConfig{}
+		if value := os.Getenv("JDK_JAVA_OPTIONS"); value != "" {
+			args, err := parseArgs(value)
+			if err != nil {
+				env.errorf("JDK_JAVA_OPTIONS: %v", err)
+			}
+			env.Option(args...)
+		}
+		options = append(options, env.options...)
+		errs = append(env.errs, errs...)
+	}
+	options = append(options, c.options...)
+
+	if len(c.classpath) > 0 {
+		classpath, err := expandClasspath(c.classpath)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		options = append(options, "-Djava.class.path="+strings.Join(classpath, string(os.PathListSeparator)))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New("JNIGI: invalid JVM config: " + strings.Join(errs, "; "))
+	}
+	return options, nil
+}
+
+// Build returns the JVMInitArgs for CreateJVM, or an error if the config is not valid. The C memory
+// of the JVMInitArgs is freed by CreateJVM, call JVMInitArgs.Free if it is not passed to CreateJVM.
+func (c *JVMConfig) Build() (*JVMInitArgs, error) {
+	options, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	var hooks *jvmHooks
+	if c.hooks.isSet() {
+		h := c.hooks
+		hooks = &h
+		options = append(options, hooks.options()...)
+	}
+	a, err := newJVMInitArgs(c.ignoreUnrecognized, false, c.version, options, hooks)
+	if err != nil {
+		return nil, err
+	}
+	a.freeAfterCreate = true
+	return a, nil
+}
+
+// parseArgs splits s into arguments like the java launcher reads argument files. Arguments are
+// separated by white space, and can be quoted with " or '. In quotes \ escapes the next character,
+// and a \ at the end of a line continues the argument on the next line without its leading white
+// space. A # outside quotes at the start of an argument comments out the rest of the line.
+func parseArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	runes := []rune(s)
+	isSpace := func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+	}
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote != 0 {
+			switch {
+			case r == quote:
+				quote = 0
+			case r == '\\' && i+1 < len(runes):
+				i++
+				switch runes[i] {
+				case 'n':
+					arg.WriteRune('\n')
+				case 't':
+					arg.WriteRune('\t')
+				case 'r':
+					arg.WriteRune('\r')
+				case 'f':
+					arg.WriteRune('\f')
+				case '\n', '\r':
+					// continuation line, skip the line break and leading white space
+					for i+1 < len(runes) && isSpace(runes[i+1]) {
+						i++
+					}
+				default:
+					arg.WriteRune(runes[i])
+				}
+			default:
+				arg.WriteRune(r)
+			}
+			continue
+		}
+		switch {
+		case isSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case r == '#' && !inArg:
+			for i+1 < len(runes) && runes[i+1] != '\n' && runes[i+1] != '\r' {
+				i++
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// expandClasspath expands wildcard entries and adds the jars named by the Class-Path manifest
+// attribute of each jar, without duplicates.
+func expandClasspath(entries []string) ([]string, error) {
+	var classpath []string
+	seen := make(map[string]bool)
+	var add func(entry string) error
+	add = func(entry string) error {
+		if seen[entry] {
+			return nil
+		}
+		seen[entry] = true
+		classpath = append(classpath, entry)
+		if !strings.HasSuffix(strings.ToLower(entry), ".jar") {
+			return nil
+		}
+		manifestPath, err := manifestClasspath(entry)
+		if err != nil {
+			return err
+		}
+		for _, p := range manifestPath {
+			if err := add(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		if entry == "*" || strings.HasSuffix(entry, string(os.PathSeparator)+"*") || strings.HasSuffix(entry, "/*") {
+			jars, err := wildcardJars(entry[:len(entry)-1])
+			if err != nil {
+				return classpath, err
+			}
+			for _, jar := range jars {
+				if err := add(jar); err != nil {
+					return classpath, err
+				}
+			}
+			continue
+		}
+		if err := add(entry); err != nil {
+			return classpath, err
+		}
+	}
+	return classpath, nil
+}
+
+// wildcardJars returns the .jar files in dir, sorted.
+func wildcardJars(dir string) ([]string, error) {
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	files, err := ioutil.ReadDir(readDir)
+	if err != nil {
+		return nil, fmt.Errorf("class path wildcard: %v", err)
+	}
+	var jars []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(strings.ToLower(f.Name()), ".jar") {
+			jars = append(jars, dir+f.Name())
+		}
+	}
+	sort.Strings(jars)
+	return jars, nil
+}
+
+// manifestClasspath returns the paths in the Class-Path attribute of the manifest of jar, relative
+// to the directory of jar. Missing jars are ignored like the JVM does.
+func manifestClasspath(jar string) ([]string, error) {
+	r, err := zip.OpenReader(jar)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("class path jar %s: %v", jar, err)
+	}
+	defer r.Close()
+
+	var attr string
+	for _, f := range r.File {
+		if !strings.EqualFold(f.Name, "META-INF/MANIFEST.MF") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("class path jar %s: %v", jar, err)
+		}
+		attr, err = manifestAttribute(rc, "Class-Path")
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("class path jar %s: %v", jar, err)
+		}
+		break
+	}
+
+	var paths []string
+	for _, u := range strings.Fields(attr) {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "" && parsed.Scheme != "file") {
+			continue
+		}
+		p := filepath.FromSlash(parsed.Path)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(jar), p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// manifestAttribute returns the value of attribute name in the main section of a jar manifest.
+func manifestAttribute(r io.Reader, name string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	var value strings.Builder
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			// end of the main section
+			break
+		}
+		if strings.HasPrefix(line, " ") {
+			if found {
+				value.WriteString(line[1:])
+			}
+			continue
+		}
+		if found {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], name) {
+			found = true
+			value.WriteString(strings.TrimPrefix(line[i+1:], " "))
+		}
+	}
+	return value.String(), scanner.Err()
+}
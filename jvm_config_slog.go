@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+package jnigi
+
+import (
+	"bytes"
+	"log/slog"
+)
+
+// Logger sends the JVM's diagnostic output to l, each line is logged at level Info with the
+// attribute source=jvm. See Output.
+func (c *JVMConfig) Logger(l *slog.Logger) *JVMConfig {
+	return c.Output(&lineWriter{line: func(line string) {
+		l.Info(line, "source", "jvm")
+	}})
+}
+
+// lineWriter calls line with each line written to it, without the line break.
+type lineWriter struct {
+	buf  []byte
+	line func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
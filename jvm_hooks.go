@@ -0,0 +1,96 @@
+package jnigi
+
+/*
+#include<jni.h>
+*/
+import "C"
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// jvmHooks holds the Go functions called by the vfprintf, exit and abort hooks of the JVM. The JVM
+// only calls the C functions, there is one JVM per process so the hooks are global.
+type jvmHooks struct {
+	output io.Writer
+	exit   func(code int)
+	abort  func()
+}
+
+var (
+	jvmHooksMu      sync.Mutex
+	currentJVMHooks *jvmHooks
+)
+
+func (h *jvmHooks) isSet() bool {
+	return h.output != nil || h.exit != nil || h.abort != nil
+}
+
+// options returns the JVM options for the hooks that are set.
+func (h *jvmHooks) options() []string {
+	var options []string
+	if h.output != nil {
+		options = append(options, "vfprintf")
+	}
+	if h.exit != nil {
+		options = append(options, "exit")
+	}
+	if h.abort != nil {
+		options = append(options, "abort")
+	}
+	return options
+}
+
+// extraInfo returns the C function for option if it is a hook that is set.
+func (h *jvmHooks) extraInfo(option string) unsafe.Pointer {
+	for _, o := range h.options() {
+		if o == option {
+			return jvmHookFunc(option)
+		}
+	}
+	return nil
+}
+
+// setJVMHooks installs h, called by CreateJVM.
+func setJVMHooks(h *jvmHooks) {
+	jvmHooksMu.Lock()
+	defer jvmHooksMu.Unlock()
+	currentJVMHooks = h
+}
+
+func getJVMHooks() *jvmHooks {
+	jvmHooksMu.Lock()
+	defer jvmHooksMu.Unlock()
+	return currentJVMHooks
+}
+
+// outputMu serializes writes to the output hook, the JVM prints from many threads.
+var outputMu sync.Mutex
+
+//export go_jvm_vfprintf
+func go_jvm_vfprintf(msg *C.char, n C.int) {
+	h := getJVMHooks()
+	if h == nil || h.output == nil {
+		return
+	}
+	data := C.GoBytes(unsafe.Pointer(msg), n)
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	h.output.Write(data)
+}
+
+//export go_jvm_exit
+func go_jvm_exit(code C.jint) {
+	if h := getJVMHooks(); h != nil && h.exit != nil {
+		h.exit(int(code))
+	}
+}
+
+//export go_jvm_abort
+func go_jvm_abort() {
+	if h := getJVMHooks(); h != nil && h.abort != nil {
+		h.abort()
+	}
+}
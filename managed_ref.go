@@ -0,0 +1,226 @@
+package jnigi
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ManagedRef holds a global reference that is deleted automatically once the ManagedRef becomes
+// unreachable, so it does not need DeleteGlobalRef. Go runs cleanups on arbitrary goroutines, so
+// the deletes are queued to a daemon thread attached to the JVM, named jnigi-ref-cleaner.
+//
+// The *ObjectRef returned by Ref is only valid while the ManagedRef is reachable, use
+// runtime.KeepAlive(m) after the last use of the reference if m is not used later.
+type ManagedRef struct {
+	ref     *ObjectRef
+	cleaner *refCleaner
+	cleanup managedCleanup
+}
+
+// ManagedRefStats holds the counts of managed references of a JVM, see JVM.ManagedRefStats.
+type ManagedRefStats struct {
+	// Live is the number of managed references not released yet.
+	Live int64
+	// Pending is the number of unreachable managed references waiting to be deleted.
+	Pending int64
+	// Released is the number of managed references deleted, by cleanup or by Release.
+	Released uint64
+}
+
+// NewManagedRef creates a new global reference to o held by a ManagedRef.
+func (j *Env) NewManagedRef(o *ObjectRef) (*ManagedRef, error) {
+	if o.IsNil() {
+		return nil, errors.New("JNIGI: NewManagedRef of nil object")
+	}
+	c, err := j.refCleaner()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ManagedRef{ref: j.NewGlobalRef(o), cleaner: c}
+	atomic.AddInt64(&c.live, 1)
+	addManagedCleanup(m, c, m.ref.jobject)
+	return m, nil
+}
+
+// Ref returns the global reference held by m. It must not be deleted, use Release.
+func (m *ManagedRef) Ref() *ObjectRef {
+	return m.ref
+}
+
+// Release deletes the global reference held by m now, instead of when m becomes unreachable.
+func (m *ManagedRef) Release(env *Env) {
+	if m.ref.IsNil() {
+		return
+	}
+	m.stopCleanup()
+	env.DeleteGlobalRef(m.ref)
+	atomic.AddInt64(&m.cleaner.live, -1)
+	atomic.AddUint64(&m.cleaner.released, 1)
+}
+
+// refCleaner deletes the global references of unreachable ManagedRefs of a JVM.
+type refCleaner struct {
+	queue chan jobject
+	stop  chan struct{}
+	done  chan struct{}
+
+	// overflow holds the references queued while queue is full, so enqueue never blocks. wake is
+	// signalled when references are added to it.
+	mu       sync.Mutex
+	overflow []jobject
+	wake     chan struct{}
+
+	live     int64
+	pending  int64
+	released uint64
+}
+
+// refCleaners holds the refCleaner of each JVM by JavaVM pointer.
+var (
+	refCleanersMu sync.Mutex
+	refCleaners   = make(map[unsafe.Pointer]*refCleaner)
+)
+
+// refCleaner returns the refCleaner of the JVM of j, starting it the first time.
+func (j *Env) refCleaner() (*refCleaner, error) {
+	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
+	if getJavaVM(j.jniEnv, p) < 0 {
+		return nil, errors.New("Couldn't get JVM")
+	}
+	jvm := newJVM(*(*unsafe.Pointer)(p), nil)
+
+	refCleanersMu.Lock()
+	defer refCleanersMu.Unlock()
+	if c, ok := refCleaners[jvm.javaVM]; ok {
+		return c, nil
+	}
+	c := &refCleaner{
+		queue: make(chan jobject, 1024),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		wake:  make(chan struct{}, 1),
+	}
+	started := make(chan error)
+	go c.run(jvm, started)
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	refCleaners[jvm.javaVM] = c
+	return c, nil
+}
+
+func (c *refCleaner) run(jvm *JVM, started chan<- error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	env, err := jvm.AttachCurrentThreadWithOptions("jnigi-ref-cleaner", nil, true)
+	started <- err
+	if err != nil {
+		return
+	}
+	defer close(c.done)
+	defer jvm.DetachCurrentThread(env)
+
+	for {
+		select {
+		case obj := <-c.queue:
+			c.delete(env, obj)
+		case <-c.wake:
+			c.deleteOverflow(env)
+		case <-c.stop:
+			for {
+				select {
+				case obj := <-c.queue:
+					c.delete(env, obj)
+				default:
+					c.deleteOverflow(env)
+					return
+				}
+			}
+		}
+	}
+}
+
+// deleteOverflow deletes the references in the overflow list.
+func (c *refCleaner) deleteOverflow(env *Env) {
+	c.mu.Lock()
+	objs := c.overflow
+	c.overflow = nil
+	c.mu.Unlock()
+	for _, obj := range objs {
+		c.delete(env, obj)
+	}
+}
+
+func (c *refCleaner) delete(env *Env, obj jobject) {
+	deleteGlobalRef(env.jniEnv, obj)
+	env.counters.track(GlobalRefType, -1)
+	atomic.AddInt64(&c.pending, -1)
+	atomic.AddInt64(&c.live, -1)
+	atomic.AddUint64(&c.released, 1)
+}
+
+// enqueue is called by the cleanup of a ManagedRef to queue its global reference for deletion. It
+// does not block, cleanups and finalizers must not wait for the cleaner thread.
+func (c *refCleaner) enqueue(obj jobject) {
+	atomic.AddInt64(&c.pending, 1)
+	select {
+	case <-c.stop:
+		// the JVM is destroyed, the reference is gone with it
+		atomic.AddInt64(&c.pending, -1)
+		return
+	default:
+	}
+	select {
+	case c.queue <- obj:
+		return
+	default:
+	}
+
+	c.mu.Lock()
+	select {
+	case <-c.stop:
+		c.mu.Unlock()
+		atomic.AddInt64(&c.pending, -1)
+		return
+	default:
+	}
+	c.overflow = append(c.overflow, obj)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ManagedRefStats returns the counts of managed references of j.
+func (j *JVM) ManagedRefStats() ManagedRefStats {
+	refCleanersMu.Lock()
+	c, ok := refCleaners[j.javaVM]
+	refCleanersMu.Unlock()
+	if !ok {
+		return ManagedRefStats{}
+	}
+	return ManagedRefStats{
+		Live:     atomic.LoadInt64(&c.live),
+		Pending:  atomic.LoadInt64(&c.pending),
+		Released: atomic.LoadUint64(&c.released),
+	}
+}
+
+// stopRefCleaner deletes the queued references and detaches the jnigi-ref-cleaner thread.
+func (j *JVM) stopRefCleaner() {
+	refCleanersMu.Lock()
+	c, ok := refCleaners[j.javaVM]
+	delete(refCleaners, j.javaVM)
+	refCleanersMu.Unlock()
+	if ok {
+		close(c.stop)
+		<-c.done
+	}
+}
@@ -0,0 +1,17 @@
+//go:build go1.24
+// +build go1.24
+
+package jnigi
+
+import "runtime"
+
+type managedCleanup = runtime.Cleanup
+
+// addManagedCleanup queues obj for deletion by c once m is unreachable.
+func addManagedCleanup(m *ManagedRef, c *refCleaner, obj jobject) {
+	m.cleanup = runtime.AddCleanup(m, c.enqueue, obj)
+}
+
+func (m *ManagedRef) stopCleanup() {
+	m.cleanup.Stop()
+}
@@ -0,0 +1,20 @@
+//go:build !go1.24
+// +build !go1.24
+
+package jnigi
+
+import "runtime"
+
+// managedCleanup is not needed with a finalizer, runtime.AddCleanup needs Go 1.24.
+type managedCleanup struct{}
+
+// addManagedCleanup queues obj for deletion by c once m is unreachable.
+func addManagedCleanup(m *ManagedRef, c *refCleaner, obj jobject) {
+	runtime.SetFinalizer(m, func(*ManagedRef) {
+		c.enqueue(obj)
+	})
+}
+
+func (m *ManagedRef) stopCleanup() {
+	runtime.SetFinalizer(m, nil)
+}
@@ -0,0 +1,351 @@
+package jnigi
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Module holds a local reference to a java.lang.Module, see Env.GetModule and Env.FindModule.
+type Module struct {
+	ref *ObjectRef
+}
+
+// ModuleDescriptor describes a named module, see Module.Descriptor.
+type ModuleDescriptor struct {
+	Name      string
+	Open      bool
+	Automatic bool
+	// Packages are all the packages of the module, sorted.
+	Packages []string
+	// Exports and Opens are the exported and open packages, sorted by package.
+	Exports []ModulePackage
+	Opens   []ModulePackage
+}
+
+// ModulePackage is a package exported or opened by a module.
+type ModulePackage struct {
+	// Package is the package name, for example java.lang.
+	Package string
+	// Targets are the modules the package is exported or opened to, empty if it is to all modules.
+	Targets []string
+}
+
+// GetModule calls JNI GetModule, it returns the module class is a member of. ErrUnsupported is
+// returned if FeatureGetModule is not supported.
+func (j *Env) GetModule(class *Class) (*Module, error) {
+	if !j.Supports(FeatureGetModule) {
+		return nil, ErrUnsupported
+	}
+	module := getModule(j.jniEnv, class.class)
+	if module == 0 {
+		return nil, j.handleException()
+	}
+	return &Module{j.newLocalRef(module, "java/lang/Module", false)}, nil
+}
+
+// FindModule returns the module name of the boot layer, or nil if there is no such module.
+func (j *Env) FindModule(name string) (*Module, error) {
+	layer := NewObjectRef("java/lang/ModuleLayer")
+	if err := j.CallStaticMethod("java/lang/ModuleLayer", "boot", layer); err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(layer)
+
+	nameStr, err := j.NewObject("java/lang/String", []byte(name), j.GetUTF8String())
+	if err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(nameStr)
+
+	j.PrecalculateSignature("(Ljava/lang/String;)Ljava/util/Optional;")
+	opt := NewObjectRef("java/util/Optional")
+	if err := layer.CallMethod(j, "findModule", opt, nameStr); err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(opt)
+
+	j.PrecalculateSignature("(Ljava/lang/Object;)Ljava/lang/Object;")
+	module := NewObjectRef("java/lang/Object")
+	if err := opt.CallMethod(j, "orElse", module, NewObjectRef("java/lang/Object")); err != nil {
+		return nil, err
+	}
+	if module.IsNil() {
+		return nil, nil
+	}
+	return &Module{module.Cast("java/lang/Module")}, nil
+}
+
+// GetObject returns the module as a *ObjectRef of class java/lang/Module. It is a local reference,
+// delete it with DeleteLocalRef when the Module is no longer used.
+func (m *Module) GetObject() *ObjectRef {
+	return m.ref
+}
+
+// checkRefs checks the references of m and other, which can be nil, can be used in env by op.
+func (m *Module) checkRefs(env *Env, op string, other *Module) error {
+	if err := env.checkRef(op, m.ref); err != nil {
+		return err
+	}
+	if other != nil {
+		return env.checkRef(op, other.ref)
+	}
+	return nil
+}
+
+// Name returns the name of the module, or "" if it is an unnamed module.
+func (m *Module) Name(env *Env) (string, error) {
+	if err := m.checkRefs(env, "Module.Name", nil); err != nil {
+		return "", err
+	}
+	var name string
+	err := callStringMethodAndAssign(env, m.ref, "getName", func(s string) {
+		name = s
+	})
+	return name, err
+}
+
+// IsNamed returns true if m is a named module.
+func (m *Module) IsNamed(env *Env) (bool, error) {
+	if err := m.checkRefs(env, "Module.IsNamed", nil); err != nil {
+		return false, err
+	}
+	var named bool
+	if err := m.ref.CallMethod(env, "isNamed", &named); err != nil {
+		return false, err
+	}
+	return named, nil
+}
+
+// Descriptor returns the descriptor of the module, or nil if it is an unnamed module.
+func (m *Module) Descriptor(env *Env) (*ModuleDescriptor, error) {
+	if err := m.checkRefs(env, "Module.Descriptor", nil); err != nil {
+		return nil, err
+	}
+	env.PrecalculateSignature("()Ljava/lang/module/ModuleDescriptor;")
+	descRef := NewObjectRef("java/lang/module/ModuleDescriptor")
+	if err := m.ref.CallMethod(env, "getDescriptor", descRef); err != nil {
+		return nil, err
+	}
+	if descRef.IsNil() {
+		return nil, nil
+	}
+	defer env.DeleteLocalRef(descRef)
+
+	desc := &ModuleDescriptor{}
+	err := callStringMethodAndAssign(env, descRef, "name", func(s string) {
+		desc.Name = s
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := descRef.CallMethod(env, "isOpen", &desc.Open); err != nil {
+		return nil, err
+	}
+	if err := descRef.CallMethod(env, "isAutomatic", &desc.Automatic); err != nil {
+		return nil, err
+	}
+	if desc.Packages, err = env.callStringSetMethod(descRef, "packages"); err != nil {
+		return nil, err
+	}
+	if desc.Exports, err = env.callModulePackages(descRef, "exports", "java/lang/module/ModuleDescriptor$Exports"); err != nil {
+		return nil, err
+	}
+	if desc.Opens, err = env.callModulePackages(descRef, "opens", "java/lang/module/ModuleDescriptor$Opens"); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// IsOpen returns true if package pkg of m is open to module other, or to all modules if other is nil.
+func (m *Module) IsOpen(env *Env, pkg string, other *Module) (bool, error) {
+	return m.callPackageMethod(env, "Module.IsOpen", "isOpen", pkg, other)
+}
+
+// IsExported returns true if package pkg of m is exported to module other, or to all modules if other
+// is nil.
+func (m *Module) IsExported(env *Env, pkg string, other *Module) (bool, error) {
+	return m.callPackageMethod(env, "Module.IsExported", "isExported", pkg, other)
+}
+
+// CanRead returns true if m reads module other.
+func (m *Module) CanRead(env *Env, other *Module) (bool, error) {
+	if err := m.checkRefs(env, "Module.CanRead", other); err != nil {
+		return false, err
+	}
+	env.PrecalculateSignature("(Ljava/lang/Module;)Z")
+	var ret bool
+	if err := m.ref.CallMethod(env, "canRead", &ret, other.ref); err != nil {
+		return false, err
+	}
+	return ret, nil
+}
+
+func (m *Module) callPackageMethod(env *Env, op, method, pkg string, other *Module) (bool, error) {
+	if err := m.checkRefs(env, op, other); err != nil {
+		return false, err
+	}
+	pkgStr, err := env.NewObject("java/lang/String", []byte(pkg), env.GetUTF8String())
+	if err != nil {
+		return false, err
+	}
+	defer env.DeleteLocalRef(pkgStr)
+
+	var ret bool
+	if other == nil {
+		env.PrecalculateSignature("(Ljava/lang/String;)Z")
+		err = m.ref.CallMethod(env, method, &ret, pkgStr)
+	} else {
+		env.PrecalculateSignature("(Ljava/lang/String;Ljava/lang/Module;)Z")
+		err = m.ref.CallMethod(env, method, &ret, pkgStr, other.ref)
+	}
+	return ret, err
+}
+
+// callStringSetMethod calls method on obj which returns a java.util.Set of String, and returns the
+// strings sorted.
+func (j *Env) callStringSetMethod(obj *ObjectRef, method string) ([]string, error) {
+	var strs []string
+	err := j.forEachSetElement(obj, method, func(elem *ObjectRef) error {
+		strs = append(strs, stringFromJavaLangString(j, elem.Cast("java/lang/String")))
+		return nil
+	})
+	sort.Strings(strs)
+	return strs, err
+}
+
+// callModulePackages calls method on a ModuleDescriptor which returns a java.util.Set of
+// ModuleDescriptor.Exports or ModuleDescriptor.Opens of class elemClass.
+func (j *Env) callModulePackages(desc *ObjectRef, method, elemClass string) ([]ModulePackage, error) {
+	var pkgs []ModulePackage
+	err := j.forEachSetElement(desc, method, func(elem *ObjectRef) error {
+		elem = elem.Cast(elemClass)
+		var pkg ModulePackage
+		err := callStringMethodAndAssign(j, elem, "source", func(s string) {
+			pkg.Package = s
+		})
+		if err != nil {
+			return err
+		}
+		if pkg.Targets, err = j.callStringSetMethod(elem, "targets"); err != nil {
+			return err
+		}
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+	sort.Slice(pkgs, func(a, b int) bool {
+		return pkgs[a].Package < pkgs[b].Package
+	})
+	return pkgs, err
+}
+
+// forEachSetElement calls method on obj which returns a java.util.Set, and calls f with each element.
+func (j *Env) forEachSetElement(obj *ObjectRef, method string, f func(elem *ObjectRef) error) error {
+	j.PrecalculateSignature("()Ljava/util/Set;")
+	set := NewObjectRef("java/util/Set")
+	if err := obj.CallMethod(j, method, set); err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(set)
+
+	j.PrecalculateSignature("()[Ljava/lang/Object;")
+	array := NewObjectArrayRef("java/lang/Object")
+	if err := set.CallMethod(j, "toArray", array); err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(array)
+
+	return j.forEachElement(array, f)
+}
+
+// The JVM does not check access for JNI calls, so the internal jdk.internal.module.Modules class is
+// used to change modules at runtime. java.lang.Module methods like addOpens only work when called
+// from code in the module itself.
+
+// AddOpens opens package pkg of module m to module other at runtime, or to all unnamed modules if
+// other is nil. This allows deep reflection on the package, like the --add-opens option.
+func (j *Env) AddOpens(m *Module, pkg string, other *Module) error {
+	return j.callModulesPackageMethod("AddOpens", "addOpens", m, pkg, other)
+}
+
+// AddExports exports package pkg of module m to module other at runtime, or to all unnamed modules if
+// other is nil, like the --add-exports option.
+func (j *Env) AddExports(m *Module, pkg string, other *Module) error {
+	return j.callModulesPackageMethod("AddExports", "addExports", m, pkg, other)
+}
+
+// AddReads makes module m read module other at runtime, or all unnamed modules if other is nil, like
+// the --add-reads option.
+func (j *Env) AddReads(m *Module, other *Module) error {
+	if m == nil {
+		return errors.New("JNIGI: AddReads of nil module")
+	}
+	if err := m.checkRefs(j, "AddReads", other); err != nil {
+		return err
+	}
+	if other == nil {
+		j.PrecalculateSignature("(Ljava/lang/Module;)V")
+		return j.CallStaticMethod("jdk/internal/module/Modules", "addReadsAllUnnamed", nil, m.ref)
+	}
+	j.PrecalculateSignature("(Ljava/lang/Module;Ljava/lang/Module;)V")
+	return j.CallStaticMethod("jdk/internal/module/Modules", "addReads", nil, m.ref, other.ref)
+}
+
+func (j *Env) callModulesPackageMethod(op, method string, m *Module, pkg string, other *Module) error {
+	if m == nil {
+		return errors.New("JNIGI: " + method + " of nil module")
+	}
+	if err := m.checkRefs(j, op, other); err != nil {
+		return err
+	}
+	pkgStr, err := j.NewObject("java/lang/String", []byte(pkg), j.GetUTF8String())
+	if err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(pkgStr)
+
+	if other == nil {
+		j.PrecalculateSignature("(Ljava/lang/Module;Ljava/lang/String;)V")
+		return j.CallStaticMethod("jdk/internal/module/Modules", method+"ToAllUnnamed", nil, m.ref, pkgStr)
+	}
+	j.PrecalculateSignature("(Ljava/lang/Module;Ljava/lang/String;Ljava/lang/Module;)V")
+	return j.CallStaticMethod("jdk/internal/module/Modules", method, nil, m.ref, pkgStr, other.ref)
+}
+
+// AddOpensOption returns the JVM option to open package pkg of module to the target modules, or to
+// all unnamed modules if there are no targets. For example AddOpensOption("java.base", "java.lang")
+// returns "--add-opens=java.base/java.lang=ALL-UNNAMED".
+func AddOpensOption(module, pkg string, targets ...string) string {
+	return "--add-opens=" + module + "/" + pkg + "=" + moduleTargets(targets)
+}
+
+// AddExportsOption returns the JVM option to export package pkg of module to the target modules, or
+// to all unnamed modules if there are no targets.
+func AddExportsOption(module, pkg string, targets ...string) string {
+	return "--add-exports=" + module + "/" + pkg + "=" + moduleTargets(targets)
+}
+
+// AddReadsOption returns the JVM option to make module read the target modules, or all unnamed
+// modules if there are no targets.
+func AddReadsOption(module string, targets ...string) string {
+	return "--add-reads=" + module + "=" + moduleTargets(targets)
+}
+
+// AddModulesOption returns the JVM option to resolve modules in addition to the initial module.
+func AddModulesOption(modules ...string) string {
+	return "--add-modules=" + strings.Join(modules, ",")
+}
+
+// ModulePathOption returns the JVM option to set the module path to paths, which can be directories
+// of modules or modular jar files.
+func ModulePathOption(paths ...string) string {
+	return "--module-path=" + strings.Join(paths, string(os.PathListSeparator))
+}
+
+func moduleTargets(targets []string) string {
+	if len(targets) == 0 {
+		return "ALL-UNNAMED"
+	}
+	return strings.Join(targets, ",")
+}
@@ -0,0 +1,128 @@
+package jnigi
+
+/*
+#include <stdint.h>
+#ifdef _WIN32
+#include <windows.h>
+static uintptr_t currentThreadID() {
+	return (uintptr_t)GetCurrentThreadId();
+}
+#else
+#include <pthread.h>
+static uintptr_t currentThreadID() {
+	return (uintptr_t)pthread_self();
+}
+#endif
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"time"
+)
+
+// errMonitorThread is returned when a monitor is used on a different OS thread than the one the Env
+// was created or attached on, JNI Envs are only valid on their own thread.
+var errMonitorThread = errors.New("JNIGI: monitor used on a different OS thread than the Env's, call runtime.LockOSThread()")
+
+// osThreadID returns the ID of the current OS thread.
+func osThreadID() uintptr {
+	return uintptr(C.currentThreadID())
+}
+
+// checkThread returns errMonitorThread if the goroutine is not on the OS thread of j.
+func (j *Env) checkThread() error {
+	if j.thread != 0 && j.thread != osThreadID() {
+		return errMonitorThread
+	}
+	return nil
+}
+
+// MonitorEnter calls JNI MonitorEnter, it enters the monitor of obj like a Java synchronized block.
+// Every MonitorEnter must be matched by MonitorExit on the same OS thread, so runtime.LockOSThread()
+// must be called first. Synchronized does this for you. An error is returned, without calling JNI,
+// if the goroutine is not on the OS thread j was created or attached on.
+func (j *Env) MonitorEnter(obj *ObjectRef) error {
+	if err := j.checkRef("MonitorEnter", obj); err != nil {
+		return err
+	}
+	if obj.IsNil() {
+		return errors.New("JNIGI: MonitorEnter on nil object")
+	}
+	if err := j.checkThread(); err != nil {
+		return err
+	}
+	if monitorEnter(j.jniEnv, obj.jobject) < 0 {
+		return j.handleException()
+	}
+	return nil
+}
+
+// MonitorExit calls JNI MonitorExit, it exits the monitor of obj entered with MonitorEnter. An error
+// is returned, without calling JNI, if the goroutine is not on the OS thread j was created or
+// attached on.
+func (j *Env) MonitorExit(obj *ObjectRef) error {
+	if err := j.checkRef("MonitorExit", obj); err != nil {
+		return err
+	}
+	if obj.IsNil() {
+		return errors.New("JNIGI: MonitorExit on nil object")
+	}
+	if err := j.checkThread(); err != nil {
+		return err
+	}
+	if monitorExit(j.jniEnv, obj.jobject) < 0 {
+		return j.handleException()
+	}
+	return nil
+}
+
+// Synchronized calls f holding the monitor of obj, like a Java synchronized block. The goroutine is
+// locked to its OS thread while f runs, and the monitor is exited when f returns or panics. An error
+// is returned, without calling f, if the goroutine is not on the OS thread j was created or attached
+// on.
+func (j *Env) Synchronized(obj *ObjectRef, f func() error) (err error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := j.checkThread(); err != nil {
+		return err
+	}
+	if err := j.MonitorEnter(obj); err != nil {
+		return err
+	}
+	defer func() {
+		if exitErr := j.MonitorExit(obj); exitErr != nil && err == nil {
+			err = exitErr
+		}
+	}()
+	return f()
+}
+
+// Wait calls Object.wait on obj, it waits until obj is notified or timeout has passed. A timeout of
+// 0 waits until obj is notified. The monitor of obj must be held, see Synchronized.
+func (j *Env) Wait(obj *ObjectRef, timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("JNIGI: Wait with negative timeout")
+	}
+	millis := int64(timeout / time.Millisecond)
+	nanos := int32(timeout % time.Millisecond)
+	if millis == 0 && nanos > 0 {
+		// Object.wait(0, n) waits forever on some JVMs, round up to a millisecond
+		millis, nanos = 1, 0
+	}
+	return obj.CallNonvirtualMethod(j, "java/lang/Object", "wait", nil, millis, nanos)
+}
+
+// Notify calls Object.notify on obj, waking up a thread waiting on obj. The monitor of obj must be
+// held, see Synchronized.
+func (j *Env) Notify(obj *ObjectRef) error {
+	return obj.CallNonvirtualMethod(j, "java/lang/Object", "notify", nil)
+}
+
+// NotifyAll calls Object.notifyAll on obj, waking up all threads waiting on obj. The monitor of obj
+// must be held, see Synchronized.
+func (j *Env) NotifyAll(obj *ObjectRef) error {
+	return obj.CallNonvirtualMethod(j, "java/lang/Object", "notifyAll", nil)
+}
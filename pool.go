@@ -0,0 +1,235 @@
+package jnigi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrPoolClosed is returned by Pool.Do after the pool is closed.
+var ErrPoolClosed = errors.New("JNIGI: pool is closed")
+
+// Pool runs functions on a fixed number of OS threads that are locked and attached to the JVM, so
+// any goroutine can call Java without LockOSThread, AttachCurrentThread and DetachCurrentThread.
+// Each thread has its own Env which is reused for every function run on it.
+type Pool struct {
+	jvm       *JVM
+	size      int
+	work      chan *poolTask
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	queued    int64
+	running   int64
+	completed uint64
+}
+
+// PoolStats holds the state of a Pool, see Pool.Stats.
+type PoolStats struct {
+	// Threads is the number of attached OS threads.
+	Threads int
+	// Queued is the number of calls to Do waiting for a thread.
+	Queued int
+	// Running is the number of functions currently running.
+	Running int
+	// Completed is the number of functions run.
+	Completed uint64
+}
+
+// PoolPanic is the value Pool.Do panics with when the function it runs panics.
+type PoolPanic struct {
+	// Value is the value the function panicked with.
+	Value interface{}
+	// Stack is the stack trace of the pool's thread when the function panicked.
+	Stack []byte
+}
+
+func (p *PoolPanic) Error() string {
+	return fmt.Sprintf("JNIGI: panic in pool: %v\n\n%s", p.Value, p.Stack)
+}
+
+type poolTask struct {
+	f    func(env *Env) error
+	err  error
+	pnc  interface{}
+	done chan struct{}
+}
+
+// NewPool starts n OS threads, locks them and attaches them to the JVM, and returns a Pool to run
+// functions on them. The Java threads are named jnigi-pool-0 to jnigi-pool-n-1. The threads are
+// detached by Close.
+func (j *JVM) NewPool(n int) (*Pool, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("JNIGI: pool size %d must be at least 1", n)
+	}
+
+	p := &Pool{
+		jvm:    j,
+		size:   n,
+		work:   make(chan *poolTask),
+		closed: make(chan struct{}),
+	}
+	started := make(chan error, n)
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go p.worker(fmt.Sprintf("jnigi-pool-%d", i), started)
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-started; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pool) worker(name string, started chan<- error) {
+	defer p.wg.Done()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	env, err := p.jvm.AttachCurrentThreadWithOptions(name, nil, false)
+	started <- err
+	if err != nil {
+		return
+	}
+	defer p.jvm.DetachCurrentThread(env)
+
+	for {
+		select {
+		case task := <-p.work:
+			atomic.AddInt64(&p.queued, -1)
+			atomic.AddInt64(&p.running, 1)
+			p.run(env, task)
+			atomic.AddInt64(&p.running, -1)
+			atomic.AddUint64(&p.completed, 1)
+			close(task.done)
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// run runs task in a local frame, so local references created by it are deleted when it returns.
+// The settings of env are restored so the next task starts with a clean Env.
+func (p *Pool) run(env *Env, task *poolTask) {
+	if err := env.PushLocalFrame(16); err != nil {
+		task.err = err
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			task.pnc = &PoolPanic{Value: r, Stack: debug.Stack()}
+		}
+		if env.exceptionCheck() {
+			// An exception left by the task is its error, unless it already failed.
+			err := env.handleException()
+			if task.err == nil && task.pnc == nil {
+				task.err = err
+			}
+			if env.exceptionCheck() {
+				exceptionClear(env.jniEnv)
+			}
+		}
+		env.PopLocalFrame(nil)
+		env.preCalcSig = ""
+		env.addtlClassLoader = p.jvm.classLoader()
+		env.ExceptionHandler = nil
+		env.autoDeleteConverted = false
+	}()
+	task.err = task.f(env)
+}
+
+// Do runs f on one of the pool's threads and returns its error. If all threads are busy Do waits
+// until one is free, or until ctx is done in which case ctx.Err() is returned and f is not run.
+// Once f is running Do waits for it to return.
+//
+// Local references created in f are deleted when f returns, use NewGlobalRef to keep an object. If
+// f panics, Do panics in the calling goroutine with a *PoolPanic holding the value and the stack of
+// the panic. If f returns nil but leaves a Java exception pending, the exception is handled with the
+// Env's ExceptionHandler and returned as the error.
+func (p *Pool) Do(ctx context.Context, f func(env *Env) error) error {
+	task := &poolTask{f: f, done: make(chan struct{})}
+
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case p.work <- task:
+	case <-ctx.Done():
+		atomic.AddInt64(&p.queued, -1)
+		return ctx.Err()
+	case <-p.closed:
+		atomic.AddInt64(&p.queued, -1)
+		return ErrPoolClosed
+	}
+
+	<-task.done
+	if task.pnc != nil {
+		panic(task.pnc)
+	}
+	return task.err
+}
+
+// Stats returns the number of threads and the number of queued, running and completed functions.
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Threads:   p.size,
+		Queued:    int(atomic.LoadInt64(&p.queued)),
+		Running:   int(atomic.LoadInt64(&p.running)),
+		Completed: atomic.LoadUint64(&p.completed),
+	}
+}
+
+// Close waits for running functions to return, then detaches and unlocks the pool's threads. Calls
+// to Do after Close return ErrPoolClosed. Close must not be called from a function run by the pool.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	p.wg.Wait()
+}
+
+// defaultPools holds the pools used by JVM.Do by JavaVM pointer.
+var (
+	defaultPoolsMu sync.Mutex
+	defaultPools   = make(map[unsafe.Pointer]*Pool)
+)
+
+// Do runs f on a pool of attached OS threads shared by all callers of Do, see Pool.Do. The pool has
+// runtime.GOMAXPROCS(0) threads and is started by the first call, it is closed by Destroy.
+func (j *JVM) Do(ctx context.Context, f func(env *Env) error) error {
+	defaultPoolsMu.Lock()
+	p, ok := defaultPools[j.javaVM]
+	if !ok {
+		var err error
+		p, err = j.NewPool(runtime.GOMAXPROCS(0))
+		if err != nil {
+			defaultPoolsMu.Unlock()
+			return err
+		}
+		defaultPools[j.javaVM] = p
+	}
+	defaultPoolsMu.Unlock()
+
+	return p.Do(ctx, f)
+}
+
+// closeDefaultPool closes the pool used by Do, if it was started.
+func (j *JVM) closeDefaultPool() {
+	defaultPoolsMu.Lock()
+	p, ok := defaultPools[j.javaVM]
+	delete(defaultPools, j.javaVM)
+	defaultPoolsMu.Unlock()
+	if ok {
+		p.Close()
+	}
+}
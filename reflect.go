@@ -0,0 +1,188 @@
+package jnigi
+
+import (
+	"errors"
+)
+
+// declaringClass returns a new global reference to the class declaring member, a reflected method,
+// constructor or field.
+func (j *Env) declaringClass(member *ObjectRef) (jclass, error) {
+	j.PrecalculateSignature("()Ljava/lang/Class;")
+	classRef := NewObjectRef("java/lang/Class")
+	if err := member.CallMethod(j, "getDeclaringClass", classRef); err != nil {
+		return 0, err
+	}
+	defer j.DeleteLocalRef(classRef)
+	return jclass(newGlobalRef(j.jniEnv, classRef.jobject)), nil
+}
+
+// reflectedParamClasses returns global references to the parameter classes of member, a
+// java.lang.reflect.Executable, for the object parameters in params, see objectTypeClass. The
+// classes are taken from member so they need not be visible to FindClass.
+func (j *Env) reflectedParamClasses(member *ObjectRef, params []string) ([]jclass, error) {
+	j.PrecalculateSignature("()[Ljava/lang/Class;")
+	array := NewObjectArrayRef("java/lang/Class")
+	if err := member.CallMethod(j, "getParameterTypes", array); err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(array)
+
+	classes := make([]jclass, 0, len(params))
+	if err := j.forEachElement(array, func(param *ObjectRef) error {
+		if len(classes) == len(params) {
+			return errors.New("JNIGI: reflected parameter types do not match the signature")
+		}
+		var class jclass
+		if _, ok := objectTypeClassName(params[len(classes)]); ok {
+			class = jclass(newGlobalRef(j.jniEnv, param.jobject))
+		}
+		classes = append(classes, class)
+		return nil
+	}); err != nil {
+		deleteClassRefs(j.jniEnv, classes)
+		return nil, err
+	}
+	return classes, nil
+}
+
+// reflectedFieldClass returns a global reference to the type of member, a java.lang.reflect.Field
+// with type signature sig, or 0 if any value of the type matches, see objectTypeClass.
+func (j *Env) reflectedFieldClass(member *ObjectRef, sig string) (jclass, error) {
+	if _, ok := objectTypeClassName(sig); !ok {
+		return 0, nil
+	}
+	j.PrecalculateSignature("()Ljava/lang/Class;")
+	classRef := NewObjectRef("java/lang/Class")
+	if err := member.CallMethod(j, "getType", classRef); err != nil {
+		return 0, err
+	}
+	defer j.DeleteLocalRef(classRef)
+	return jclass(newGlobalRef(j.jniEnv, classRef.jobject)), nil
+}
+
+// FromReflectedMethod calls JNI FromReflectedMethod and returns a handle to the method or
+// constructor method, a java.lang.reflect.Method or java.lang.reflect.Constructor object.
+// Return values of calls made with the handle are converted according to the reflected return type.
+func (j *Env) FromReflectedMethod(method *ObjectRef) (*Method, error) {
+	if method.IsNil() {
+		return nil, errors.New("JNIGI: FromReflectedMethod with nil method")
+	}
+
+	isCtor, err := method.IsInstanceOf(j, "java/lang/reflect/Constructor")
+	if err != nil {
+		return nil, err
+	}
+	var member *ObjectRef
+	if isCtor {
+		member = method.Cast("java/lang/reflect/Constructor")
+	} else {
+		member = method.Cast("java/lang/reflect/Method")
+	}
+
+	desc, err := j.describeExecutable(member, isCtor)
+	if err != nil {
+		return nil, err
+	}
+	params, rType, rClassName, err := parseMethodSignature(desc.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	mid := fromReflectedMethod(j.jniEnv, member.jobject)
+	if mid == 0 {
+		return nil, j.handleException()
+	}
+
+	paramClasses, err := j.reflectedParamClasses(member, params)
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := j.declaringClass(member)
+	if err != nil {
+		deleteClassRefs(j.jniEnv, paramClasses)
+		return nil, err
+	}
+
+	return &Method{
+		class:        class,
+		className:    desc.DeclaringClass,
+		name:         desc.Name,
+		sig:          desc.Signature,
+		mid:          mid,
+		static:       desc.Modifiers.Is(ModStatic),
+		ctor:         isCtor,
+		params:       paramTypes(params),
+		paramClasses: paramClasses,
+		rType:        rType,
+		rClassName:   rClassName,
+	}, nil
+}
+
+// FromReflectedField calls JNI FromReflectedField and returns a handle to the field field, a
+// java.lang.reflect.Field object.
+func (j *Env) FromReflectedField(field *ObjectRef) (*Field, error) {
+	if field.IsNil() {
+		return nil, errors.New("JNIGI: FromReflectedField with nil field")
+	}
+	member := field.Cast("java/lang/reflect/Field")
+
+	desc, err := j.describeField(member)
+	if err != nil {
+		return nil, err
+	}
+	fType, fClassName, _, err := parseTypeSignature(desc.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	fid := fromReflectedField(j.jniEnv, member.jobject)
+	if fid == 0 {
+		return nil, j.handleException()
+	}
+
+	valueClass, err := j.reflectedFieldClass(member, desc.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := j.declaringClass(member)
+	if err != nil {
+		deleteClassRefs(j.jniEnv, []jclass{valueClass})
+		return nil, err
+	}
+
+	return &Field{
+		class:      class,
+		className:  desc.DeclaringClass,
+		name:       desc.Name,
+		sig:        desc.Signature,
+		fid:        fid,
+		static:     desc.Modifiers.Is(ModStatic),
+		fType:      fType,
+		fClassName: fClassName,
+		valueClass: valueClass,
+	}, nil
+}
+
+// ToReflectedMethod calls JNI ToReflectedMethod, returning a java.lang.reflect.Method, or a
+// java.lang.reflect.Constructor if m is a constructor.
+func (j *Env) ToReflectedMethod(m *Method) (*ObjectRef, error) {
+	obj := toReflectedMethod(j.jniEnv, m.class, m.mid, fromBool(m.static))
+	if obj == 0 {
+		return nil, j.handleException()
+	}
+	if m.ctor {
+		return j.newLocalRef(obj, "java/lang/reflect/Constructor", false), nil
+	}
+	return j.newLocalRef(obj, "java/lang/reflect/Method", false), nil
+}
+
+// ToReflectedField calls JNI ToReflectedField, returning a java.lang.reflect.Field.
+func (j *Env) ToReflectedField(f *Field) (*ObjectRef, error) {
+	obj := toReflectedField(j.jniEnv, f.class, f.fid, fromBool(f.static))
+	if obj == 0 {
+		return nil, j.handleException()
+	}
+	return j.newLocalRef(obj, "java/lang/reflect/Field", false), nil
+}
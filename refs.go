@@ -0,0 +1,349 @@
+package jnigi
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// RefType is the kind of a JNI object reference, the values match JNI jobjectRefType.
+type RefType int
+
+const (
+	// InvalidRefType is used for references that are not valid, or whose kind is not known.
+	InvalidRefType RefType = iota
+	LocalRefType
+	GlobalRefType
+	WeakGlobalRefType
+)
+
+func (t RefType) String() string {
+	switch t {
+	case LocalRefType:
+		return "local"
+	case GlobalRefType:
+		return "global"
+	case WeakGlobalRefType:
+		return "weak global"
+	default:
+		return "invalid"
+	}
+}
+
+// GetObjectRefType calls JNI GetObjectRefType, it returns the kind of reference o holds as known by
+// the JVM. InvalidRefType is returned for a Nil reference.
+func (j *Env) GetObjectRefType(o *ObjectRef) RefType {
+	if o.jobject == 0 {
+		return InvalidRefType
+	}
+	return RefType(getObjectRefType(j.jniEnv, o.jobject))
+}
+
+// RefType returns the kind of reference o was created as. It is InvalidRefType for Nil references
+// and references made by WrapJObject, use Env.GetObjectRefType to ask the JVM.
+func (o *ObjectRef) RefType() RefType {
+	if o.jobject == 0 {
+		return InvalidRefType
+	}
+	return o.kind
+}
+
+// Env returns the Env a local reference was created in, local references are only valid on the
+// thread of that Env. It is nil for other references.
+func (o *ObjectRef) Env() *Env {
+	if o.kind != LocalRefType {
+		return nil
+	}
+	return o.env
+}
+
+// newLocalRef returns an *ObjectRef for obj, a local reference created in j.
+func (j *Env) newLocalRef(obj jobject, className string, isArray bool) *ObjectRef {
+	o := &ObjectRef{jobject: obj, className: className, isArray: isArray}
+	if obj != 0 {
+		o.kind = LocalRefType
+		o.env = j
+		j.trackNewLocal(o)
+		o.debug = j.newRefInfo(LocalRefType)
+	}
+	return o
+}
+
+// newWeakGlobalRef returns an *ObjectRef for obj, a weak global reference created in j.
+func (j *Env) newWeakGlobalRef(obj jobject, className string, isArray bool) *ObjectRef {
+	o := &ObjectRef{jobject: obj, className: className, isArray: isArray}
+	if obj != 0 {
+		p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+		defer free(p)
+		if getJavaVM(j.jniEnv, p) == 0 {
+			o.javaVM = *(*unsafe.Pointer)(p)
+		}
+		o.kind = WeakGlobalRefType
+		j.counters.track(WeakGlobalRefType, 1)
+		o.debug = j.newRefInfo(WeakGlobalRefType)
+	}
+	return o
+}
+
+// weakCleared returns true if the object of weak global reference o has been garbage collected.
+func (o *ObjectRef) weakCleared() bool {
+	if o.javaVM == nil {
+		return false
+	}
+	p := malloc(unsafe.Sizeof((unsafe.Pointer)(nil)))
+	defer free(p)
+	if getEnv(o.javaVM, p, DEFAULT_VERSION) != jniOK {
+		return false
+	}
+	return toBool(isSameObject(*(*unsafe.Pointer)(p), o.jobject, 0))
+}
+
+// Upgrade returns a new local reference to the object of weak global reference o, ok is false if the
+// object has been garbage collected. The returned reference keeps the object alive until it is
+// deleted. o can also be a local or global reference, then ok is only false if it is Nil.
+func (o *ObjectRef) Upgrade(env *Env) (ref *ObjectRef, ok bool) {
+	if env.reportRef("Upgrade", o) {
+		return nil, false
+	}
+	if o.jobject == 0 {
+		return nil, false
+	}
+	local := newLocalRef(env.jniEnv, o.jobject)
+	if local == 0 {
+		return nil, false
+	}
+	return env.newLocalRef(local, o.className, o.isArray), true
+}
+
+// UpgradeGlobal is like Upgrade but returns a new global reference.
+func (o *ObjectRef) UpgradeGlobal(env *Env) (ref *ObjectRef, ok bool) {
+	if env.reportRef("UpgradeGlobal", o) {
+		return nil, false
+	}
+	if o.jobject == 0 {
+		return nil, false
+	}
+	global := newGlobalRef(env.jniEnv, o.jobject)
+	if global == 0 {
+		return nil, false
+	}
+	return env.newGlobalRef(global, o.className, o.isArray), true
+}
+
+// newGlobalRef returns an *ObjectRef for obj, a global reference created in j.
+func (j *Env) newGlobalRef(obj jobject, className string, isArray bool) *ObjectRef {
+	o := &ObjectRef{jobject: obj, className: className, isArray: isArray}
+	if obj != 0 {
+		o.kind = GlobalRefType
+		j.counters.track(GlobalRefType, 1)
+		o.debug = j.newRefInfo(GlobalRefType)
+	}
+	return o
+}
+
+// Reference debugging checks ObjectRefs for stale local references, references deleted as the wrong
+// kind, double deletes and local references used on another thread. The checked uses are: deleting
+// and upgrading references, the object a method is called on or a field is accessed in, including
+// through Method and Field handles, method arguments and field values, the objects passed to the
+// Class, Module and monitor functions, and PopLocalFrame. Other functions, for example the array
+// functions, do not check their references. It is enabled with SetRefDebug, or by building with the
+// jnigi_debug build tag.
+
+var (
+	refDebugMu      sync.Mutex
+	refDebugEnabled bool
+	refDebugHandler func(err error)
+)
+
+// SetRefDebug turns reference debugging on or off. When on, misuse of an ObjectRef is returned as a
+// *RefError by methods that return an error, and is passed to handler by methods that do not, for
+// example DeleteLocalRef. A nil handler panics with the *RefError. Only references created while
+// debugging is on are checked. Debugging records the call stack of every reference created, so it
+// is slow.
+func SetRefDebug(enabled bool, handler func(err error)) {
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	refDebugEnabled = enabled
+	refDebugHandler = handler
+}
+
+// RefError describes misuse of an ObjectRef found by reference debugging.
+type RefError struct {
+	// Op is the operation that used the reference, for example DeleteLocalRef.
+	Op string
+	// Problem describes what is wrong.
+	Problem string
+	// Kind is the kind the reference was created as.
+	Kind RefType
+	// Stack is the call stack where the reference was created.
+	Stack string
+}
+
+func (e *RefError) Error() string {
+	return fmt.Sprintf("JNIGI: %s: %s (%s reference created at:\n%s)", e.Op, e.Problem, e.Kind, e.Stack)
+}
+
+// refInfo holds what reference debugging knows about a reference, it is shared by copies of an
+// ObjectRef.
+type refInfo struct {
+	kind    RefType
+	jniEnv  uintptr
+	frame   *refFrame
+	deleted bool
+	pcs     []uintptr
+}
+
+// refFrame is a local frame of an Env, the base frame is popped when the thread is detached.
+type refFrame struct {
+	parent *refFrame
+	popped bool
+}
+
+func (j *Env) newRefInfo(kind RefType) *refInfo {
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	if !refDebugEnabled {
+		return nil
+	}
+	info := &refInfo{kind: kind, jniEnv: uintptr(j.jniEnv)}
+	if kind == LocalRefType {
+		info.frame = j.currentFrame()
+	}
+	pcs := make([]uintptr, 32)
+	info.pcs = pcs[:runtime.Callers(3, pcs)]
+	return info
+}
+
+// currentFrame returns the local frame of j, refDebugMu must be held.
+func (j *Env) currentFrame() *refFrame {
+	if j.frame == nil {
+		j.frame = &refFrame{}
+	}
+	return j.frame
+}
+
+// pushRefFrame records a local frame pushed with PushLocalFrame.
+func (j *Env) pushRefFrame() {
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	if refDebugEnabled {
+		j.frame = &refFrame{parent: j.currentFrame()}
+	}
+}
+
+// popRefFrame records a local frame popped with PopLocalFrame.
+func (j *Env) popRefFrame() {
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	if j.frame != nil && j.frame.parent != nil {
+		j.frame.popped = true
+		j.frame = j.frame.parent
+	}
+}
+
+// detachRefFrames records that the thread of j was detached, so all its local references are stale.
+func (j *Env) detachRefFrames() {
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	for f := j.frame; f != nil; f = f.parent {
+		f.popped = true
+	}
+	j.frame = nil
+}
+
+func (info *refInfo) stack() string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(info.pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// checkRef returns a *RefError if reference debugging is on and o can not be used in j by op.
+func (j *Env) checkRef(op string, o *ObjectRef) error {
+	if o == nil || o.debug == nil || o.jobject == 0 {
+		return nil
+	}
+	refDebugMu.Lock()
+	defer refDebugMu.Unlock()
+	if !refDebugEnabled {
+		return nil
+	}
+	return j.checkRefLocked(op, o.debug)
+}
+
+func (j *Env) checkRefLocked(op string, info *refInfo) error {
+	var problem string
+	switch {
+	case info.deleted:
+		problem = "reference used after it was deleted"
+	case info.kind == LocalRefType && info.frame.popped:
+		problem = "stale local reference, its local frame was popped or its thread detached"
+	case info.kind == LocalRefType && info.jniEnv != uintptr(j.jniEnv):
+		problem = "local reference used on another thread"
+	default:
+		return nil
+	}
+	return &RefError{Op: op, Problem: problem, Kind: info.kind, Stack: info.stack()}
+}
+
+// checkDelete checks o can be deleted as a reference of kind, and records it as deleted. It reports
+// a *RefError to the debug handler and returns false if o must not be deleted.
+func (j *Env) checkDelete(op string, o *ObjectRef, kind RefType) bool {
+	if o == nil || o.debug == nil || o.jobject == 0 {
+		return true
+	}
+	refDebugMu.Lock()
+	if !refDebugEnabled {
+		refDebugMu.Unlock()
+		return true
+	}
+	info := o.debug
+	var err error
+	if info.deleted {
+		err = &RefError{Op: op, Problem: "reference deleted twice", Kind: info.kind, Stack: info.stack()}
+	} else if info.kind != kind {
+		err = &RefError{Op: op, Problem: fmt.Sprintf("%s reference deleted as a %s reference", info.kind, kind), Kind: info.kind, Stack: info.stack()}
+	} else if kind == LocalRefType {
+		err = j.checkRefLocked(op, info)
+	}
+	if err == nil {
+		info.deleted = true
+	}
+	handler := refDebugHandler
+	refDebugMu.Unlock()
+
+	if err != nil {
+		reportRefError(handler, err)
+		return false
+	}
+	return true
+}
+
+// reportRef reports a *RefError if reference debugging is on and o can not be used in j by op, and
+// returns true if it did. It is used by methods that do not return an error.
+func (j *Env) reportRef(op string, o *ObjectRef) bool {
+	err := j.checkRef(op, o)
+	if err == nil {
+		return false
+	}
+	refDebugMu.Lock()
+	handler := refDebugHandler
+	refDebugMu.Unlock()
+	reportRefError(handler, err)
+	return true
+}
+
+func reportRefError(handler func(err error), err error) {
+	if handler == nil {
+		panic(err)
+	}
+	handler(err)
+}
@@ -0,0 +1,411 @@
+//go:build go1.21
+// +build go1.21
+
+package jnigi
+
+/*
+#include<jni.h>
+#include<stdint.h>
+
+extern void go_log_publish(void* env, uintptr_t cls, jint id, uintptr_t record, uintptr_t message);
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const goLogHandlerClass = "jnigi/GoLogHandler"
+
+func init() {
+	helperClassDefs[goLogHandlerClass] = helperClassDef{bytecode: goLogHandlerBytecode}
+}
+
+// SlogBridge routes java.util.logging records to a slog.Logger, see Env.InstallSlogBridge.
+type SlogBridge struct {
+	// Logger receives the records.
+	Logger *slog.Logger
+	// JavaLogger is the name of the java.util.logging logger the handler is added to, "" for the
+	// root logger which receives the records of all loggers.
+	JavaLogger string
+	// ReplaceHandlers removes the other handlers of the Java logger, like the ConsoleHandler of the
+	// root logger, and stops a named logger from passing records to its parent's handlers.
+	ReplaceHandlers bool
+}
+
+// InstallSlogBridge adds a java.util.logging Handler to a Java logger that converts each LogRecord
+// to a slog.Record and passes it to the handler of b.Logger. The record has the formatted message of
+// the LogRecord and its time, its level is mapped with SlogLevel, and it has these attributes:
+//
+//	logger   the Java logger name
+//	class    the source class name, if known
+//	method   the source method name, if known
+//	params   the parameters of the message as strings, if any
+//	error    the thrown exception as a *ThrowableError, if any
+//
+// The level of the Java logger is set to the lowest level b.Logger is enabled for, so Java does not
+// create records that would be dropped, see SetJavaLogLevel. Call Uninstall on the returned bridge
+// to remove the handler and release the references it holds.
+//
+// No System.LoggerFinder is provided, this is on purpose: the JDK's default System.LoggerFinder
+// sends System.Logger output to java.util.logging when the java.logging module is present, so it
+// reaches the bridge too.
+func (j *Env) InstallSlogBridge(b SlogBridge) (*InstalledSlogBridge, error) {
+	if b.Logger == nil {
+		return nil, errors.New("JNIGI: InstallSlogBridge with nil Logger")
+	}
+	class, err := j.helperClass(goLogHandlerClass)
+	if err != nil {
+		return nil, err
+	}
+	mnCstr := cString("publish0")
+	defer free(mnCstr)
+	sigCstr := cString("(ILjava/util/logging/LogRecord;Ljava/lang/String;)V")
+	defer free(sigCstr)
+	if registerNative(j.jniEnv, class, mnCstr, sigCstr, unsafe.Pointer(C.go_log_publish)) < 0 {
+		return nil, j.handleException()
+	}
+
+	logger, err := j.javaLogger(b.JavaLogger)
+	if err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(logger)
+
+	if b.ReplaceHandlers {
+		j.PrecalculateSignature("()[Ljava/util/logging/Handler;")
+		handlers := NewObjectArrayRef("java/util/logging/Handler")
+		if err := logger.CallMethod(j, "getHandlers", handlers); err != nil {
+			return nil, err
+		}
+		defer j.DeleteLocalRef(handlers)
+		err := j.forEachElement(handlers, func(h *ObjectRef) error {
+			return logger.CallMethod(j, "removeHandler", nil, h.Cast("java/util/logging/Handler"))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if b.JavaLogger != "" {
+			if err := logger.CallMethod(j, "setUseParentHandlers", nil, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	id := slogBridges.add(b.Logger)
+	handler, err := j.newObject(class, goLogHandlerClass, int32(id))
+	if err != nil {
+		slogBridges.remove(id)
+		return nil, err
+	}
+	defer j.DeleteLocalRef(handler)
+	if err := logger.CallMethod(j, "addHandler", nil, handler.Cast("java/util/logging/Handler")); err != nil {
+		slogBridges.remove(id)
+		return nil, err
+	}
+	// LogManager only holds weak references to named loggers, the global reference keeps the
+	// handler from being lost when logger is garbage collected
+	installed := &InstalledSlogBridge{id: id, javaLogger: j.NewGlobalRef(logger), handler: j.NewGlobalRef(handler)}
+
+	if err := j.setJavaLoggerLevel(logger, lowestEnabledLevel(b.Logger)); err != nil {
+		installed.Uninstall(j)
+		return nil, err
+	}
+	return installed, nil
+}
+
+// InstalledSlogBridge is a handler added by InstallSlogBridge.
+type InstalledSlogBridge struct {
+	id         int32
+	javaLogger *ObjectRef
+	handler    *ObjectRef
+}
+
+// Uninstall removes the handler from the Java logger and deletes the references held for it. The
+// handlers removed by SlogBridge.ReplaceHandlers are not restored. Uninstall does nothing if b is
+// already uninstalled.
+func (b *InstalledSlogBridge) Uninstall(env *Env) error {
+	if b.handler == nil {
+		return nil
+	}
+	slogBridges.remove(b.id)
+	err := b.javaLogger.CallMethod(env, "removeHandler", nil, b.handler.Cast("java/util/logging/Handler"))
+	env.DeleteGlobalRef(b.handler)
+	env.DeleteGlobalRef(b.javaLogger)
+	b.handler, b.javaLogger = nil, nil
+	return err
+}
+
+// SetJavaLogLevel sets the level of java.util.logging logger javaLogger, "" for the root logger, to
+// the Java level that matches level, see JavaLogLevel. LogManager only holds weak references to
+// named loggers, so a global reference to each logger configured is kept for the life of the JVM,
+// otherwise the level would be lost when the logger is garbage collected.
+func (j *Env) SetJavaLogLevel(javaLogger string, level slog.Level) error {
+	logger, err := j.javaLogger(javaLogger)
+	if err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(logger)
+	if err := j.setJavaLoggerLevel(logger, JavaLogLevel(level)); err != nil {
+		return err
+	}
+
+	configuredLoggersMu.Lock()
+	defer configuredLoggersMu.Unlock()
+	if _, ok := configuredLoggers[javaLogger]; !ok {
+		configuredLoggers[javaLogger] = j.NewGlobalRef(logger)
+	}
+	return nil
+}
+
+// configuredLoggers holds global references to the loggers configured by SetJavaLogLevel by name.
+var (
+	configuredLoggersMu sync.Mutex
+	configuredLoggers   = make(map[string]*ObjectRef)
+)
+
+// SlogLevel returns the slog level for a java.util.logging level value: SEVERE is Error, WARNING
+// is Warn, INFO is Info, CONFIG and FINE are Debug, and FINER and FINEST are Debug-4.
+func SlogLevel(javaLevel int) slog.Level {
+	switch {
+	case javaLevel >= 1000:
+		return slog.LevelError
+	case javaLevel >= 900:
+		return slog.LevelWarn
+	case javaLevel >= 800:
+		return slog.LevelInfo
+	case javaLevel >= 500:
+		return slog.LevelDebug
+	default:
+		return slog.LevelDebug - 4
+	}
+}
+
+// JavaLogLevel returns the name of the java.util.logging level that matches slog level, the
+// reverse of SlogLevel.
+func JavaLogLevel(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "SEVERE"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	case level >= slog.LevelDebug:
+		return "FINE"
+	default:
+		return "FINEST"
+	}
+}
+
+// lowestEnabledLevel returns the Java level of the lowest level logger is enabled for, or OFF.
+func lowestEnabledLevel(logger *slog.Logger) string {
+	for _, level := range []slog.Level{slog.LevelDebug - 4, slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError} {
+		if logger.Enabled(context.Background(), level) {
+			return JavaLogLevel(level)
+		}
+	}
+	return "OFF"
+}
+
+// javaLogger returns the java.util.logging.Logger name.
+func (j *Env) javaLogger(name string) (*ObjectRef, error) {
+	nameStr, err := j.NewObject("java/lang/String", []byte(name), j.GetUTF8String())
+	if err != nil {
+		return nil, err
+	}
+	defer j.DeleteLocalRef(nameStr)
+
+	logger := NewObjectRef("java/util/logging/Logger")
+	if err := j.CallStaticMethod("java/util/logging/Logger", "getLogger", logger, nameStr); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+func (j *Env) setJavaLoggerLevel(logger *ObjectRef, levelName string) error {
+	level := NewObjectRef("java/util/logging/Level")
+	if err := j.GetStaticField("java/util/logging/Level", levelName, level); err != nil {
+		return err
+	}
+	defer j.DeleteLocalRef(level)
+	return logger.CallMethod(j, "setLevel", nil, level)
+}
+
+// slogBridgeRegistry holds the loggers of the installed handlers by the id they are created with in
+// Java.
+type slogBridgeRegistry struct {
+	mu      sync.Mutex
+	bridges map[int32]*slog.Logger
+	nextID  int32
+}
+
+var slogBridges = &slogBridgeRegistry{bridges: make(map[int32]*slog.Logger)}
+
+func (r *slogBridgeRegistry) add(logger *slog.Logger) int32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.bridges[r.nextID] = logger
+	return r.nextID
+}
+
+func (r *slogBridgeRegistry) get(id int32) *slog.Logger {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bridges[id]
+}
+
+func (r *slogBridgeRegistry) remove(id int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.bridges, id)
+}
+
+//export go_log_publish
+func go_log_publish(jenv unsafe.Pointer, cls uintptr, id C.jint, record uintptr, message uintptr) {
+	logger := slogBridges.get(int32(id))
+	if logger == nil {
+		return
+	}
+	env := WrapEnv(jenv)
+	// the local frame counts the local references made here as deleted when it is popped
+	if err := env.PushLocalFrame(32); err != nil {
+		return
+	}
+	defer env.PopLocalFrame(nil)
+
+	if r, ok := newSlogRecord(env, WrapJObject(record, "java/util/logging/LogRecord", false), WrapJObject(message, "java/lang/String", false)); ok {
+		if logger.Enabled(context.Background(), r.Level) {
+			logger.Handler().Handle(context.Background(), r)
+		}
+	}
+}
+
+// newSlogRecord converts a LogRecord to a slog.Record, ok is false if it could not be converted.
+func newSlogRecord(env *Env, record, message *ObjectRef) (r slog.Record, ok bool) {
+	level := NewObjectRef("java/util/logging/Level")
+	if err := record.CallMethod(env, "getLevel", level); err != nil {
+		return r, false
+	}
+	var levelValue int
+	if err := level.CallMethod(env, "intValue", &levelValue); err != nil {
+		return r, false
+	}
+	var millis int64
+	if err := record.CallMethod(env, "getMillis", &millis); err != nil {
+		return r, false
+	}
+
+	r = slog.NewRecord(time.Unix(0, millis*int64(time.Millisecond)), SlogLevel(levelValue), stringFromJavaLangString(env, message), 0)
+
+	for _, attr := range []struct{ key, method string }{
+		{"logger", "getLoggerName"},
+		{"class", "getSourceClassName"},
+		{"method", "getSourceMethodName"},
+	} {
+		key := attr.key
+		callStringMethodAndAssign(env, record, attr.method, func(s string) {
+			if s != "" {
+				r.AddAttrs(slog.String(key, s))
+			}
+		})
+	}
+
+	env.PrecalculateSignature("()[Ljava/lang/Object;")
+	params := NewObjectArrayRef("java/lang/Object")
+	if err := record.CallMethod(env, "getParameters", params); err == nil && !params.IsNil() {
+		var strs []string
+		env.forEachElement(params, func(param *ObjectRef) error {
+			if param.IsNil() {
+				strs = append(strs, "null")
+				return nil
+			}
+			return callStringMethodAndAssign(env, param, "toString", func(s string) {
+				strs = append(strs, s)
+			})
+		})
+		if len(strs) > 0 {
+			r.AddAttrs(slog.Any("params", strs))
+		}
+	}
+
+	thrown := NewObjectRef("java/lang/Throwable")
+	if err := record.CallMethod(env, "getThrown", thrown); err == nil && !thrown.IsNil() {
+		if throwableErr, _ := NewThrowableErrorFromObject(env, thrown); throwableErr != nil {
+			r.AddAttrs(slog.Any("error", throwableErr))
+		}
+	}
+	return r, true
+}
+
+// goLogHandlerBytecode returns the class file of:
+//
+//	public class GoLogHandler extends Handler {
+//		private final int id;
+//		private final Formatter formatter;
+//
+//		public GoLogHandler(int id) {
+//			this.id = id;
+//			this.formatter = new SimpleFormatter();
+//		}
+//
+//		public void publish(LogRecord record) {
+//			if (!isLoggable(record)) {
+//				return;
+//			}
+//			publish0(id, record, formatter.formatMessage(record));
+//		}
+//
+//		public void flush() {
+//		}
+//
+//		public void close() {
+//		}
+//
+//		private static native void publish0(int id, LogRecord record, String message);
+//	}
+func goLogHandlerBytecode() []byte {
+	cw := newClassWriter(goLogHandlerClass, "java/util/logging/Handler")
+	cw.field(accPrivate|accFinal, "id", "I")
+	cw.field(accPrivate|accFinal, "formatter", "Ljava/util/logging/Formatter;")
+
+	cw.method(accPublic, "<init>", "(I)V", 3, 2).
+		op(opAload0).
+		invoke(opInvokespecial, "java/util/logging/Handler", "<init>", "()V").
+		op(opAload0, opIload1).
+		fieldOp(opPutfield, goLogHandlerClass, "id", "I").
+		op(opAload0).
+		typeOp(opNew, "java/util/logging/SimpleFormatter").
+		op(opDup).
+		invoke(opInvokespecial, "java/util/logging/SimpleFormatter", "<init>", "()V").
+		fieldOp(opPutfield, goLogHandlerClass, "formatter", "Ljava/util/logging/Formatter;").
+		op(opReturn)
+
+	code := cw.method(accPublic, "publish", "(Ljava/util/logging/LogRecord;)V", 4, 2).
+		op(opAload0, opAload1).
+		invoke(opInvokevirtual, "java/util/logging/Handler", "isLoggable", "(Ljava/util/logging/LogRecord;)Z")
+	loggable := code.branch(opIfne)
+	code.op(opReturn)
+	code.label(loggable)
+	code.op(opAload0).
+		fieldOp(opGetfield, goLogHandlerClass, "id", "I").
+		op(opAload1, opAload0).
+		fieldOp(opGetfield, goLogHandlerClass, "formatter", "Ljava/util/logging/Formatter;").
+		op(opAload1).
+		invoke(opInvokevirtual, "java/util/logging/Formatter", "formatMessage", "(Ljava/util/logging/LogRecord;)Ljava/lang/String;").
+		invoke(opInvokestatic, goLogHandlerClass, "publish0", "(ILjava/util/logging/LogRecord;Ljava/lang/String;)V").
+		op(opReturn)
+
+	cw.method(accPublic, "flush", "()V", 0, 1).op(opReturn)
+	cw.method(accPublic, "close", "()V", 0, 1).op(opReturn)
+
+	cw.nativeMethod(accPrivate|accStatic, "publish0", "(ILjava/util/logging/LogRecord;Ljava/lang/String;)V")
+
+	return cw.bytes()
+}
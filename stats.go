@@ -0,0 +1,176 @@
+package jnigi
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Stats holds counts of live references and C allocations, see Env.Stats and JVM.Stats. Only
+// references created by jnigi methods that return an *ObjectRef are counted, not the references
+// jnigi holds itself, like the class cache.
+type Stats struct {
+	// LocalRefs is the number of live local references.
+	LocalRefs int64
+	// GlobalRefs is the number of live global references of the JVM.
+	GlobalRefs int64
+	// WeakGlobalRefs is the number of live weak global references of the JVM.
+	WeakGlobalRefs int64
+	// CAllocs is the number of C allocations made by jnigi that are not freed, for the process.
+	CAllocs int64
+}
+
+// Stats returns the number of live local references of j, and the number of live global and weak
+// global references of its JVM. Local references are counted as deleted when their local frame is
+// popped.
+func (j *Env) Stats() Stats {
+	stats := j.counters.stats()
+	stats.LocalRefs = atomic.LoadInt64(&j.localRefs)
+	return stats
+}
+
+// Stats returns the number of live local references of all Envs, and of live global and weak global
+// references of j.
+func (j *JVM) Stats() Stats {
+	return j.counters.stats()
+}
+
+// PublishExpvar publishes the Stats of j with expvar as name. Like expvar.Publish it panics if name
+// is already used.
+func (j *JVM) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return j.Stats()
+	}))
+}
+
+// refCounters counts the live references of a JVM.
+type refCounters struct {
+	local  int64
+	global int64
+	weak   int64
+}
+
+// refCountersByVM holds the refCounters of each JVM by JavaVM pointer.
+var (
+	refCountersMu   sync.Mutex
+	refCountersByVM = make(map[unsafe.Pointer]*refCounters)
+)
+
+// sharedRefCounters returns the refCounters of javaVM.
+func sharedRefCounters(javaVM unsafe.Pointer) *refCounters {
+	refCountersMu.Lock()
+	defer refCountersMu.Unlock()
+	c, ok := refCountersByVM[javaVM]
+	if !ok {
+		c = &refCounters{}
+		refCountersByVM[javaVM] = c
+	}
+	return c
+}
+
+// removeSharedRefCounters forgets the refCounters of javaVM.
+func removeSharedRefCounters(javaVM unsafe.Pointer) {
+	refCountersMu.Lock()
+	defer refCountersMu.Unlock()
+	delete(refCountersByVM, javaVM)
+}
+
+func (c *refCounters) track(kind RefType, n int64) {
+	if c == nil {
+		return
+	}
+	switch kind {
+	case LocalRefType:
+		atomic.AddInt64(&c.local, n)
+	case GlobalRefType:
+		atomic.AddInt64(&c.global, n)
+	case WeakGlobalRefType:
+		atomic.AddInt64(&c.weak, n)
+	}
+}
+
+func (c *refCounters) stats() Stats {
+	stats := Stats{CAllocs: atomic.LoadInt64(&cAllocs)}
+	if c != nil {
+		stats.LocalRefs = atomic.LoadInt64(&c.local)
+		stats.GlobalRefs = atomic.LoadInt64(&c.global)
+		stats.WeakGlobalRefs = atomic.LoadInt64(&c.weak)
+	}
+	return stats
+}
+
+func (j *Env) trackLocal(n int64) {
+	atomic.AddInt64(&j.localRefs, n)
+	j.counters.track(LocalRefType, n)
+}
+
+// localFrame counts the live local references of a local frame. id is unique within the Env, so a
+// reference of a popped frame is not counted against a later frame at the same depth.
+type localFrame struct {
+	id   uint64
+	refs int64
+}
+
+// trackNewLocal counts a new local reference o of j, in the current local frame.
+func (j *Env) trackNewLocal(o *ObjectRef) {
+	if len(j.localFrames) == 0 {
+		j.startLocalFrame()
+	}
+	o.frameDepth = len(j.localFrames) - 1
+	frame := &j.localFrames[o.frameDepth]
+	o.frameID = frame.id
+	frame.refs++
+	j.trackLocal(1)
+}
+
+// untrackLocal counts local reference o as deleted, o is deleted by the caller. Only references
+// created in j are counted, the frames of another Env may be in use by another goroutine.
+func (j *Env) untrackLocal(o *ObjectRef) {
+	if o.kind != LocalRefType || o.env != j || o.jobject == 0 {
+		return
+	}
+	if o.frameDepth >= len(j.localFrames) {
+		return
+	}
+	frame := &j.localFrames[o.frameDepth]
+	if frame.id == o.frameID && frame.refs > 0 {
+		frame.refs--
+		j.trackLocal(-1)
+	}
+}
+
+// untrackGlobal counts global or weak global reference o as deleted.
+func (j *Env) untrackGlobal(o *ObjectRef) {
+	j.counters.track(o.kind, -1)
+}
+
+// untrackLocals counts all local references of j as deleted, when its thread is detached.
+func (j *Env) untrackLocals() {
+	j.trackLocal(-atomic.LoadInt64(&j.localRefs))
+	j.localFrames = nil
+}
+
+// trackPushFrame starts counting the local references of a new local frame.
+func (j *Env) trackPushFrame() {
+	if len(j.localFrames) == 0 {
+		j.startLocalFrame()
+	}
+	j.startLocalFrame()
+}
+
+// startLocalFrame adds a local frame with a new id.
+func (j *Env) startLocalFrame() {
+	j.lastFrameID++
+	j.localFrames = append(j.localFrames, localFrame{id: j.lastFrameID})
+}
+
+// trackPopFrame counts the local references of the popped local frame as deleted.
+func (j *Env) trackPopFrame() {
+	n := len(j.localFrames)
+	if n < 2 {
+		return
+	}
+	j.trackLocal(-j.localFrames[n-1].refs)
+	j.localFrames = j.localFrames[:n-1]
+}
@@ -0,0 +1,471 @@
+package jnigi
+
+/*
+#include<jni.h>
+#include<stdint.h>
+
+extern void go_stdio_write(void* env, uintptr_t cls, jint id, jint b);
+extern void go_stdio_write_bytes(void* env, uintptr_t cls, jint id, uintptr_t array, jint off, jint len);
+extern void go_stdio_flush(void* env, uintptr_t cls, jint id);
+extern jint go_stdio_read(void* env, uintptr_t cls, jint id);
+extern jint go_stdio_read_bytes(void* env, uintptr_t cls, jint id, uintptr_t array, jint off, jint len);
+*/
+import "C"
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+const (
+	goOutputStreamClass = "jnigi/GoOutputStream"
+	goInputStreamClass  = "jnigi/GoInputStream"
+
+	// maxPartialLine is the size at which a line without a line break is written anyway
+	maxPartialLine = 64 * 1024
+	// maxRead is the most read from a Go reader by one call
+	maxRead = 64 * 1024
+)
+
+// RedirectStdio replaces Java's System.out, System.err and System.in with streams backed by Go.
+// Everything Java prints to System.out and System.err is written to stdout and stderr, including the
+// stack traces printed by DescribeExceptionHandler, and Java code reading System.in reads from stdin.
+// A nil argument leaves that stream as it is. RedirectStdio can be called again to change the
+// streams.
+//
+// The output is line framed: each Write call gets one complete line, including its line break, so
+// stdout and stderr can feed a line based logging pipeline. A line without a line break is held
+// until the line is completed, it is longer than 64KiB, or the stream is replaced by another call
+// to RedirectStdio. Writes and reads are serialized per stream, and happen on the Java thread that
+// uses the stream.
+func (j *Env) RedirectStdio(stdout, stderr io.Writer, stdin io.Reader) error {
+	outClass, err := j.helperClass(goOutputStreamClass)
+	if err != nil {
+		return err
+	}
+	inClass, err := j.helperClass(goInputStreamClass)
+	if err != nil {
+		return err
+	}
+	if err := j.registerStdioNatives(outClass, inClass); err != nil {
+		return err
+	}
+
+	if stdout != nil {
+		if err := j.redirectOutput(outClass, "setOut", &stdioOut, stdout); err != nil {
+			return err
+		}
+	}
+	if stderr != nil {
+		if err := j.redirectOutput(outClass, "setErr", &stdioErr, stderr); err != nil {
+			return err
+		}
+	}
+	if stdin != nil {
+		id := stdioStreams.add(&stdioStream{r: stdin})
+		stream, err := j.newObject(inClass, goInputStreamClass, int32(id))
+		if err != nil {
+			stdioStreams.remove(id)
+			return err
+		}
+		defer j.DeleteLocalRef(stream)
+		j.PrecalculateSignature("(Ljava/io/InputStream;)V")
+		if err := j.CallStaticMethod("java/lang/System", "setIn", nil, stream); err != nil {
+			stdioStreams.remove(id)
+			return err
+		}
+		stdioStreams.replace(&stdioIn, id)
+	}
+	return nil
+}
+
+// redirectOutput calls System method setter with a PrintStream writing to w, current is the id of
+// the stream it replaces.
+func (j *Env) redirectOutput(outClass jclass, setter string, current *int32, w io.Writer) error {
+	id := stdioStreams.add(&stdioStream{w: w})
+	stream, err := j.newObject(outClass, goOutputStreamClass, int32(id))
+	if err != nil {
+		stdioStreams.remove(id)
+		return err
+	}
+	defer j.DeleteLocalRef(stream)
+
+	printStream, err := j.NewObject("java/io/PrintStream", stream.Cast("java/io/OutputStream"), true, j.GetUTF8String())
+	if err != nil {
+		stdioStreams.remove(id)
+		return err
+	}
+	defer j.DeleteLocalRef(printStream)
+
+	if err := j.CallStaticMethod("java/lang/System", setter, nil, printStream); err != nil {
+		stdioStreams.remove(id)
+		return err
+	}
+	stdioStreams.replace(current, id)
+	return nil
+}
+
+func (j *Env) registerStdioNatives(outClass, inClass jclass) error {
+	natives := []struct {
+		class     jclass
+		name, sig string
+		fptr      unsafe.Pointer
+	}{
+		{outClass, "write0", "(II)V", unsafe.Pointer(C.go_stdio_write)},
+		{outClass, "writeBytes0", "(I[BII)V", unsafe.Pointer(C.go_stdio_write_bytes)},
+		{outClass, "flush0", "(I)V", unsafe.Pointer(C.go_stdio_flush)},
+		{inClass, "read0", "(I)I", unsafe.Pointer(C.go_stdio_read)},
+		{inClass, "readBytes0", "(I[BII)I", unsafe.Pointer(C.go_stdio_read_bytes)},
+	}
+	for _, n := range natives {
+		mnCstr := cString(n.name)
+		sigCstr := cString(n.sig)
+		r := registerNative(j.jniEnv, n.class, mnCstr, sigCstr, n.fptr)
+		free(mnCstr)
+		free(sigCstr)
+		if r < 0 {
+			return j.handleException()
+		}
+	}
+	return nil
+}
+
+// stdioStream is a Go writer or reader used by a GoOutputStream or GoInputStream.
+type stdioStream struct {
+	mu  sync.Mutex
+	w   io.Writer
+	r   io.Reader
+	buf []byte
+}
+
+// write writes the complete lines in p, and holds the rest until its line is complete.
+func (s *stdioStream) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			if len(s.buf) < maxPartialLine {
+				return nil
+			}
+			i = len(s.buf) - 1
+		}
+		line := s.buf[:i+1]
+		s.buf = s.buf[i+1:]
+		if _, err := s.w.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// flush flushes the Go writer if it has a Flush method, partial lines are held.
+func (s *stdioStream) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// close writes a held partial line.
+func (s *stdioStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w != nil && len(s.buf) > 0 {
+		s.w.Write(s.buf)
+		s.buf = nil
+	}
+}
+
+// read reads at most n bytes, it returns io.EOF at the end of the stream.
+func (s *stdioStream) read(n int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > maxRead {
+		n = maxRead
+	}
+	buf := make([]byte, n)
+	for {
+		r, err := s.r.Read(buf)
+		if r > 0 {
+			return buf[:r], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// stdioRegistry holds the streams by the id they are created with in Java.
+type stdioRegistry struct {
+	mu      sync.Mutex
+	streams map[int32]*stdioStream
+	nextID  int32
+}
+
+var (
+	stdioStreams = &stdioRegistry{streams: make(map[int32]*stdioStream)}
+	// the ids of the current System.out, System.err and System.in streams
+	stdioOut, stdioErr, stdioIn int32
+)
+
+func (r *stdioRegistry) add(s *stdioStream) int32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.streams[r.nextID] = s
+	return r.nextID
+}
+
+func (r *stdioRegistry) get(id int32) *stdioStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[id]
+}
+
+func (r *stdioRegistry) remove(id int32) {
+	r.mu.Lock()
+	s := r.streams[id]
+	delete(r.streams, id)
+	r.mu.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
+
+// replace sets *current to id and removes the stream it replaces. Java code can still hold the old
+// stream, its output is dropped.
+func (r *stdioRegistry) replace(current *int32, id int32) {
+	r.mu.Lock()
+	old := *current
+	*current = id
+	r.mu.Unlock()
+	if old != 0 {
+		r.remove(old)
+	}
+}
+
+// throwStdioException throws an exception of class className with message msg in the Java thread
+// of env.
+func throwStdioException(env unsafe.Pointer, className string, msg string) {
+	cnCstr := cString(className)
+	defer free(cnCstr)
+	class := findClass(env, cnCstr, nil)
+	if class == 0 {
+		// FindClass threw
+		return
+	}
+	msgCstr := cString(msg)
+	defer free(msgCstr)
+	throwNew(env, class, msgCstr)
+	deleteLocalRef(env, jobject(class))
+}
+
+// checkRegion throws an IndexOutOfBoundsException and returns false if off and n are not a region
+// of array.
+func checkRegion(env unsafe.Pointer, array jarray, off, n C.jint) bool {
+	if array == 0 {
+		throwStdioException(env, "java/lang/NullPointerException", "null array")
+		return false
+	}
+	length := getArrayLength(env, array)
+	if off < 0 || n < 0 || int64(off)+int64(n) > int64(length) {
+		throwStdioException(env, "java/lang/IndexOutOfBoundsException", "invalid array region")
+		return false
+	}
+	return true
+}
+
+func stdioWrite(env unsafe.Pointer, id C.jint, p []byte) {
+	s := stdioStreams.get(int32(id))
+	if s == nil {
+		return
+	}
+	if err := s.write(p); err != nil {
+		throwStdioException(env, "java/io/IOException", err.Error())
+	}
+}
+
+//export go_stdio_write
+func go_stdio_write(env unsafe.Pointer, cls uintptr, id C.jint, b C.jint) {
+	stdioWrite(env, id, []byte{byte(b)})
+}
+
+//export go_stdio_write_bytes
+func go_stdio_write_bytes(env unsafe.Pointer, cls uintptr, id C.jint, array uintptr, off, n C.jint) {
+	if !checkRegion(env, jarray(array), off, n) || n == 0 {
+		return
+	}
+	p := make([]byte, int(n))
+	getByteArrayRegion(env, jbyteArray(array), jsize(off), jsize(n), unsafe.Pointer(&p[0]))
+	stdioWrite(env, id, p)
+}
+
+//export go_stdio_flush
+func go_stdio_flush(env unsafe.Pointer, cls uintptr, id C.jint) {
+	s := stdioStreams.get(int32(id))
+	if s == nil {
+		return
+	}
+	if err := s.flush(); err != nil {
+		throwStdioException(env, "java/io/IOException", err.Error())
+	}
+}
+
+//export go_stdio_read
+func go_stdio_read(env unsafe.Pointer, cls uintptr, id C.jint) C.jint {
+	s := stdioStreams.get(int32(id))
+	if s == nil {
+		return -1
+	}
+	p, err := s.read(1)
+	if err == io.EOF {
+		return -1
+	}
+	if err != nil {
+		throwStdioException(env, "java/io/IOException", err.Error())
+		return -1
+	}
+	return C.jint(p[0])
+}
+
+//export go_stdio_read_bytes
+func go_stdio_read_bytes(env unsafe.Pointer, cls uintptr, id C.jint, array uintptr, off, n C.jint) C.jint {
+	if !checkRegion(env, jarray(array), off, n) {
+		return -1
+	}
+	if n == 0 {
+		return 0
+	}
+	s := stdioStreams.get(int32(id))
+	if s == nil {
+		return -1
+	}
+	p, err := s.read(int(n))
+	if err == io.EOF {
+		return -1
+	}
+	if err != nil {
+		throwStdioException(env, "java/io/IOException", err.Error())
+		return -1
+	}
+	setByteArrayRegion(env, jbyteArray(array), jsize(off), jsize(len(p)), unsafe.Pointer(&p[0]))
+	return C.jint(len(p))
+}
+
+// goOutputStreamBytecode returns the class file of:
+//
+//	public class GoOutputStream extends OutputStream {
+//		private final int id;
+//
+//		public GoOutputStream(int id) {
+//			this.id = id;
+//		}
+//
+//		public void write(int b) {
+//			write0(id, b);
+//		}
+//
+//		public void write(byte[] b, int off, int len) {
+//			writeBytes0(id, b, off, len);
+//		}
+//
+//		public void flush() {
+//			flush0(id);
+//		}
+//
+//		private static native void write0(int id, int b);
+//		private static native void writeBytes0(int id, byte[] b, int off, int len);
+//		private static native void flush0(int id);
+//	}
+func goOutputStreamBytecode() []byte {
+	cw := newClassWriter(goOutputStreamClass, "java/io/OutputStream")
+	cw.field(accPrivate|accFinal, "id", "I")
+
+	cw.method(accPublic, "<init>", "(I)V", 2, 2).
+		op(opAload0).
+		invoke(opInvokespecial, "java/io/OutputStream", "<init>", "()V").
+		op(opAload0, opIload1).
+		fieldOp(opPutfield, goOutputStreamClass, "id", "I").
+		op(opReturn)
+
+	cw.method(accPublic, "write", "(I)V", 2, 2).
+		op(opAload0).
+		fieldOp(opGetfield, goOutputStreamClass, "id", "I").
+		op(opIload1).
+		invoke(opInvokestatic, goOutputStreamClass, "write0", "(II)V").
+		op(opReturn)
+
+	cw.method(accPublic, "write", "([BII)V", 4, 4).
+		op(opAload0).
+		fieldOp(opGetfield, goOutputStreamClass, "id", "I").
+		op(opAload1, opIload2, opIload3).
+		invoke(opInvokestatic, goOutputStreamClass, "writeBytes0", "(I[BII)V").
+		op(opReturn)
+
+	cw.method(accPublic, "flush", "()V", 1, 1).
+		op(opAload0).
+		fieldOp(opGetfield, goOutputStreamClass, "id", "I").
+		invoke(opInvokestatic, goOutputStreamClass, "flush0", "(I)V").
+		op(opReturn)
+
+	cw.nativeMethod(accPrivate|accStatic, "write0", "(II)V")
+	cw.nativeMethod(accPrivate|accStatic, "writeBytes0", "(I[BII)V")
+	cw.nativeMethod(accPrivate|accStatic, "flush0", "(I)V")
+
+	return cw.bytes()
+}
+
+// goInputStreamBytecode returns the class file of:
+//
+//	public class GoInputStream extends InputStream {
+//		private final int id;
+//
+//		public GoInputStream(int id) {
+//			this.id = id;
+//		}
+//
+//		public int read() {
+//			return read0(id);
+//		}
+//
+//		public int read(byte[] b, int off, int len) {
+//			return readBytes0(id, b, off, len);
+//		}
+//
+//		private static native int read0(int id);
+//		private static native int readBytes0(int id, byte[] b, int off, int len);
+//	}
+func goInputStreamBytecode() []byte {
+	cw := newClassWriter(goInputStreamClass, "java/io/InputStream")
+	cw.field(accPrivate|accFinal, "id", "I")
+
+	cw.method(accPublic, "<init>", "(I)V", 2, 2).
+		op(opAload0).
+		invoke(opInvokespecial, "java/io/InputStream", "<init>", "()V").
+		op(opAload0, opIload1).
+		fieldOp(opPutfield, goInputStreamClass, "id", "I").
+		op(opReturn)
+
+	cw.method(accPublic, "read", "()I", 1, 1).
+		op(opAload0).
+		fieldOp(opGetfield, goInputStreamClass, "id", "I").
+		invoke(opInvokestatic, goInputStreamClass, "read0", "(I)I").
+		op(opIreturn)
+
+	cw.method(accPublic, "read", "([BII)I", 4, 4).
+		op(opAload0).
+		fieldOp(opGetfield, goInputStreamClass, "id", "I").
+		op(opAload1, opIload2, opIload3).
+		invoke(opInvokestatic, goInputStreamClass, "readBytes0", "(I[BII)I").
+		op(opIreturn)
+
+	cw.nativeMethod(accPrivate|accStatic, "read0", "(I)I")
+	cw.nativeMethod(accPrivate|accStatic, "readBytes0", "(I[BII)I")
+
+	return cw.bytes()
+}
@@ -0,0 +1,93 @@
+package jnigi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NEGOTIATE_VERSION can be passed to NewJVMInitArgs instead of a JNI version, so that CreateJVM
+// uses the highest version supported by the JVM.
+const NEGOTIATE_VERSION = 0
+
+// knownVersions are the JNI versions tried by CreateJVM with NEGOTIATE_VERSION, highest first.
+var knownVersions = []int{
+	JNI_VERSION_21,
+	JNI_VERSION_20,
+	JNI_VERSION_19,
+	JNI_VERSION_10,
+	JNI_VERSION_9,
+	JNI_VERSION_1_8,
+	JNI_VERSION_1_6,
+	JNI_VERSION_1_4,
+	JNI_VERSION_1_2,
+}
+
+// ErrUnsupported is returned when a JNI function is not supported by the JVM, or by the jni.h
+// jnigi was built with. Use Env.Supports to check first.
+var ErrUnsupported = errors.New("JNIGI: not supported by this JVM")
+
+// VersionString returns a JNI version as a string like "1.8" or "21".
+func VersionString(version int) string {
+	if version == NEGOTIATE_VERSION {
+		return "negotiated"
+	}
+	major, minor := version>>16, version&0xffff
+	if major == 1 {
+		return fmt.Sprintf("1.%d", minor)
+	}
+	if minor == 0 {
+		return fmt.Sprintf("%d", major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+// Version calls JNI GetVersion, it returns the JNI version of the JVM, for example JNI_VERSION_21.
+func (j *Env) Version() int {
+	return int(getVersion(j.jniEnv))
+}
+
+// Feature is a JNI function that is not supported by all JVMs, see Env.Supports.
+type Feature int
+
+const (
+	// FeatureGetModule is JNI GetModule, added in JNI_VERSION_9.
+	FeatureGetModule Feature = iota
+	// FeatureIsVirtualThread is JNI IsVirtualThread, added in JNI_VERSION_21.
+	FeatureIsVirtualThread
+)
+
+func (f Feature) String() string {
+	switch f {
+	case FeatureGetModule:
+		return "GetModule"
+	case FeatureIsVirtualThread:
+		return "IsVirtualThread"
+	default:
+		return fmt.Sprintf("Feature(%d)", int(f))
+	}
+}
+
+// Supports returns true if feature can be used, it must be supported by the JVM and be in the jni.h
+// jnigi was built with.
+func (j *Env) Supports(feature Feature) bool {
+	switch feature {
+	case FeatureGetModule:
+		return haveGetModule && j.Version() >= JNI_VERSION_9
+	case FeatureIsVirtualThread:
+		return haveIsVirtualThread && j.Version() >= JNI_VERSION_21
+	default:
+		return false
+	}
+}
+
+// IsVirtualThread calls JNI IsVirtualThread, it returns true if thread is a virtual thread.
+// ErrUnsupported is returned if FeatureIsVirtualThread is not supported.
+func (j *Env) IsVirtualThread(thread *ObjectRef) (bool, error) {
+	if !j.Supports(FeatureIsVirtualThread) {
+		return false, ErrUnsupported
+	}
+	if err := j.checkRef("IsVirtualThread", thread); err != nil {
+		return false, err
+	}
+	return toBool(isVirtualThread(j.jniEnv, thread.jobject)), nil
+}
@@ -27,6 +27,27 @@ jint dyn_JNI_CreateJavaVM(JavaVM **pvm, void **penv, void *args) {
     return var_JNI_CreateJavaVM(pvm, penv, args);
 }
 
+typedef jint (*type_JNI_GetCreatedJavaVMs)(JavaVM**, jsize, jsize*);
+
+type_JNI_GetCreatedJavaVMs var_JNI_GetCreatedJavaVMs;
+
+// load_JNI_GetCreatedJavaVMs looks up JNI_GetCreatedJavaVMs in the libraries loaded by the process
+// if LoadJVMLib was not called, for example when running inside a Java process. It returns 0 if it
+// is not found.
+int load_JNI_GetCreatedJavaVMs(void) {
+    if (var_JNI_GetCreatedJavaVMs == NULL) {
+        HMODULE jvm = GetModuleHandleA("jvm.dll");
+        if (jvm != NULL) {
+            var_JNI_GetCreatedJavaVMs = (type_JNI_GetCreatedJavaVMs)GetProcAddress(jvm, "JNI_GetCreatedJavaVMs");
+        }
+    }
+    return var_JNI_GetCreatedJavaVMs != NULL;
+}
+
+jint dyn_JNI_GetCreatedJavaVMs(JavaVM **vmBuf, jsize bufLen, jsize *nVMs) {
+    return var_JNI_GetCreatedJavaVMs(vmBuf, bufLen, nVMs);
+}
+
 */
 import "C"
 
@@ -44,6 +65,13 @@ func jni_CreateJavaVM(pvm unsafe.Pointer, penv unsafe.Pointer, args unsafe.Point
 	return jint(C.dyn_JNI_CreateJavaVM((**C.JavaVM)(pvm), (*unsafe.Pointer)(penv), (unsafe.Pointer)(args)))
 }
 
+func jni_GetCreatedJavaVMs(vmBuf unsafe.Pointer, bufLen int, nVMs unsafe.Pointer) (jint, error) {
+	if C.load_JNI_GetCreatedJavaVMs() == 0 {
+		return 0, errors.New("could not find JNI_GetCreatedJavaVMs in jvm.dll")
+	}
+	return jint(C.dyn_JNI_GetCreatedJavaVMs((**C.JavaVM)(vmBuf), C.jsize(bufLen), (*C.jsize)(nVMs))), nil
+}
+
 // LoadJVMLib loads jvm.dll as specified in jvmLibPath
 func LoadJVMLib(jvmLibPath string) error {
 	// use the golang.org/x/sys/windows LoadLibrary function to handle paths with unicode characters
@@ -68,5 +96,12 @@ func LoadJVMLib(jvmLibPath string) error {
 		return errors.New("could not find JNI_CreateJavaVM in jvm.dll")
 	}
 	C.var_JNI_CreateJavaVM = C.type_JNI_CreateJavaVM(ptr)
+
+	// optional, GetCreatedJVMs looks for it in the process if it is not found
+	cs4 := cString("JNI_GetCreatedJavaVMs")
+	defer free(cs4)
+	if ptr = C.GetProcAddress(cLibHandle, (*C.char)(cs4)); ptr != nil {
+		C.var_JNI_GetCreatedJavaVMs = C.type_JNI_GetCreatedJavaVMs(ptr)
+	}
 	return nil
 }